@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/blubywaff/ftag/internal/db"
+	"github.com/blubywaff/ftag/internal/model"
+)
+
+type CollectionForm struct {
+	// only when editing
+	CollectionId string
+	Name         string
+	Description  string
+	// only when creating
+	Tags string
+	// only when editing
+	AddTags string
+	DelTags string
+}
+
+type MemberChange struct {
+	CollectionId string
+	// appended in this order
+	Add    []string
+	Remove []string
+}
+
+type Reorder struct {
+	CollectionId string
+	// every member exactly once
+	Members []string
+}
+
+// writes the collection after a change, or the error that stopped it
+func writeCollection(res http.ResponseWriter, status int, c model.Collection, err error) {
+	switch {
+	case errors.Is(err, db.INVALID_COLLECTION):
+		http.Error(res, "invalid name or description", 400)
+	case errors.Is(err, db.NO_RESULT):
+		http.Error(res, "no such collection or resource", 404)
+	case errors.Is(err, db.MEMBERS_CHANGED):
+		http.Error(res, "order must have every member exactly once", 409)
+	case err != nil:
+		res.WriteHeader(500)
+		log.Println("error changing collection", err)
+	default:
+		writeJsonStatus(res, status, c)
+	}
+}
+
+// GET ?id= returns a collection and without id lists them all, POST creates one, DELETE ?id= deletes it.
+// The members of a collection are paged through in order by /api/query?collection=<id>
+func collection(res http.ResponseWriter, req *http.Request) {
+	id := req.URL.Query().Get("id")
+	switch req.Method {
+	case "GET":
+		if id == "" {
+			cs, err := client.Collections(req.Context())
+			if err != nil {
+				res.WriteHeader(500)
+				log.Println("error listing collections", err)
+				return
+			}
+			writeJson(res, cs)
+			return
+		}
+		c, err := client.GetCollection(req.Context(), id)
+		writeCollection(res, 200, c, err)
+	case "POST":
+		var form CollectionForm
+		if err := json.NewDecoder(req.Body).Decode(&form); err != nil {
+			res.WriteHeader(400)
+			return
+		}
+		var tags model.TagSet
+		if badtags := tags.FillFromString(form.Tags); len(badtags) != 0 {
+			http.Error(res, "Some tags were invalid.", 400)
+			return
+		}
+		c, err := client.CreateCollection(req.Context(), form.Name, form.Description, tags)
+		writeCollection(res, 201, c, err)
+	case "DELETE":
+		err := client.DeleteCollection(req.Context(), id)
+		if errors.Is(err, db.NO_RESULT) {
+			http.Error(res, "no such collection", 404)
+			return
+		}
+		if err != nil {
+			res.WriteHeader(500)
+			log.Println("error deleting collection", err)
+			return
+		}
+		res.WriteHeader(204)
+	default:
+		res.WriteHeader(405)
+	}
+}
+
+func collectionEdit(res http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		res.WriteHeader(405)
+		return
+	}
+	var form CollectionForm
+	if err := json.NewDecoder(req.Body).Decode(&form); err != nil {
+		res.WriteHeader(400)
+		return
+	}
+	var addtags, deltags model.TagSet
+	addtags.FillFromString(form.AddTags)
+	deltags.FillFromString(form.DelTags)
+	c, err := client.EditCollection(req.Context(), form.CollectionId, form.Name, form.Description, addtags, deltags)
+	writeCollection(res, 200, c, err)
+}
+
+func collectionMembers(res http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		res.WriteHeader(405)
+		return
+	}
+	var mc MemberChange
+	if err := json.NewDecoder(req.Body).Decode(&mc); err != nil {
+		res.WriteHeader(400)
+		return
+	}
+	c, err := client.ChangeMembers(req.Context(), mc.CollectionId, mc.Add, mc.Remove)
+	writeCollection(res, 200, c, err)
+}
+
+func collectionReorder(res http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		res.WriteHeader(405)
+		return
+	}
+	var ro Reorder
+	if err := json.NewDecoder(req.Body).Decode(&ro); err != nil {
+		res.WriteHeader(400)
+		return
+	}
+	c, err := client.ReorderCollection(req.Context(), ro.CollectionId, ro.Members)
+	writeCollection(res, 200, c, err)
+}
+
+// ?id= lists the collections a resource is in
+func resourceCollections(res http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		res.WriteHeader(405)
+		return
+	}
+	id := req.URL.Query().Get("id")
+	if id == "" {
+		res.WriteHeader(400)
+		return
+	}
+	cs, err := client.CollectionsOf(req.Context(), id)
+	if err != nil {
+		res.WriteHeader(500)
+		log.Println("error listing collections", err)
+		return
+	}
+	writeJson(res, cs)
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/blubywaff/ftag/internal/blob"
+	"github.com/blubywaff/ftag/internal/config"
+	"github.com/blubywaff/ftag/internal/derive"
+)
+
+var deriver *derive.Deriver
+
+// resources waiting for their variants, see deriveNew
+var deriveQueue = make(chan string, 1024)
+
+func newDeriver() *derive.Deriver {
+	dc := config.Global.Derive
+	variants := make([]derive.Variant, 0, len(dc.Variants))
+	for _, v := range dc.Variants {
+		variants = append(variants, derive.Variant{Name: v.Name, Width: v.Width, Height: v.Height, Format: v.Format})
+	}
+	return &derive.Deriver{
+		Store:        blobs,
+		Variants:     variants,
+		Quality:      dc.Quality,
+		MaxPixels:    dc.MaxPixels,
+		MaxDimension: dc.MaxDimension,
+		Cache:        &derive.Cache{Store: blobs, MaxSize: dc.CacheSize},
+	}
+}
+
+// Queues the variants of newly stored images to be generated ahead of their first request.
+// If the queue is full they are left to be generated lazily.
+func deriveNew(results []UploadResult) {
+	if !config.Global.Derive.Eager {
+		return
+	}
+	for _, r := range results {
+		if r.Status != 201 || !derive.Supported(r.Mimetype) {
+			continue
+		}
+		select {
+		case deriveQueue <- r.Id:
+		default:
+		}
+	}
+}
+
+// Generates queued variants one resource at a time until ctx is done
+func runDeriver(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case id := <-deriveQueue:
+			if err := deriver.Generate(ctx, id); err != nil {
+				log.Println("could not generate variants", id, err)
+			}
+		}
+	}
+}
+
+func serveVariant(res http.ResponseWriter, req *http.Request, id string, variant string) {
+	if strings.Contains(id, "/") {
+		http.Error(res, "no such variant", 404)
+		return
+	}
+	f, err := deriver.Open(req.Context(), id, variant)
+	switch {
+	case errors.Is(err, derive.UNKNOWN_VARIANT):
+		http.Error(res, "unknown variant", 400)
+		return
+	case errors.Is(err, fs.ErrNotExist), errors.Is(err, blob.INVALID_KEY),
+		errors.Is(err, derive.NOT_IMAGE), errors.Is(err, derive.TOO_MANY_PIXELS):
+		http.Error(res, "no such variant", 404)
+		return
+	case err != nil:
+		log.Println("could not open variant", id, variant, err)
+		http.Error(res, "Server error", 500)
+		return
+	}
+	defer f.Close()
+	bi, err := blobs.Stat(req.Context(), derive.Key(id, variant))
+	if err != nil {
+		http.Error(res, "Server error", 500)
+		return
+	}
+	for _, v := range deriver.Variants {
+		if v.Name == variant {
+			setContentType(res, v.Mimetype())
+		}
+	}
+	http.ServeContent(res, req, "", bi.ModTime, f)
+}
+
+// a missing parameter is 0 so that only one side needs to be given
+func dimensionParam(q url.Values, name string) (int, error) {
+	str := q.Get(name)
+	if str == "" {
+		return 0, nil
+	}
+	return strconv.Atoi(str)
+}
+
+// serves the image resized according to ?w=&h=&fit=&fmt=, see derive.Options
+func serveResized(res http.ResponseWriter, req *http.Request, id string) {
+	q := req.URL.Query()
+	o := derive.Options{Fit: q.Get("fit"), Format: q.Get("fmt")}
+	if o.Fit == "" {
+		o.Fit = derive.Contain
+	}
+	if o.Format == "" {
+		o.Format = derive.Jpeg
+	}
+	var err, herr error
+	o.Width, err = dimensionParam(q, "w")
+	o.Height, herr = dimensionParam(q, "h")
+	if err != nil || herr != nil {
+		http.Error(res, "invalid dimensions", 400)
+		return
+	}
+	if strings.Contains(id, "/") {
+		http.Error(res, "no such resource", 404)
+		return
+	}
+	f, err := deriver.Render(req.Context(), id, o)
+	switch {
+	case errors.Is(err, derive.INVALID_OPTIONS), errors.Is(err, derive.UNSUPPORTED_FORMAT):
+		http.Error(res, err.Error(), 400)
+		return
+	case errors.Is(err, fs.ErrNotExist), errors.Is(err, blob.INVALID_KEY):
+		http.Error(res, "no such resource", 404)
+		return
+	case errors.Is(err, derive.NOT_IMAGE), errors.Is(err, derive.TOO_MANY_PIXELS):
+		http.Error(res, err.Error(), 415)
+		return
+	case err != nil:
+		log.Println("could not resize", id, err)
+		http.Error(res, "Server error", 500)
+		return
+	}
+	defer f.Close()
+	setContentType(res, o.Mimetype())
+	http.ServeContent(res, req, "", time.Time{}, f)
+}
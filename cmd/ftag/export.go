@@ -0,0 +1,301 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/blubywaff/ftag/internal/db"
+	"github.com/blubywaff/ftag/internal/model"
+)
+
+// resources fetched per query while exporting
+const exportPage = 500
+
+// where exported files go, either a directory or a tar stream
+type exportSink interface {
+	Add(ctx context.Context, name string, size int64, r io.Reader) error
+	Close() error
+}
+
+type dirSink struct {
+	dir string
+}
+
+func (d dirSink) Add(ctx context.Context, name string, size int64, r io.Reader) error {
+	path := filepath.Join(d.dir, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return err
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (d dirSink) Close() error { return nil }
+
+type tarSink struct {
+	tw *tar.Writer
+	c  io.Closer
+}
+
+func (t tarSink) Add(ctx context.Context, name string, size int64, r io.Reader) error {
+	err := t.tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: size, Typeflag: tar.TypeReg})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(t.tw, r)
+	return err
+}
+
+func (t tarSink) Close() error {
+	err := t.tw.Close()
+	if cerr := t.c.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// Writes resources and their blobs in the layout read by `ftag import`,
+// which is the same as that of tojanus/export.py with named files added under files/<id>/.
+func runExport(ctx context.Context, args []string) error {
+	fset := flag.NewFlagSet("export", flag.ExitOnError)
+	format := fset.String("format", "dir", "Either dir or tar.")
+	intags := fset.String("include", "", "Only resources with all of these tags.")
+	extags := fset.String("exclude", "", "Skip resources with any of these tags.")
+	source := fset.String("source", "", "Only resources whose source contains this.")
+	fset.Usage = func() {
+		fmt.Fprintln(fset.Output(), "usage: ftag export [flags] <output dir or tar file, - for stdout>")
+		fset.PrintDefaults()
+	}
+	fset.Parse(args)
+	if fset.NArg() != 1 {
+		fset.Usage()
+		return errors.New("invalid arguments")
+	}
+	out := fset.Arg(0)
+
+	query := model.Query{Source: *source, Untagged: true}
+	if bad := query.Include.FillFromString(*intags); len(bad) != 0 {
+		return fmt.Errorf("invalid include tags: %v", bad)
+	}
+	if bad := query.Exclude.FillFromString(*extags); len(bad) != 0 {
+		return fmt.Errorf("invalid exclude tags: %v", bad)
+	}
+
+	var sink exportSink
+	switch *format {
+	case "dir":
+		if err := os.MkdirAll(out, os.ModePerm); err != nil {
+			return err
+		}
+		sink = dirSink{out}
+	case "tar":
+		var w io.WriteCloser = os.Stdout
+		if out != "-" {
+			f, err := os.Create(out)
+			if err != nil {
+				return err
+			}
+			w = f
+		}
+		sink = tarSink{tar.NewWriter(w), w}
+	default:
+		return errors.New("unknown format: " + *format)
+	}
+
+	if err := exportProperties(ctx, sink); err != nil {
+		sink.Close()
+		return err
+	}
+	entries, err := exportResources(ctx, query, sink)
+	if err != nil {
+		sink.Close()
+		return err
+	}
+	if err := exportCollections(ctx, entries, sink); err != nil {
+		sink.Close()
+		return err
+	}
+	bts, err := json.Marshal(entries)
+	if err != nil {
+		sink.Close()
+		return err
+	}
+	// written last so that a manifest is only present for a complete export
+	if err := sink.Add(ctx, "export.json", int64(len(bts)), bytes.NewReader(bts)); err != nil {
+		sink.Close()
+		return err
+	}
+	if err := sink.Close(); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "progress: exported %d resources\n", len(entries))
+	return nil
+}
+
+// The matches are found once up front and then read a page at a time,
+// so that uploads during the export neither skip nor repeat any of them.
+func exportResources(ctx context.Context, query model.Query, sink exportSink) ([]ExportEntry, error) {
+	ids, err := client.TagQueryIds(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	exported := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		exported[id] = true
+	}
+	entries := make([]ExportEntry, 0, len(ids))
+	for page := range slices.Chunk(ids, exportPage) {
+		// those removed since are left out
+		rs, err := client.GetFiles(ctx, page)
+		if err != nil {
+			return nil, err
+		}
+		rels, err := client.RelationsFrom(ctx, page)
+		if err != nil {
+			return nil, err
+		}
+		relsFrom := make(map[string][]ExportRelation)
+		for _, rel := range rels {
+			if exported[rel.To] {
+				relsFrom[rel.From] = append(relsFrom[rel.From], ExportRelation{Type: rel.Type, To: rel.To})
+			}
+		}
+		slices.SortFunc(rs, func(a, b model.Resource) int {
+			return slices.Index(page, a.Id) - slices.Index(page, b.Id)
+		})
+		for _, r := range rs {
+			e := ExportEntry{
+				Id:        r.Id,
+				Mime:      r.Mimetype,
+				Upload:    r.CreatedAt.Format(db.TimeFormat),
+				Tags:      r.Tags.Inner,
+				Source:    r.Source,
+				Props:     r.Props,
+				Relations: relsFrom[r.Id],
+			}
+			if r.Kind != model.KindFile {
+				e.Kind, e.Url, e.Title, e.Text = r.Kind, r.Url, r.Title, r.Text
+			}
+			if e.Tags == nil {
+				e.Tags = []string{}
+			}
+			for _, f := range r.Files {
+				e.Files = append(e.Files, ExportFile{
+					Name:     f.Name,
+					Mime:     f.Mimetype,
+					Added:    f.AddedAt.Format(db.TimeFormat),
+					Filename: f.Filename,
+				})
+			}
+			if !e.hasFile() {
+				entries = append(entries, e)
+				continue
+			}
+			if err := exportBlob(ctx, e, sink); err != nil {
+				return nil, fmt.Errorf("resource %s: %w", r.Id, err)
+			}
+			entries = append(entries, e)
+		}
+		// stderr so that a tar written to stdout stays intact
+		fmt.Fprintf(os.Stderr, "progress: resources %d\n", len(entries))
+	}
+	return entries, nil
+}
+
+// the content and the named files of e
+func exportBlob(ctx context.Context, e ExportEntry, sink exportSink) error {
+	if err := exportKey(ctx, e.Id, e.Filename(), sink); err != nil {
+		return err
+	}
+	for _, f := range e.Files {
+		// the key is also the path in the export
+		key := db.FileKey(e.Id, f.Name)
+		if err := exportKey(ctx, key, key, sink); err != nil {
+			return fmt.Errorf("file %q: %w", f.Name, err)
+		}
+	}
+	return nil
+}
+
+func exportKey(ctx context.Context, key string, name string, sink exportSink) error {
+	bi, err := blobs.Stat(ctx, key)
+	if err != nil {
+		return err
+	}
+	f, err := blobs.Open(ctx, key)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return sink.Add(ctx, name, bi.Size, f)
+}
+
+// Writes every property definition to properties.json
+func exportProperties(ctx context.Context, sink exportSink) error {
+	defs, err := client.PropertyDefs(ctx)
+	if err != nil {
+		return err
+	}
+	eps := make([]ExportProperty, 0, len(defs))
+	for _, d := range defs {
+		eps = append(eps, ExportProperty{Key: d.Key, Type: d.Type})
+	}
+	bts, err := json.Marshal(eps)
+	if err != nil {
+		return err
+	}
+	return sink.Add(ctx, "properties.json", int64(len(bts)), bytes.NewReader(bts))
+}
+
+// Writes every collection to collections.json, with only the members in entries
+func exportCollections(ctx context.Context, entries []ExportEntry, sink exportSink) error {
+	cs, err := client.Collections(ctx)
+	if err != nil {
+		return err
+	}
+	exported := make(map[string]bool, len(entries))
+	for _, e := range entries {
+		exported[e.Id] = true
+	}
+	ecs := make([]ExportCollection, 0, len(cs))
+	for _, c := range cs {
+		ec := ExportCollection{
+			Id:          c.Id,
+			Name:        c.Name,
+			Description: c.Description,
+			Created:     c.CreatedAt.Format(db.TimeFormat),
+			Tags:        c.Tags.Inner,
+			Members:     []string{},
+		}
+		if ec.Tags == nil {
+			ec.Tags = []string{}
+		}
+		for _, m := range c.Members {
+			if exported[m] {
+				ec.Members = append(ec.Members, m)
+			}
+		}
+		ecs = append(ecs, ec)
+	}
+	bts, err := json.Marshal(ecs)
+	if err != nil {
+		return err
+	}
+	return sink.Add(ctx, "collections.json", int64(len(bts)), bytes.NewReader(bts))
+}
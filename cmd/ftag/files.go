@@ -0,0 +1,109 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net/http"
+
+	"github.com/blubywaff/ftag/internal/config"
+	"github.com/blubywaff/ftag/internal/db"
+	"github.com/blubywaff/ftag/internal/model"
+)
+
+// ?id=&name= for the named files of a resource, served by /files/<id>/<name>.
+// GET lists them, POST adds the first uploadfile of a multipart form under name, DELETE removes it.
+// Tags stay on the resource, a file with the same name has to be removed before it is added again.
+func resourceFiles(res http.ResponseWriter, req *http.Request) {
+	id := req.URL.Query().Get("id")
+	name := req.URL.Query().Get("name")
+	if id == "" {
+		res.WriteHeader(400)
+		return
+	}
+	switch req.Method {
+	case "GET":
+		rsc, err := client.GetFile(req.Context(), id)
+		if errors.Is(err, db.NO_RESULT) {
+			http.Error(res, "no such resource", 404)
+			return
+		}
+		if err != nil {
+			res.WriteHeader(500)
+			log.Println("error listing files", err)
+			return
+		}
+		files := rsc.Files
+		if files == nil {
+			files = []model.File{}
+		}
+		writeJson(res, files)
+	case "POST":
+		if !db.ValidFileName(name) {
+			http.Error(res, "invalid name field", 400)
+			return
+		}
+		addNamedFile(res, req, id, name)
+	case "DELETE":
+		err := client.RemoveNamedFile(req.Context(), id, name)
+		if errors.Is(err, db.NO_RESULT) {
+			http.Error(res, "no such file", 404)
+			return
+		}
+		if err != nil {
+			res.WriteHeader(500)
+			log.Println("error removing file", err)
+			return
+		}
+		res.WriteHeader(204)
+	default:
+		res.WriteHeader(405)
+	}
+}
+
+func addNamedFile(res http.ResponseWriter, req *http.Request, id string, name string) {
+	req.Body = http.MaxBytesReader(res, req.Body, config.Global.Upload.MaxRequestSize)
+	mr, err := req.MultipartReader()
+	if err != nil {
+		http.Error(res, "expected multipart form", 400)
+		return
+	}
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			http.Error(res, "missing uploadfile", 400)
+			return
+		}
+		if isTooLarge(err) {
+			http.Error(res, "upload too large", 413)
+			return
+		}
+		if err != nil {
+			http.Error(res, "malformed multipart form", 400)
+			return
+		}
+		if part.FormName() != "uploadfile" {
+			part.Close()
+			continue
+		}
+		f := &limitReader{part, config.Global.Upload.MaxFileSize}
+		file, err := client.AddNamedFile(req.Context(), id, name, f, part.FileName())
+		part.Close()
+		switch {
+		case errors.Is(err, db.NO_RESULT):
+			http.Error(res, "no such resource", 404)
+		case errors.Is(err, db.FILE_EXISTS):
+			http.Error(res, "a file with that name already exists", 409)
+		case isTooLarge(err):
+			http.Error(res, "file too large", 413)
+		case errors.Is(err, db.STRIP_FAILED):
+			http.Error(res, "could not remove embedded metadata", 422)
+		case err != nil:
+			res.WriteHeader(500)
+			log.Println("error adding file", err)
+		default:
+			writeJsonStatus(res, 201, file)
+		}
+		return
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/blubywaff/ftag/internal/db"
+)
+
+// orphan blobs younger than this may still be part of an upload
+const fsckGrace = time.Hour
+
+// variants made from content that fsck has since put back from a version are stale
+func forgetRestored(ctx context.Context, report db.FsckReport) {
+	for _, id := range report.Restored {
+		if err := deriver.Forget(ctx, id); err != nil {
+			log.Println("could not drop derived files of", id, err)
+		}
+	}
+}
+
+// Reports disagreements between the graph and blob storage, fixing them with -repair.
+// Exits with an error if problems were found and not repaired.
+func runFsck(ctx context.Context, args []string) error {
+	fset := flag.NewFlagSet("fsck", flag.ExitOnError)
+	repair := fset.Bool("repair", false, "Fix the problems found.")
+	grace := fset.Duration("grace", fsckGrace, "Orphan blobs younger than this are never deleted.")
+	fset.Parse(args)
+
+	report, err := client.Fsck(ctx, *repair, *grace)
+	if err != nil {
+		return err
+	}
+	forgetRestored(ctx, report)
+	bts, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(bts))
+	if !report.Clean() && !report.Repaired {
+		return errors.New("fsck found problems, rerun with -repair to fix them")
+	}
+	return nil
+}
+
+// GET reports, POST with ?repair=true also repairs
+func adminFsck(res http.ResponseWriter, req *http.Request) {
+	repair := false
+	switch req.Method {
+	case "GET":
+	case "POST":
+		var err error
+		repair, err = boolParam(req, "repair")
+		if err != nil {
+			http.Error(res, "invalid repair field", 400)
+			return
+		}
+	default:
+		res.WriteHeader(405)
+		return
+	}
+	report, err := client.Fsck(req.Context(), repair, fsckGrace)
+	if err != nil {
+		res.WriteHeader(500)
+		log.Println("fsck failed", err)
+		return
+	}
+	forgetRestored(req.Context(), report)
+	writeJson(res, report)
+}
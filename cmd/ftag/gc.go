@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/blubywaff/ftag/internal/config"
+	"github.com/blubywaff/ftag/internal/db"
+)
+
+// totals since startup, served on /api/admin/metrics
+var (
+	gcDeletedBlobs   = new(expvar.Int)
+	gcReclaimedBytes = new(expvar.Int)
+	gcRuns           = new(expvar.Int)
+)
+
+// not published with expvar.Publish, which would also serve them next to
+// the command line and memory statistics that expvar publishes by default
+var metrics = new(expvar.Map)
+
+func init() {
+	metrics.Set("gc_deleted_blobs", gcDeletedBlobs)
+	metrics.Set("gc_reclaimed_bytes", gcReclaimedBytes)
+	metrics.Set("gc_runs", gcRuns)
+}
+
+// Responds with the ftag counters as a json object
+func adminMetrics(res http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		res.WriteHeader(405)
+		return
+	}
+	res.Header().Set("Content-Type", "application/json; charset=utf-8")
+	fmt.Fprint(res, metrics.String())
+}
+
+func gcOptions(dryRun bool) db.GCOptions {
+	return db.GCOptions{
+		DryRun:       dryRun,
+		Grace:        config.Global.GC.Grace.Duration,
+		StagingGrace: config.Global.Upload.StagingExpiry.Duration,
+	}
+}
+
+func gc(ctx context.Context, opts db.GCOptions) (db.GCReport, error) {
+	report, err := client.GC(ctx, opts)
+	if err != nil {
+		return report, err
+	}
+	if !opts.DryRun {
+		gcRuns.Add(1)
+		gcDeletedBlobs.Add(int64(len(report.Collected)))
+		gcReclaimedBytes.Add(report.ReclaimedBytes)
+	}
+	return report, nil
+}
+
+func runGC(ctx context.Context, args []string) error {
+	fset := flag.NewFlagSet("gc", flag.ExitOnError)
+	dryRun := fset.Bool("dry-run", false, "Only list what would be deleted.")
+	grace := fset.Duration("grace", config.Global.GC.Grace.Duration, "Unreferenced blobs younger than this are kept.")
+	fset.Parse(args)
+
+	opts := gcOptions(*dryRun)
+	opts.Grace = *grace
+	report, err := gc(ctx, opts)
+	if err != nil {
+		return err
+	}
+	bts, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(bts))
+	return nil
+}
+
+// Collects every interval until ctx is done
+func runCollector(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			report, err := gc(ctx, gcOptions(false))
+			if err != nil {
+				log.Println("gc failed", err)
+				continue
+			}
+			if len(report.Collected) != 0 {
+				log.Println("gc reclaimed bytes:", report.ReclaimedBytes)
+			}
+		}
+	}
+}
+
+// GET is a dry run, POST collects
+func adminGC(res http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" && req.Method != "POST" {
+		res.WriteHeader(405)
+		return
+	}
+	report, err := gc(req.Context(), gcOptions(req.Method == "GET"))
+	if err != nil {
+		res.WriteHeader(500)
+		log.Println("gc failed", err)
+		return
+	}
+	writeJson(res, report)
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/blubywaff/ftag/internal/db"
+	"github.com/blubywaff/ftag/internal/model"
+)
+
+// One entry of export.json as written by tojanus/export.py
+type ExportEntry struct {
+	Id     string   `json:"id"`
+	Mime   string   `json:"mime"`
+	Upload string   `json:"upload"`
+	Tags   []string `json:"tags"`
+	// not written by export.py
+	Source string `json:"source,omitempty"`
+	// bookmarks and notes have no file, see model.Resource.Kind
+	Kind  string `json:"kind,omitempty"`
+	Url   string `json:"url,omitempty"`
+	Title string `json:"title,omitempty"`
+	Text  string `json:"text,omitempty"`
+	// stored next to the content under db.FileKey, see model.Resource.Files
+	Files []ExportFile `json:"files,omitempty"`
+	// custom properties by key, defined in properties.json
+	Props map[string]interface{} `json:"props,omitempty"`
+	// relations starting at this resource, only to others in the export
+	Relations []ExportRelation `json:"relations,omitempty"`
+}
+
+// A relation of an ExportEntry, see model.Relation
+type ExportRelation struct {
+	Type string `json:"type"`
+	To   string `json:"to"`
+}
+
+// One entry of collections.json, members are only those in the export
+type ExportCollection struct {
+	Id          string   `json:"id"`
+	Name        string   `json:"name"`
+	Description string   `json:"description,omitempty"`
+	Created     string   `json:"created"`
+	Tags        []string `json:"tags"`
+	Members     []string `json:"members"`
+}
+
+// One entry of properties.json, see model.PropertyDef
+type ExportProperty struct {
+	Key  string `json:"key"`
+	Type string `json:"type"`
+}
+
+// A named file of an ExportEntry
+type ExportFile struct {
+	Name     string `json:"name"`
+	Mime     string `json:"mime"`
+	Added    string `json:"added"`
+	Filename string `json:"filename,omitempty"`
+}
+
+func (e ExportEntry) hasFile() bool {
+	return e.Kind == "" || e.Kind == model.KindFile
+}
+
+// files are named <id>.<last part of the mimetype>
+func (e ExportEntry) Filename() string {
+	parts := strings.Split(e.Mime, "/")
+	return e.Id + "." + parts[len(parts)-1]
+}
+
+// Loads an export directory (export.json plus one file per resource, properties.json and collections.json) into the database.
+// Already imported resources and blobs are skipped, so it can simply be rerun after a crash.
+func runImport(ctx context.Context, args []string) error {
+	fset := flag.NewFlagSet("import", flag.ExitOnError)
+	batchSize := fset.Int("batch", 500, "Resources per transaction.")
+	fset.Usage = func() {
+		fmt.Fprintln(fset.Output(), "usage: ftag import [-batch n] <export dir>")
+		fset.PrintDefaults()
+	}
+	fset.Parse(args)
+	if fset.NArg() != 1 || *batchSize < 1 {
+		fset.Usage()
+		return errors.New("invalid arguments")
+	}
+	dir := fset.Arg(0)
+
+	bts, err := os.ReadFile(filepath.Join(dir, "export.json"))
+	if err != nil {
+		return err
+	}
+	var entries []ExportEntry
+	if err := json.Unmarshal(bts, &entries); err != nil {
+		return err
+	}
+
+	if err := importProperties(ctx, dir); err != nil {
+		return err
+	}
+
+	added, skipped := 0, 0
+	for start := 0; start < len(entries); start += *batchSize {
+		end := min(start+*batchSize, len(entries))
+		batch := make([]db.Imported, 0, end-start)
+		for _, e := range entries[start:end] {
+			im, err := importEntry(ctx, dir, e)
+			if err != nil {
+				return fmt.Errorf("resource %s: %w", e.Id, err)
+			}
+			batch = append(batch, im)
+		}
+		n, err := client.ImportResources(ctx, batch)
+		if err != nil {
+			return err
+		}
+		added += n
+		skipped += len(batch) - n
+		fmt.Printf("progress: resources %d / %d (%d added, %d already present)\n", end, len(entries), added, skipped)
+	}
+	// once every resource is present, relations may point either way
+	if err := importRelations(ctx, entries); err != nil {
+		return err
+	}
+	return importCollections(ctx, dir)
+}
+
+// defines those in properties.json, which older exports do not have
+func importProperties(ctx context.Context, dir string) error {
+	bts, err := os.ReadFile(filepath.Join(dir, "properties.json"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var eps []ExportProperty
+	if err := json.Unmarshal(bts, &eps); err != nil {
+		return err
+	}
+	for _, ep := range eps {
+		if err := client.DefineProperty(ctx, model.PropertyDef{Key: ep.Key, Type: ep.Type}); err != nil {
+			return fmt.Errorf("property %s: %w", ep.Key, err)
+		}
+	}
+	return nil
+}
+
+// from collections.json, which older exports do not have
+func importCollections(ctx context.Context, dir string) error {
+	bts, err := os.ReadFile(filepath.Join(dir, "collections.json"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var ecs []ExportCollection
+	if err := json.Unmarshal(bts, &ecs); err != nil {
+		return err
+	}
+	cs := make([]model.Collection, 0, len(ecs))
+	for _, ec := range ecs {
+		c := model.Collection{Id: ec.Id, Name: ec.Name, Description: ec.Description, Members: ec.Members}
+		c.CreatedAt, err = parseExportTime(ec.Created)
+		if err != nil {
+			return fmt.Errorf("collection %s: %w", ec.Id, err)
+		}
+		for _, t := range ec.Tags {
+			if err := c.Tags.Add(t); err != nil {
+				fmt.Printf("warning: collection %s: dropping tag %q: %v\n", ec.Id, t, err)
+			}
+		}
+		cs = append(cs, c)
+	}
+	n, err := client.ImportCollections(ctx, cs)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("progress: collections %d (%d added, %d already present)\n", len(cs), n, len(cs)-n)
+	return nil
+}
+
+// relations already present are left as they are
+func importRelations(ctx context.Context, entries []ExportEntry) error {
+	n := 0
+	for _, e := range entries {
+		for _, r := range e.Relations {
+			rel := model.Relation{Type: r.Type, From: e.Id, To: r.To}
+			err := client.Relate(ctx, rel)
+			if errors.Is(err, db.INVALID_RELATION) || errors.Is(err, db.RELATION_CONFLICT) || errors.Is(err, db.NO_RESULT) {
+				fmt.Printf("warning: resource %s: dropping relation %s %s: %v\n", e.Id, r.Type, r.To, err)
+				continue
+			}
+			if err != nil {
+				return fmt.Errorf("resource %s: %w", e.Id, err)
+			}
+			n++
+		}
+	}
+	if n != 0 {
+		fmt.Printf("progress: relations %d\n", n)
+	}
+	return nil
+}
+
+// times as written by ftag export or export.py
+func parseExportTime(str string) (time.Time, error) {
+	for _, tf := range db.TimeFormatP {
+		if t, err := time.Parse(tf, str); err == nil {
+			return t, nil
+		}
+	}
+	// python isoformat without a timezone
+	return time.Parse("2006-01-02T15:04:05.999999", str)
+}
+
+// copies the blobs if they are not already stored and builds the resource
+func importEntry(ctx context.Context, dir string, e ExportEntry) (db.Imported, error) {
+	rsc := model.Resource{Id: e.Id, Mimetype: e.Mime, Source: e.Source, Kind: e.Kind, Url: e.Url, Title: e.Title, Text: e.Text, Props: e.Props}
+	var err error
+	rsc.CreatedAt, err = parseExportTime(e.Upload)
+	if err != nil {
+		return db.Imported{}, err
+	}
+	for _, t := range e.Tags {
+		if err := rsc.Tags.Add(t); err != nil {
+			fmt.Printf("warning: resource %s: dropping tag %q: %v\n", e.Id, t, err)
+		}
+	}
+	if !e.hasFile() {
+		return db.Imported{Resource: rsc}, nil
+	}
+
+	hash, _, err := importBlob(ctx, filepath.Join(dir, e.Filename()), e.Id)
+	if err != nil {
+		return db.Imported{}, err
+	}
+	for _, ef := range e.Files {
+		if !db.ValidFileName(ef.Name) {
+			return db.Imported{}, fmt.Errorf("file %q: %w", ef.Name, db.INVALID_FILE_NAME)
+		}
+		f := model.File{Name: ef.Name, Mimetype: ef.Mime, Filename: ef.Filename}
+		f.AddedAt, err = parseExportTime(ef.Added)
+		if err != nil {
+			return db.Imported{}, fmt.Errorf("file %q: %w", ef.Name, err)
+		}
+		key := db.FileKey(e.Id, ef.Name)
+		f.Hash, f.Size, err = importBlob(ctx, filepath.Join(dir, filepath.FromSlash(key)), key)
+		if err != nil {
+			return db.Imported{}, fmt.Errorf("file %q: %w", ef.Name, err)
+		}
+		rsc.Files = append(rsc.Files, f)
+	}
+	return db.Imported{Resource: rsc, Hash: hash}, nil
+}
+
+// copies the file at path to key unless an earlier run already did, returns its sha256 and size
+func importBlob(ctx context.Context, path string, key string) (string, int64, error) {
+	src, err := os.Open(path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer src.Close()
+	fi, err := src.Stat()
+	if err != nil {
+		return "", 0, err
+	}
+
+	h := sha256.New()
+	bi, err := blobs.Stat(ctx, key)
+	switch {
+	case err == nil && bi.Size == fi.Size():
+		// copied by an earlier run, only the hash is needed
+		_, err = io.Copy(h, src)
+	case err == nil || errors.Is(err, fs.ErrNotExist):
+		// a partial copy from a crashed run is replaced
+		if err == nil {
+			if err := blobs.Delete(ctx, key); err != nil {
+				return "", 0, err
+			}
+		}
+		_, err = blobs.Put(ctx, key, io.TeeReader(src, h))
+	}
+	if err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(h.Sum(nil)), fi.Size(), nil
+}
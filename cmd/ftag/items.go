@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/blubywaff/ftag/internal/db"
+	"github.com/blubywaff/ftag/internal/model"
+	"github.com/blubywaff/ftag/internal/probe"
+)
+
+type ItemForm struct {
+	// only when editing
+	ResourceId string
+	// see model.Resource.Kind, not a file
+	Kind  string
+	Url   string
+	Title string
+	Text  string
+	// only when creating
+	Tags string
+}
+
+func (f ItemForm) item() db.Item {
+	return db.Item{Kind: f.Kind, Url: strings.TrimSpace(f.Url), Title: strings.TrimSpace(f.Title), Text: f.Text}
+}
+
+// bookmarks without a title are given the one of the page, if it can be fetched
+// the page is fetched like an upload by url, so the handlers get the upload timeout
+func fillTitle(ctx context.Context, item *db.Item) {
+	if item.Kind != model.KindBookmark || item.Title != "" {
+		return
+	}
+	title, err := fetcher.Title(ctx, item.Url)
+	if err != nil {
+		log.Println("could not fetch title of", item.Url, err)
+		return
+	}
+	item.Title = title
+}
+
+// a note of db.MaxText, with room for json escaping and the other fields
+const maxItemBody = 2*db.MaxText + maxFieldSize
+
+// creates a bookmark or note
+func itemNew(res http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		res.WriteHeader(405)
+		return
+	}
+	var form ItemForm
+	if err := json.NewDecoder(http.MaxBytesReader(res, req.Body, maxItemBody)).Decode(&form); err != nil {
+		if isTooLarge(err) {
+			http.Error(res, "bookmark or note too large", 413)
+			return
+		}
+		res.WriteHeader(400)
+		return
+	}
+	var tags model.TagSet
+	if badtags := tags.FillFromString(form.Tags); len(badtags) != 0 {
+		http.Error(res, "Some tags were invalid.", 400)
+		return
+	}
+	item := form.item()
+	fillTitle(req.Context(), &item)
+	ar, err := client.AddItem(req.Context(), item, tags)
+	if errors.Is(err, db.INVALID_ITEM) {
+		http.Error(res, "invalid bookmark or note", 400)
+		return
+	}
+	if err != nil {
+		res.WriteHeader(500)
+		log.Println("error adding item", err)
+		return
+	}
+	status := 201
+	if ar.Duplicate {
+		status = 200
+	}
+	writeJsonStatus(res, status, ar.Resource)
+}
+
+// replaces the url, title and text of a bookmark or note
+func itemEdit(res http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		res.WriteHeader(405)
+		return
+	}
+	var form ItemForm
+	if err := json.NewDecoder(http.MaxBytesReader(res, req.Body, maxItemBody)).Decode(&form); err != nil {
+		if isTooLarge(err) {
+			http.Error(res, "bookmark or note too large", 413)
+			return
+		}
+		res.WriteHeader(400)
+		return
+	}
+	rsc, err := client.GetFile(req.Context(), form.ResourceId)
+	if errors.Is(err, db.NO_RESULT) {
+		http.Error(res, "no such resource", 404)
+		return
+	}
+	if err != nil {
+		res.WriteHeader(500)
+		log.Println("error finding resource", err)
+		return
+	}
+	if rsc.Kind == model.KindFile {
+		http.Error(res, "resource is a file", 409)
+		return
+	}
+	form.Kind = rsc.Kind
+	item := form.item()
+	fillTitle(req.Context(), &item)
+	rsc, err = client.EditItem(req.Context(), form.ResourceId, item)
+	switch {
+	case errors.Is(err, db.INVALID_ITEM):
+		http.Error(res, "invalid bookmark or note", 400)
+	case errors.Is(err, db.NO_RESULT):
+		http.Error(res, "no such resource", 404)
+	case errors.Is(err, db.WRONG_KIND):
+		http.Error(res, "resource changed kind", 409)
+	case err != nil:
+		res.WriteHeader(500)
+		log.Println("error editing item", err)
+	default:
+		writeJson(res, rsc)
+	}
+}
+
+// the content of a bookmark is its url and that of a note its text
+func serveItem(res http.ResponseWriter, req *http.Request, rsc model.Resource) {
+	content := rsc.Text
+	if rsc.Kind == model.KindBookmark {
+		content = rsc.Url + "\r\n"
+	}
+	disposition := "inline"
+	if download, _ := boolParam(req, "download"); download {
+		disposition = "attachment"
+	}
+	name := rsc.Title
+	if name == "" {
+		name = rsc.Id
+	}
+	res.Header().Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{
+		"filename": probe.Filename(name, rsc.Mimetype),
+	}))
+	setContentType(res, rsc.Mimetype+"; charset=utf-8")
+	http.ServeContent(res, req, "", time.Time{}, strings.NewReader(content))
+}
@@ -1,38 +1,71 @@
 package main
 
 import (
+	"bufio"
 	"context"
 	"encoding/json"
 	"errors"
+	"flag"
 	"html/template"
+	"io"
 	"log"
+	"mime"
 	"net/http"
+	"net/url"
+	"os"
+	"path"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/blubywaff/ftag/internal/archive"
+	"github.com/blubywaff/ftag/internal/blob"
 	"github.com/blubywaff/ftag/internal/config"
 	"github.com/blubywaff/ftag/internal/db"
+	"github.com/blubywaff/ftag/internal/error"
+	"github.com/blubywaff/ftag/internal/fetch"
+	"github.com/blubywaff/ftag/internal/markdown"
 	"github.com/blubywaff/ftag/internal/model"
+	"github.com/blubywaff/ftag/internal/probe"
+	"github.com/blubywaff/ftag/internal/tus"
 )
 
 var templates *template.Template
 
 var client db.Database
 
+var fetcher *fetch.Fetcher
+
+var blobs blob.Store
+
 var (
 	INVALID_FORM_FIELD       = errors.New("invalid field in form")
 	EMPTY_FORM               = errors.New("empty form")
 	MISSING_FORM_REQUIREMENT = errors.New("required form field not present")
+	FILE_TOO_LARGE           = errors.New("file exceeds upload size limit")
+	FETCH_FAILED             = errors.New("could not download file")
 )
 
+// limit for non-file multipart fields
+const maxFieldSize = 1 << 16
+
 type TagChange struct {
 	AddTags    string
 	DelTags    string
 	ResourceId string
 }
 
+type PrivacyChange struct {
+	ResourceId string
+	// see model.Resource.Privacy
+	Privacy string
+}
+
 func writeJson[T any](res http.ResponseWriter, value T) {
+	writeJsonStatus(res, 200, value)
+}
+
+func writeJsonStatus[T any](res http.ResponseWriter, status int, value T) {
 	bts, err := json.Marshal(value)
 	if err != nil {
 		res.WriteHeader(500)
@@ -40,9 +73,9 @@ func writeJson[T any](res http.ResponseWriter, value T) {
 		return
 	}
 	res.Header().Add("Content-Type", "application/json")
+	res.WriteHeader(status)
 	_, err = res.Write(bts)
 	if err != nil {
-		res.WriteHeader(500)
 		log.Println("error with view.gohtml", err)
 	}
 }
@@ -94,8 +127,42 @@ func query(res http.ResponseWriter, req *http.Request) {
 		return
 	}
 	extag.Union(*userex.Duplicate().Difference(intag))
-	query := model.Query{Include: intag, Exclude: extag, Offset: index - 1, Limit: 1}
+	query := model.Query{
+		Include:    intag,
+		Exclude:    extag,
+		Source:     req.URL.Query().Get("source"),
+		Filename:   req.URL.Query().Get("filename"),
+		Kind:       req.URL.Query().Get("kind"),
+		Collection: req.URL.Query().Get("collection"),
+		Offset:     index - 1,
+		Limit:      1,
+	}
+	if query.Kind != "" && !model.ValidKind(query.Kind) {
+		http.Error(res, "invalid kind", 400)
+		return
+	}
+	query.Untagged, err = boolParam(req, "untagged")
+	if err != nil {
+		http.Error(res, "invalid untagged field", 400)
+		return
+	}
+	if err := relationQuery(req, &query); err != nil {
+		http.Error(res, err.Error(), 400)
+		return
+	}
+	if err := propQuery(req, &query); err != nil {
+		http.Error(res, err.Error(), 400)
+		return
+	}
+	if err := metaQuery(req.URL.Query(), &query); err != nil {
+		http.Error(res, err.Error(), 400)
+		return
+	}
 	rsrcs, err := client.TagQuery(req.Context(), query)
+	if errors.Is(err, db.UNKNOWN_PROPERTY) || errors.Is(err, db.INVALID_PROPERTY_VALUE) {
+		http.Error(res, err.Error(), 400)
+		return
+	}
 	if err != nil {
 		res.WriteHeader(500)
 		log.Println("err with viewPage db TagQuery", err)
@@ -112,6 +179,53 @@ func query(res http.ResponseWriter, req *http.Request) {
 	writeJson(res, rsrcs)
 }
 
+// Reads the optional technical metadata bounds of a query:
+// minwidth, maxwidth, minheight, maxheight, minsize, maxsize, minduration, maxduration and orientation
+func metaQuery(q url.Values, query *model.Query) error {
+	ints := map[string]*int{
+		"minwidth":  &query.MinWidth,
+		"maxwidth":  &query.MaxWidth,
+		"minheight": &query.MinHeight,
+		"maxheight": &query.MaxHeight,
+	}
+	for name, p := range ints {
+		if str := q.Get(name); str != "" {
+			v, err := strconv.Atoi(str)
+			if err != nil || v < 0 {
+				return errors.New("invalid " + name)
+			}
+			*p = v
+		}
+	}
+	sizes := map[string]*int64{"minsize": &query.MinSize, "maxsize": &query.MaxSize}
+	for name, p := range sizes {
+		if str := q.Get(name); str != "" {
+			v, err := strconv.ParseInt(str, 10, 64)
+			if err != nil || v < 0 {
+				return errors.New("invalid " + name)
+			}
+			*p = v
+		}
+	}
+	durations := map[string]*float64{"minduration": &query.MinDuration, "maxduration": &query.MaxDuration}
+	for name, p := range durations {
+		if str := q.Get(name); str != "" {
+			v, err := strconv.ParseFloat(str, 64)
+			if err != nil || v < 0 {
+				return errors.New("invalid " + name)
+			}
+			*p = v
+		}
+	}
+	switch o := q.Get("orientation"); o {
+	case "", model.Landscape, model.Portrait, model.Square:
+		query.Orientation = o
+	default:
+		return errors.New("invalid orientation")
+	}
+	return nil
+}
+
 func resource(res http.ResponseWriter, req *http.Request) {
 	if req.Method != "GET" {
 		res.WriteHeader(405)
@@ -127,10 +241,14 @@ func resource(res http.ResponseWriter, req *http.Request) {
 		return
 	}
 	rsrc, err := client.GetFile(req.Context(), idstr[0])
-	// TODO id doesn't exist
+	if errors.Is(err, db.NO_RESULT) {
+		http.Error(res, "no such resource", 404)
+		return
+	}
 	if err != nil {
 		res.WriteHeader(500)
 		log.Println("error finding resource", err)
+		return
 	}
 	writeJson(res, rsrc)
 }
@@ -163,54 +281,649 @@ func resourceTags(res http.ResponseWriter, req *http.Request) {
 	writeJson(res, rsc)
 }
 
-func upload(res http.ResponseWriter, req *http.Request) {
+// Sets whether embedded location and device data is removed from one resource,
+// overriding config.Config_Privacy. Responds with the updated resource.
+func resourcePrivacy(res http.ResponseWriter, req *http.Request) {
 	if req.Method != "POST" {
 		res.WriteHeader(405)
 		return
 	}
-	// 1024 megabytes
-	// consider using maltipart reader to avoid reading oversized uploads
-	err := req.ParseMultipartForm(1 << 30)
+	var pc PrivacyChange
+	if err := json.NewDecoder(req.Body).Decode(&pc); err != nil {
+		res.WriteHeader(400)
+		return
+	}
+	err := client.SetPrivacy(req.Context(), pc.ResourceId, pc.Privacy)
+	if errors.Is(err, db.INVALID_PRIVACY) {
+		http.Error(res, "invalid privacy", 400)
+		return
+	}
+	if errors.Is(err, db.NO_RESULT) {
+		http.Error(res, "no such resource", 404)
+		return
+	}
+	if err != nil {
+		res.WriteHeader(500)
+		log.Println("error setting privacy", err)
+		return
+	}
+	rsc, err := client.GetFile(req.Context(), pc.ResourceId)
 	if err != nil {
 		res.WriteHeader(500)
-		log.Println("error with multipart form upload")
+		return
+	}
+	writeJson(res, rsc)
+}
+
+// like io.LimitReader, but reports FILE_TOO_LARGE instead of a silent EOF
+type limitReader struct {
+	r io.Reader
+	n int64
+}
+
+func (l *limitReader) Read(p []byte) (int, error) {
+	if l.n <= 0 {
+		// only an error if there is actually more data
+		var b [1]byte
+		n, err := l.r.Read(b[:])
+		if n > 0 {
+			return 0, FILE_TOO_LARGE
+		}
+		return 0, err
+	}
+	if int64(len(p)) > l.n {
+		p = p[:l.n]
+	}
+	n, err := l.r.Read(p)
+	l.n -= int64(n)
+	return n, err
+}
+
+func isTooLarge(err error) bool {
+	var mbe *http.MaxBytesError
+	return errors.Is(err, FILE_TOO_LARGE) || errors.As(err, &mbe) ||
+		errors.Is(err, archive.ENTRY_LARGE) || errors.Is(err, archive.HIGH_RATIO) ||
+		errors.Is(err, archive.TOO_LARGE) || errors.Is(err, archive.TOO_MANY) ||
+		errors.Is(err, fetch.TOO_LARGE)
+}
+
+// Outcome of one "uploadfile" part, or of one entry of an uploaded archive
+type UploadResult struct {
+	Filename string
+	// http status for this file alone
+	Status    int
+	Id        string
+	Mimetype  string
+	Duplicate bool
+	Source    string `json:",omitempty"`
+	// name of the uploaded archive this file was expanded from
+	Archive string `json:",omitempty"`
+	Error   string `json:",omitempty"`
+	// embedded keywords that could not be added as tags, see db.AddResult
+	InvalidKeywords []string `json:",omitempty"`
+	UnknownKeywords []string `json:",omitempty"`
+}
+
+// stores one file, either straight away or as part of a batch
+type adder func(ctx context.Context, f io.Reader, tags model.TagSet, meta db.FileMeta) (db.AddResult, error)
+
+func fillResult(result *UploadResult, ar db.AddResult, err error) {
+	switch {
+	case isTooLarge(err):
+		result.Status = 413
+		result.Error = "file too large"
+	case errors.Is(err, db.STRIP_FAILED):
+		result.Status = 422
+		result.Error = "could not remove embedded metadata"
+	case err != nil:
+		log.Println("failed to write file to database", err)
+		result.Status = 500
+		result.Error = "could not store file"
+	case ar.Duplicate:
+		result.Status = 200
+	default:
+		result.Status = 201
+	}
+	result.Id = ar.Resource.Id
+	result.Mimetype = ar.Resource.Mimetype
+	result.Duplicate = ar.Duplicate
+	result.InvalidKeywords = ar.InvalidKeywords
+	result.UnknownKeywords = ar.UnknownKeywords
+}
+
+// empty is false
+func boolParam(req *http.Request, name string) (bool, error) {
+	str := req.URL.Query().Get(name)
+	if str == "" {
+		return false, nil
+	}
+	return strconv.ParseBool(str)
+}
+
+// Files are streamed straight into storage as the multipart body is read,
+// so the "tags" field must come before any "uploadfile" parts.
+// Tags may also be given in the query string.
+//
+// Responds with one UploadResult per file.
+// The status is 201 if every file was stored and 207 if any file failed.
+// With ?atomic=true the first failure rolls back every file in the request.
+// With ?expand=true zip and tar archives are stored as their individual entries,
+// and ?dirtags=true additionally tags each entry with the directories it was in.
+// With ?keywords=true the keywords embedded in images are added as tags.
+// With ?dedupe=true a file whose content is already stored only adds its tags to
+// the existing resource and is reported as a Duplicate with status 200.
+// ?privacy=keep or ?privacy=strip overrides config.Config_Privacy for every file.
+func upload(res http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		res.WriteHeader(405)
+		return
+	}
+	req.Body = http.MaxBytesReader(res, req.Body, config.Global.Upload.MaxRequestSize)
+	mr, err := req.MultipartReader()
+	if err != nil {
+		http.Error(res, "expected multipart form", 400)
 		return
 	}
 
 	var tags model.TagSet
-	badtags := tags.FillFromString(req.FormValue("tags"))
-	if len(badtags) != 0 {
+	if badtags := tags.FillFromString(req.URL.Query().Get("tags")); len(badtags) != 0 {
 		http.Error(res, "Some tags were invalid, multiupload aborted.", 400)
 		return
 	}
+	atomic, err := boolParam(req, "atomic")
+	if err != nil {
+		http.Error(res, "invalid atomic field", 400)
+		return
+	}
+	expand, err := boolParam(req, "expand")
+	if err != nil {
+		http.Error(res, "invalid expand field", 400)
+		return
+	}
+	dirtags, err := boolParam(req, "dirtags")
+	if err != nil {
+		http.Error(res, "invalid dirtags field", 400)
+		return
+	}
+	keywords, err := boolParam(req, "keywords")
+	if err != nil {
+		http.Error(res, "invalid keywords field", 400)
+		return
+	}
+	dedupe, err := boolParam(req, "dedupe")
+	if err != nil {
+		http.Error(res, "invalid dedupe field", 400)
+		return
+	}
+	privacy := req.URL.Query().Get("privacy")
+	if !model.ValidPrivacy(privacy) {
+		http.Error(res, "invalid privacy field", 400)
+		return
+	}
+
+	add := adder(func(ctx context.Context, f io.Reader, tags model.TagSet, meta db.FileMeta) (db.AddResult, error) {
+		meta.Keywords = keywords
+		meta.Privacy = privacy
+		meta.Dedupe = dedupe
+		return client.AddFile(ctx, f, tags, meta)
+	})
+	var batch db.Batch
+	if atomic {
+		batch, err = client.BeginBatch(req.Context())
+		if err != nil {
+			res.WriteHeader(500)
+			log.Println("failed to begin upload batch", err)
+			return
+		}
+		defer batch.Rollback()
+		add = func(ctx context.Context, f io.Reader, tags model.TagSet, meta db.FileMeta) (db.AddResult, error) {
+			meta.Keywords = keywords
+			meta.Privacy = privacy
+			meta.Dedupe = dedupe
+			return batch.AddFile(ctx, f, tags, meta)
+		}
+	}
+	results := make([]UploadResult, 0)
+	// abandons the whole request, the batch (if any) is rolled back by the defer
+	abort := func(status int, msg string) {
+		if len(results) == 0 {
+			http.Error(res, msg, status)
+			return
+		}
+		for i := range results {
+			if atomic && results[i].Error == "" {
+				results[i].Status = 424
+				results[i].Error = "rolled back"
+			}
+		}
+		writeJsonStatus(res, status, results)
+	}
+
+	failed := false
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if isTooLarge(err) {
+			abort(413, "upload too large")
+			return
+		}
+		if err != nil {
+			abort(400, "malformed multipart form")
+			return
+		}
+		switch part.FormName() {
+		case "tags":
+			if len(results) != 0 {
+				abort(400, "tags must be sent before files")
+				return
+			}
+			bts, err := io.ReadAll(io.LimitReader(part, maxFieldSize))
+			if err != nil {
+				abort(400, "malformed multipart form")
+				return
+			}
+			if badtags := tags.FillFromString(string(bts)); len(badtags) != 0 {
+				abort(400, "Some tags were invalid, multiupload aborted.")
+				return
+			}
+		case "uploadfile":
+			f := bufio.NewReader(&limitReader{part, config.Global.Upload.MaxFileSize})
+			kind := ""
+			if expand {
+				// a short file just gives a short head
+				head, _ := f.Peek(512)
+				kind = archive.Detect(head, part.FileName())
+			}
+			var rs []UploadResult
+			if kind == "" {
+				result := UploadResult{Filename: part.FileName()}
+				ar, err := add(req.Context(), f, tags, db.FileMeta{Filename: part.FileName()})
+				fillResult(&result, ar, err)
+				rs = []UploadResult{result}
+			} else {
+				rs = expandUpload(req.Context(), add, part.FileName(), kind, f, tags, dirtags)
+			}
+			results = append(results, rs...)
+			for _, r := range rs {
+				if r.Error != "" {
+					failed = true
+				}
+			}
+			if failed && atomic {
+				abort(207, "")
+				return
+			}
+		}
+		part.Close()
+	}
+
+	if atomic {
+		if err := batch.Commit(req.Context()); err != nil {
+			log.Println("failed to commit upload batch", err)
+			abort(500, "could not store files")
+			return
+		}
+	}
+	deriveNew(results)
+	if failed {
+		writeJsonStatus(res, 207, results)
+		return
+	}
+	writeJsonStatus(res, 201, results)
+}
+
+// makes a directory name into a tag, returns "" if it cannot be one
+func dirTag(dir string) string {
+	tag := strings.Map(func(r rune) rune {
+		if r == ' ' || r == '_' || r == '.' {
+			return '-'
+		}
+		return r
+	}, strings.ToLower(dir))
+	var ts model.TagSet
+	if ts.Add(tag) != nil {
+		return ""
+	}
+	return tag
+}
 
-	fhs := req.MultipartForm.File["uploadfile"]
-	for _, fh := range fhs {
-		f, err := fh.Open()
+// Stores every entry of an archive as its own resource.
+// Zip needs random access so it is staged in blob storage first, tars are streamed.
+func expandUpload(ctx context.Context, add adder, filename string, kind string, f io.Reader, tags model.TagSet, dirtags bool) []UploadResult {
+	ac := config.Global.Archive
+	lim := archive.Limits{
+		MaxEntries:   ac.MaxEntries,
+		MaxEntrySize: config.Global.Upload.MaxFileSize,
+		MaxTotalSize: ac.MaxTotalSize,
+		MaxRatio:     ac.MaxRatio,
+	}
+	results := make([]UploadResult, 0)
+	entry := func(name string, r io.Reader, err error) error {
+		result := UploadResult{Filename: name, Archive: filename}
 		if err != nil {
-			log.Println("failed to open file from fileheader", err)
-			continue // safety measure TODO figure this out
+			result.Status = 422
+			if isTooLarge(err) {
+				result.Status = 413
+			}
+			result.Error = err.Error()
+			results = append(results, result)
+			return nil
+		}
+		etags := *tags.Duplicate()
+		if dirtags {
+			for _, d := range archive.Dirs(name) {
+				if tag := dirTag(d); tag != "" {
+					etags.Add(tag)
+				}
+			}
+		}
+		ar, err := add(ctx, r, etags, db.FileMeta{Filename: path.Base(name)})
+		if errors.Is(err, archive.TOO_LARGE) {
+			return err
+		}
+		fillResult(&result, ar, err)
+		results = append(results, result)
+		return nil
+	}
+
+	var err error
+	if kind == archive.Zip {
+		err = expandZip(ctx, f, lim, entry)
+	} else {
+		err = archive.WalkTar(f, kind, lim, entry)
+	}
+	if err != nil {
+		log.Println("failed to expand archive", filename, err)
+		result := UploadResult{Filename: filename, Status: 422, Error: err.Error()}
+		if isTooLarge(err) {
+			result.Status = 413
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+func expandZip(ctx context.Context, f io.Reader, lim archive.Limits, entry archive.EntryFunc) error {
+	id, err := db.GenUUID()
+	if err != nil {
+		return err
+	}
+	key := "staging/" + id + ".archive"
+	size, err := blobs.Put(ctx, key, f)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := blobs.Delete(context.Background(), key); err != nil {
+			log.Println("could not delete staged archive: " + key)
+		}
+	}()
+	zf, err := blobs.Open(ctx, key)
+	if err != nil {
+		return err
+	}
+	defer zf.Close()
+	return archive.WalkZip(zf, size, lim, entry)
+}
+
+type UrlUpload struct {
+	Urls []string
+	Tags string
+	// add the keywords embedded in images as tags
+	Keywords bool
+	// see model.Resource.Privacy
+	Privacy string
+	// see db.FileMeta.Dedupe
+	Dedupe bool
+}
+
+// Downloads each url into a new resource, remembering where it came from.
+// Responds like upload, with one UploadResult per url.
+func uploadUrl(res http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		res.WriteHeader(405)
+		return
+	}
+	var uu UrlUpload
+	dec := json.NewDecoder(http.MaxBytesReader(res, req.Body, maxFieldSize))
+	if err := dec.Decode(&uu); err != nil {
+		res.WriteHeader(400)
+		return
+	}
+	if len(uu.Urls) == 0 {
+		http.Error(res, "no urls", 400)
+		return
+	}
+	if !model.ValidPrivacy(uu.Privacy) {
+		http.Error(res, "invalid privacy", 400)
+		return
+	}
+	var tags model.TagSet
+	if badtags := tags.FillFromString(uu.Tags); len(badtags) != 0 {
+		http.Error(res, "Some tags were invalid, upload aborted.", 400)
+		return
+	}
+
+	results := make([]UploadResult, 0, len(uu.Urls))
+	failed := false
+	for _, raw := range uu.Urls {
+		result := UploadResult{Source: raw}
+		if u, err := url.Parse(raw); err == nil {
+			result.Filename = path.Base(u.Path)
+		}
+		ar, err := fetchFile(req.Context(), raw, tags, db.FileMeta{Source: raw, Keywords: uu.Keywords, Privacy: uu.Privacy, Dedupe: uu.Dedupe})
+		switch {
+		case errors.Is(err, fetch.DISALLOWED_URL):
+			result.Status = 403
+			result.Error = "url not allowed"
+		case errors.Is(err, FETCH_FAILED):
+			result.Status = 502
+			result.Error = "could not download file"
+		default:
+			fillResult(&result, ar, err)
 		}
-		defer f.Close()
-		_, err = client.AddFile(req.Context(), f, tags)
 		if err != nil {
-			log.Println("failed to write file to database", err)
-			continue // TODO there should be some failure mode here
+			log.Println("url upload failed", raw, err)
+			failed = true
 		}
+		results = append(results, result)
+	}
+	deriveNew(results)
+	if failed {
+		writeJsonStatus(res, 207, results)
+		return
 	}
+	writeJsonStatus(res, 201, results)
+}
 
-	res.WriteHeader(201)
+// meta.Filename is filled in from the url
+func fetchFile(ctx context.Context, raw string, tags model.TagSet, meta db.FileMeta) (db.AddResult, error) {
+	body, err := fetcher.Get(ctx, raw)
+	if errors.Is(err, fetch.DISALLOWED_URL) || errors.Is(err, fetch.TOO_LARGE) {
+		return db.AddResult{}, err
+	}
+	if err != nil {
+		return db.AddResult{}, apperror.ErrorWithContext{Original: FETCH_FAILED, Message: err.Error()}
+	}
+	defer body.Close()
+	if u, err := url.Parse(raw); err == nil && path.Base(u.Path) != "/" && path.Base(u.Path) != "." {
+		meta.Filename = path.Base(u.Path)
+	}
+	return client.AddFile(ctx, body, tags, meta)
 }
 
+// tags for a resumable upload are given as the "tags" metadata entry
+func tusTags(up tus.Upload) (model.TagSet, error) {
+	var tags model.TagSet
+	if badtags := tags.FillFromString(up.Metadata["tags"]); len(badtags) != 0 {
+		return tags, INVALID_FORM_FIELD
+	}
+	return tags, nil
+}
+
+func tusValidate(up tus.Upload) error {
+	if _, err := tusTags(up); err != nil {
+		return err
+	}
+	if !model.ValidPrivacy(up.Metadata["privacy"]) {
+		return INVALID_FORM_FIELD
+	}
+	return nil
+}
+
+func tusFinish(ctx context.Context, r io.Reader, up tus.Upload) (string, error) {
+	tags, err := tusTags(up)
+	if err != nil {
+		return "", err
+	}
+	// "filename" is what tus clients conventionally send
+	meta := db.FileMeta{
+		Filename: up.Metadata["filename"],
+		Keywords: up.Metadata["keywords"] == "true",
+		Privacy:  up.Metadata["privacy"],
+		Dedupe:   up.Metadata["dedupe"] == "true",
+	}
+	ar, err := client.AddFile(ctx, r, tags, meta)
+	if err != nil {
+		return "", err
+	}
+	if !ar.Duplicate {
+		deriveNew([]UploadResult{{Status: 201, Id: ar.Resource.Id, Mimetype: ar.Resource.Mimetype}})
+	}
+	return ar.Resource.Id, nil
+}
+
+// ?variant=<name> serves a resized copy of an image, see config.Config_Derive,
+// and any of ?w=&h=&fit=&fmt= resizes it on request
+// The original is sent under its uploaded filename, as an attachment with ?download=1.
+// Embedded location and device data is removed according to db.StripWhenServed,
+// resized copies never carry any since they are re-encoded
 func servefile(res http.ResponseWriter, req *http.Request) {
-	id := req.URL.Path[len("/files/"):]
-	bts, err := client.GetBytes(req.Context(), id)
+	// /files/<id>/<name> is a named file of the resource
+	id, name, named := strings.Cut(req.URL.Path[len("/files/"):], "/")
+	if named {
+		serveNamedFile(res, req, id, name)
+		return
+	}
+	if variant := req.URL.Query().Get("variant"); variant != "" {
+		serveVariant(res, req, id, variant)
+		return
+	}
+	q := req.URL.Query()
+	if q.Has("w") || q.Has("h") || q.Has("fit") || q.Has("fmt") {
+		serveResized(res, req, id)
+		return
+	}
+	rsc, err := client.GetFile(req.Context(), id)
+	if errors.Is(err, db.NO_RESULT) {
+		http.Error(res, "no such resource", 404)
+		return
+	}
 	if err != nil {
 		log.Println(err)
 		http.Error(res, "Server error", 500)
 		return
 	}
-	res.Write(bts)
+	if rsc.Kind != model.KindFile {
+		serveItem(res, req, rsc)
+		return
+	}
+	key := id
+	if str := q.Get("version"); str != "" {
+		n, err := strconv.Atoi(str)
+		if err != nil {
+			http.Error(res, "invalid version field", 400)
+			return
+		}
+		v, err := client.GetVersion(req.Context(), id, n)
+		if errors.Is(err, db.NO_RESULT) {
+			http.Error(res, "no such version", 404)
+			return
+		}
+		if err != nil {
+			log.Println(err)
+			http.Error(res, "Server error", 500)
+			return
+		}
+		key = db.VersionKey(id, n)
+		rsc.Mimetype = v.Mimetype
+		rsc.Filename = v.Filename
+	}
+	serveBlob(res, req, key, rsc)
+}
+
+func serveNamedFile(res http.ResponseWriter, req *http.Request, id string, name string) {
+	rsc, err := client.GetFile(req.Context(), id)
+	if err == nil {
+		var file model.File
+		file, err = client.GetNamedFile(req.Context(), id, name)
+		rsc.Mimetype = file.Mimetype
+		rsc.Filename = file.Filename
+		if rsc.Filename == "" {
+			rsc.Filename = name
+		}
+	}
+	if errors.Is(err, db.NO_RESULT) {
+		http.Error(res, "no such file", 404)
+		return
+	}
+	if err != nil {
+		log.Println(err)
+		http.Error(res, "Server error", 500)
+		return
+	}
+	serveBlob(res, req, db.FileKey(id, name), rsc)
+}
+
+// serves the blob under key as the content of rsc
+func serveBlob(res http.ResponseWriter, req *http.Request, key string, rsc model.Resource) {
+	f, err := blobs.Open(req.Context(), key)
+	if err != nil {
+		log.Println(err)
+		http.Error(res, "Server error", 500)
+		return
+	}
+	defer f.Close()
+	bi, err := blobs.Stat(req.Context(), key)
+	if err != nil {
+		http.Error(res, "Server error", 500)
+		return
+	}
+	var content io.ReadSeeker = f
+	if db.StripWhenServed(rsc) {
+		content, err = db.Stripped(f, bi.Size, rsc.Mimetype)
+		if err != nil {
+			// never fall back to the original
+			log.Println("could not strip", key, err)
+			http.Error(res, "could not remove embedded metadata", 500)
+			return
+		}
+	}
+	disposition := "inline"
+	if download, _ := boolParam(req, "download"); download {
+		disposition = "attachment"
+	}
+	name := rsc.Filename
+	if name == "" {
+		name = rsc.Id
+	}
+	res.Header().Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{
+		"filename": probe.Filename(name, rsc.Mimetype),
+	}))
+	setContentType(res, rsc.Mimetype)
+	http.ServeContent(res, req, "", bi.ModTime, content)
+}
+
+// Sets the type of stored content, which browsers must neither guess
+// nor run scripts from in the origin of the app
+func setContentType(res http.ResponseWriter, mimetype string) {
+	res.Header().Set("Content-Type", mimetype)
+	res.Header().Set("X-Content-Type-Options", "nosniff")
+	if probe.Active(mimetype) {
+		res.Header().Set("Content-Security-Policy", "sandbox")
+	}
 }
 
 func debugMiddleWare(prefix string, next http.Handler) http.Handler {
@@ -220,8 +933,12 @@ func debugMiddleWare(prefix string, next http.Handler) http.Handler {
 	})
 }
 
-func addContext(ctx context.Context, next http.Handler) http.Handler {
+// bounds the request context so that database work is abandoned
+// when the client goes away or the request takes too long
+func withTimeout(d time.Duration, next http.Handler) http.Handler {
 	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		ctx, cancel := context.WithTimeout(req.Context(), d)
+		defer cancel()
 		next.ServeHTTP(res, req.WithContext(ctx))
 	})
 }
@@ -233,32 +950,127 @@ func main() {
 	// Load config
 	config.Load()
 
-	// Load Templates
-	templates = template.Must(template.New("").Funcs(map[string]any{
-		"hasPrefix":   strings.HasPrefix,
-		"getBaseUrl":  func() string { return config.Global.UrlBase },
-		"stringifyTS": func(ts model.TagSet) string { return ts.String() },
-	}).ParseGlob("./templates/*.gohtml"))
+	blobs = blob.Disk{Root: config.Global.Storage.Root}
+	deriver = newDeriver()
 
 	// Load database connection
-	dbc, err := db.ConnectDatabases(ctx)
+	dbc, err := db.ConnectDatabases(ctx, blobs)
 	if err != nil {
 		log.Fatal(err)
 	}
 	defer dbc.Close(ctx)
 	client = dbc
 
+	// subcommands come after the global flags, e.g. `ftag -config x.json import ./export`
+	switch cmd := flag.Arg(0); cmd {
+	case "", "serve":
+		serve(ctx)
+	case "import":
+		err = runImport(ctx, flag.Args()[1:])
+	case "export":
+		err = runExport(ctx, flag.Args()[1:])
+	case "fsck":
+		err = runFsck(ctx, flag.Args()[1:])
+	case "gc":
+		err = runGC(ctx, flag.Args()[1:])
+	case "similar":
+		err = runSimilar(ctx, flag.Args()[1:])
+	case "redetect":
+		err = runRedetect(ctx, flag.Args()[1:])
+	default:
+		err = errors.New("unknown command: " + cmd)
+	}
+	if err != nil {
+		log.Println(err)
+		dbc.Close(ctx)
+		os.Exit(1)
+	}
+}
+
+func serve(ctx context.Context) {
+	// Load Templates
+	templates = template.Must(template.New("").Funcs(map[string]any{
+		"hasPrefix":   strings.HasPrefix,
+		"getBaseUrl":  func() string { return config.Global.UrlBase },
+		"stringifyTS": func(ts model.TagSet) string { return ts.String() },
+		"markdown":    func(s string) template.HTML { return template.HTML(markdown.Render(s)) },
+	}).ParseGlob("./templates/*.gohtml"))
+
+	fc := config.Global.Fetch
+	fetcher = fetch.New(fetch.Policy{
+		Schemes:      fc.Schemes,
+		Hosts:        fc.Hosts,
+		AllowPrivate: fc.AllowPrivate,
+		MaxSize:      fc.MaxSize,
+		Timeout:      fc.Timeout.Duration,
+	})
+
 	server := http.NewServeMux()
 
 	statfs := http.FileServer(http.Dir("./dist"))
 
+	reqTimeout := config.Global.Timeout.Request.Duration
+	uploadTimeout := config.Global.Timeout.Upload.Duration
+	adminTimeout := config.Global.Timeout.Admin.Duration
+
+	tusHandler := &tus.Handler{
+		Store:    blobs,
+		BasePath: config.Global.UrlBase + "/api/upload/tus",
+		MaxSize:  config.Global.Upload.MaxFileSize,
+		Expiry:   config.Global.Upload.StagingExpiry.Duration,
+		Validate: tusValidate,
+		Finish:   tusFinish,
+	}
+	if interval := config.Global.Upload.SweepInterval.Duration; interval > 0 {
+		go tusHandler.RunSweeper(ctx, interval)
+	}
+	go runDeriver(ctx)
+	if err := deriver.Cache.Load(ctx); err != nil {
+		log.Println("could not load resize cache", err)
+	}
+	if interval := config.Global.Scrub.Interval.Duration; interval > 0 {
+		go runScrubber(ctx, interval)
+	}
+	if interval := config.Global.GC.Interval.Duration; interval > 0 {
+		go runCollector(ctx, interval)
+	}
+	if interval := config.Global.Similar.Interval.Duration; interval > 0 {
+		go runGrouper(ctx, interval)
+	}
+
 	server.HandleFunc("/", landingPage)
 	server.Handle("/public/", http.StripPrefix("/public/", statfs))
-	server.HandleFunc("/files/", servefile)
-	server.HandleFunc("/api/query", query)
-	server.HandleFunc("/api/resource", resource)
-	server.HandleFunc("/api/resource/tags", resourceTags)
-	server.HandleFunc("/api/upload", upload)
+	server.Handle("/files/", withTimeout(reqTimeout, http.HandlerFunc(servefile)))
+	server.Handle("/api/query", withTimeout(reqTimeout, http.HandlerFunc(query)))
+	server.Handle("/api/resource", withTimeout(reqTimeout, http.HandlerFunc(resource)))
+	server.Handle("/api/resource/tags", withTimeout(reqTimeout, http.HandlerFunc(resourceTags)))
+	server.Handle("/api/resource/props", withTimeout(reqTimeout, http.HandlerFunc(resourceProps)))
+	server.Handle("/api/properties", withTimeout(reqTimeout, http.HandlerFunc(properties)))
+	server.Handle("/api/resource/privacy", withTimeout(reqTimeout, http.HandlerFunc(resourcePrivacy)))
+	server.Handle("/api/resource/duplicates", withTimeout(reqTimeout, http.HandlerFunc(resourceDuplicates)))
+	server.Handle("/api/resource/content", withTimeout(uploadTimeout, http.HandlerFunc(resourceContent)))
+	server.Handle("/api/resource/versions", withTimeout(reqTimeout, http.HandlerFunc(resourceVersions)))
+	server.Handle("/api/resource/revert", withTimeout(uploadTimeout, http.HandlerFunc(resourceRevert)))
+	server.Handle("/api/resource/files", withTimeout(uploadTimeout, http.HandlerFunc(resourceFiles)))
+	server.Handle("/api/resource/relations", withTimeout(reqTimeout, http.HandlerFunc(resourceRelations)))
+	server.Handle("/api/resource/collections", withTimeout(reqTimeout, http.HandlerFunc(resourceCollections)))
+	server.Handle("/api/collection", withTimeout(reqTimeout, http.HandlerFunc(collection)))
+	server.Handle("/api/collection/edit", withTimeout(reqTimeout, http.HandlerFunc(collectionEdit)))
+	server.Handle("/api/collection/members", withTimeout(reqTimeout, http.HandlerFunc(collectionMembers)))
+	server.Handle("/api/collection/reorder", withTimeout(reqTimeout, http.HandlerFunc(collectionReorder)))
+	server.Handle("/api/item", withTimeout(uploadTimeout, http.HandlerFunc(itemNew)))
+	server.Handle("/api/item/edit", withTimeout(uploadTimeout, http.HandlerFunc(itemEdit)))
+	server.Handle("/api/admin/fsck", withTimeout(adminTimeout, http.HandlerFunc(adminFsck)))
+	server.Handle("/api/admin/scrub", withTimeout(adminTimeout, http.HandlerFunc(adminScrub)))
+	server.Handle("/api/admin/gc", withTimeout(adminTimeout, http.HandlerFunc(adminGC)))
+	server.Handle("/api/admin/similar", withTimeout(adminTimeout, http.HandlerFunc(adminSimilar)))
+	server.Handle("/api/admin/redetect", withTimeout(adminTimeout, http.HandlerFunc(adminRedetect)))
+	server.Handle("/api/admin/metrics", withTimeout(adminTimeout, http.HandlerFunc(adminMetrics)))
+	server.Handle("/api/upload", withTimeout(uploadTimeout, http.HandlerFunc(upload)))
+	tusRoute := withTimeout(uploadTimeout, http.StripPrefix("/api/upload/tus", tusHandler))
+	server.Handle("/api/upload/url", withTimeout(uploadTimeout, http.HandlerFunc(uploadUrl)))
+	server.Handle("/api/upload/tus", tusRoute)
+	server.Handle("/api/upload/tus/", tusRoute)
 
-	log.Fatal(http.ListenAndServe(":8080", addContext(ctx, http.StripPrefix(config.Global.UrlBase, server))))
+	log.Fatal(http.ListenAndServe(":8080", http.StripPrefix(config.Global.UrlBase, server)))
 }
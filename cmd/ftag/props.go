@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/blubywaff/ftag/internal/db"
+	"github.com/blubywaff/ftag/internal/model"
+)
+
+type PropChange struct {
+	ResourceId string
+	// values as json has them, dates as strings
+	Set   map[string]interface{}
+	Unset []string
+}
+
+// Reads the repeated prop query parameter, each a condition like rating>=4
+func propQuery(req *http.Request, query *model.Query) error {
+	for _, str := range req.URL.Query()["prop"] {
+		c, err := model.ParsePropCondition(str)
+		if err != nil {
+			return errors.New("invalid prop: " + err.Error())
+		}
+		query.Props = append(query.Props, c)
+	}
+	return nil
+}
+
+// GET lists the defined properties, POST defines the model.PropertyDef in the body, DELETE ?key= removes one
+// along with every value of it
+func properties(res http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case "GET":
+		defs, err := client.PropertyDefs(req.Context())
+		if err != nil {
+			res.WriteHeader(500)
+			log.Println("error listing properties", err)
+			return
+		}
+		writeJson(res, defs)
+	case "POST":
+		var def model.PropertyDef
+		if err := json.NewDecoder(req.Body).Decode(&def); err != nil {
+			res.WriteHeader(400)
+			return
+		}
+		err := client.DefineProperty(req.Context(), def)
+		switch {
+		case errors.Is(err, db.INVALID_PROPERTY):
+			http.Error(res, "invalid key or type", 400)
+		case errors.Is(err, db.PROPERTY_EXISTS):
+			http.Error(res, err.Error(), 409)
+		case err != nil:
+			res.WriteHeader(500)
+			log.Println("error defining property", err)
+		default:
+			writeJson(res, def)
+		}
+	case "DELETE":
+		err := client.RemoveProperty(req.Context(), req.URL.Query().Get("key"))
+		if errors.Is(err, db.NO_RESULT) {
+			http.Error(res, "no such property", 404)
+			return
+		}
+		if err != nil {
+			res.WriteHeader(500)
+			log.Println("error removing property", err)
+			return
+		}
+		res.WriteHeader(204)
+	default:
+		res.WriteHeader(405)
+	}
+}
+
+// like resourceTags, for custom properties
+func resourceProps(res http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		res.WriteHeader(405)
+		return
+	}
+	var pc PropChange
+	if err := json.NewDecoder(req.Body).Decode(&pc); err != nil {
+		res.WriteHeader(400)
+		return
+	}
+	err := client.ChangeProps(req.Context(), pc.ResourceId, pc.Set, pc.Unset)
+	switch {
+	case errors.Is(err, db.NO_RESULT):
+		http.Error(res, "no such resource", 404)
+		return
+	case errors.Is(err, db.UNKNOWN_PROPERTY), errors.Is(err, db.INVALID_PROPERTY_VALUE):
+		http.Error(res, err.Error(), 400)
+		return
+	case err != nil:
+		res.WriteHeader(500)
+		log.Println("error changing properties", err)
+		return
+	}
+	rsc, err := client.GetFile(req.Context(), pc.ResourceId)
+	if err != nil {
+		res.WriteHeader(500)
+		return
+	}
+	writeJson(res, rsc)
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+)
+
+func runRedetect(ctx context.Context, args []string) error {
+	fset := flag.NewFlagSet("redetect", flag.ExitOnError)
+	dryRun := fset.Bool("dry-run", false, "Only list the mimetypes that would change.")
+	fset.Parse(args)
+
+	report, err := client.Redetect(ctx, *dryRun)
+	if err != nil {
+		return err
+	}
+	bts, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(bts))
+	return nil
+}
+
+// GET lists what would change, POST records the new mimetypes
+func adminRedetect(res http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" && req.Method != "POST" {
+		res.WriteHeader(405)
+		return
+	}
+	report, err := client.Redetect(req.Context(), req.Method == "GET")
+	if err != nil {
+		res.WriteHeader(500)
+		log.Println("redetect failed", err)
+		return
+	}
+	writeJson(res, report)
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/blubywaff/ftag/internal/db"
+	"github.com/blubywaff/ftag/internal/model"
+)
+
+// Reads the optional relation filters of a query: toplevel, childof and noduplicates
+func relationQuery(req *http.Request, query *model.Query) error {
+	var err error
+	if query.TopLevel, err = boolParam(req, "toplevel"); err != nil {
+		return errors.New("invalid toplevel")
+	}
+	if query.NoDuplicates, err = boolParam(req, "noduplicates"); err != nil {
+		return errors.New("invalid noduplicates")
+	}
+	query.ChildOf = req.URL.Query().Get("childof")
+	return nil
+}
+
+// GET ?id= lists the resources related to one, POST adds the model.Relation in the body, DELETE removes it
+func resourceRelations(res http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case "GET":
+		id := req.URL.Query().Get("id")
+		if id == "" {
+			res.WriteHeader(400)
+			return
+		}
+		neighbors, err := client.Neighborhood(req.Context(), id)
+		if errors.Is(err, db.NO_RESULT) {
+			http.Error(res, "no such resource", 404)
+			return
+		}
+		if err != nil {
+			res.WriteHeader(500)
+			log.Println("error finding related resources", err)
+			return
+		}
+		writeJson(res, neighbors)
+	case "POST", "DELETE":
+		var rel model.Relation
+		if err := json.NewDecoder(req.Body).Decode(&rel); err != nil {
+			res.WriteHeader(400)
+			return
+		}
+		var err error
+		if req.Method == "POST" {
+			err = client.Relate(req.Context(), rel)
+		} else {
+			err = client.Unrelate(req.Context(), rel)
+		}
+		switch {
+		case errors.Is(err, db.INVALID_RELATION):
+			http.Error(res, "invalid relation", 400)
+		case errors.Is(err, db.NO_RESULT):
+			http.Error(res, "no such resource or relation", 404)
+		case errors.Is(err, db.RELATION_CONFLICT):
+			http.Error(res, err.Error(), 409)
+		case err != nil:
+			res.WriteHeader(500)
+			log.Println("error changing relation", err)
+		default:
+			res.WriteHeader(204)
+		}
+	default:
+		res.WriteHeader(405)
+	}
+}
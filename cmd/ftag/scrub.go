@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/blubywaff/ftag/internal/config"
+	"github.com/blubywaff/ftag/internal/db"
+)
+
+// the latest scrub report is kept here in blob storage
+const scrubReportKey = "meta/scrub.json"
+
+var SCRUB_RUNNING = errors.New("scrub already running")
+
+// only one scrub at a time, it reads every blob
+var scrubMu sync.Mutex
+
+// when the running scrub started, nil if none is running
+var scrubStarted atomic.Pointer[time.Time]
+
+type ScrubStatus struct {
+	// when the running scrub started, nil if none is running
+	Running *time.Time
+	// the latest finished scrub, nil if none has finished yet
+	Last *db.ScrubReport
+}
+
+// Takes the scrub lock unless a scrub is running, endScrub releases it
+func beginScrub() bool {
+	if !scrubMu.TryLock() {
+		return false
+	}
+	now := time.Now().UTC()
+	scrubStarted.Store(&now)
+	return true
+}
+
+func endScrub() {
+	scrubStarted.Store(nil)
+	scrubMu.Unlock()
+}
+
+// Scrubs and stores the report, the caller holds the scrub lock
+func scrub(ctx context.Context) {
+	report, err := client.Scrub(ctx, config.Global.Scrub.Tag)
+	if err != nil {
+		log.Println("scrub failed", err)
+		return
+	}
+	if len(report.Corrupt) != 0 {
+		log.Println("scrub found corrupt blobs:", len(report.Corrupt))
+	}
+	bts, err := json.Marshal(report)
+	if err != nil {
+		log.Println("could not store scrub report", err)
+		return
+	}
+	if err := blobs.Delete(ctx, scrubReportKey); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		log.Println("could not store scrub report", err)
+		return
+	}
+	if _, err = blobs.Put(ctx, scrubReportKey, bytes.NewReader(bts)); err != nil {
+		log.Println("could not store scrub report", err)
+	}
+}
+
+// the latest stored report, nil if none has been stored
+func lastScrub(ctx context.Context) (*db.ScrubReport, error) {
+	f, err := blobs.Open(ctx, scrubReportKey)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var report db.ScrubReport
+	if err := json.NewDecoder(f).Decode(&report); err != nil {
+		return nil, err
+	}
+	return &report, nil
+}
+
+// Scrubs every interval until ctx is done, starting right away if the last scrub is older than interval
+func runScrubber(ctx context.Context, interval time.Duration) {
+	run := func() {
+		if !beginScrub() {
+			log.Println("scrub skipped,", SCRUB_RUNNING)
+			return
+		}
+		defer endScrub()
+		scrub(ctx)
+	}
+	last, err := lastScrub(ctx)
+	if err != nil {
+		log.Println("could not read scrub report", err)
+	}
+	if last == nil || time.Since(last.Finished) >= interval {
+		run()
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			run()
+		}
+	}
+}
+
+// GET returns the status and the last report, POST starts a scrub in the background
+func adminScrub(res http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case "GET":
+		last, err := lastScrub(req.Context())
+		if err != nil {
+			res.WriteHeader(500)
+			log.Println("could not read scrub report", err)
+			return
+		}
+		writeJson(res, ScrubStatus{Running: scrubStarted.Load(), Last: last})
+	case "POST":
+		if !beginScrub() {
+			http.Error(res, SCRUB_RUNNING.Error(), 409)
+			return
+		}
+		go func() {
+			defer endScrub()
+			// outlives the request
+			scrub(context.Background())
+		}()
+		res.WriteHeader(202)
+	default:
+		res.WriteHeader(405)
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/blubywaff/ftag/internal/config"
+	"github.com/blubywaff/ftag/internal/db"
+)
+
+// the latest grouping of near-duplicates is kept here in blob storage
+const similarReportKey = "meta/similar.json"
+
+var GROUPING_RUNNING = errors.New("grouping already running")
+
+// only one grouping at a time, it may decode every image
+var similarMu sync.Mutex
+
+func groupSimilar(ctx context.Context, threshold int) (db.SimilarReport, error) {
+	if !similarMu.TryLock() {
+		return db.SimilarReport{}, GROUPING_RUNNING
+	}
+	defer similarMu.Unlock()
+	report, err := client.GroupSimilar(ctx, threshold)
+	if err != nil {
+		return report, err
+	}
+	bts, err := json.Marshal(report)
+	if err != nil {
+		return report, err
+	}
+	if err := blobs.Delete(ctx, similarReportKey); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return report, err
+	}
+	_, err = blobs.Put(ctx, similarReportKey, bytes.NewReader(bts))
+	return report, err
+}
+
+func runSimilar(ctx context.Context, args []string) error {
+	fset := flag.NewFlagSet("similar", flag.ExitOnError)
+	threshold := fset.Int("threshold", config.Global.Similar.Threshold, "Most differing hash bits for images to count as alike.")
+	fset.Parse(args)
+
+	report, err := groupSimilar(ctx, *threshold)
+	if err != nil {
+		return err
+	}
+	bts, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(bts))
+	return nil
+}
+
+// Groups every interval until ctx is done
+func runGrouper(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			report, err := groupSimilar(ctx, config.Global.Similar.Threshold)
+			if err != nil {
+				log.Println("grouping near-duplicates failed", err)
+				continue
+			}
+			if len(report.Groups) != 0 {
+				log.Println("groups of near-duplicates:", len(report.Groups))
+			}
+		}
+	}
+}
+
+// ?threshold= overrides config.Config_Similar.Threshold
+func thresholdParam(req *http.Request) (int, error) {
+	str := req.URL.Query().Get("threshold")
+	if str == "" {
+		return config.Global.Similar.Threshold, nil
+	}
+	n, err := strconv.Atoi(str)
+	if err != nil || n < 0 || n > 64 {
+		return 0, INVALID_FORM_FIELD
+	}
+	return n, nil
+}
+
+// GET returns the last grouping, POST groups now
+func adminSimilar(res http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case "GET":
+		f, err := blobs.Open(req.Context(), similarReportKey)
+		if errors.Is(err, fs.ErrNotExist) {
+			http.Error(res, "no grouping has run yet", 404)
+			return
+		}
+		if err != nil {
+			res.WriteHeader(500)
+			return
+		}
+		defer f.Close()
+		var report db.SimilarReport
+		if err := json.NewDecoder(f).Decode(&report); err != nil {
+			res.WriteHeader(500)
+			log.Println("invalid stored grouping report", err)
+			return
+		}
+		writeJson(res, report)
+	case "POST":
+		threshold, err := thresholdParam(req)
+		if err != nil {
+			http.Error(res, "invalid threshold field", 400)
+			return
+		}
+		report, err := groupSimilar(req.Context(), threshold)
+		if errors.Is(err, GROUPING_RUNNING) {
+			http.Error(res, err.Error(), 409)
+			return
+		}
+		if err != nil {
+			res.WriteHeader(500)
+			log.Println("grouping near-duplicates failed", err)
+			return
+		}
+		writeJson(res, report)
+	default:
+		res.WriteHeader(405)
+	}
+}
+
+// ?id= lists the images that look like that resource, closest first
+func resourceDuplicates(res http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		res.WriteHeader(405)
+		return
+	}
+	id := req.URL.Query().Get("id")
+	if id == "" {
+		res.WriteHeader(400)
+		return
+	}
+	threshold, err := thresholdParam(req)
+	if err != nil {
+		http.Error(res, "invalid threshold field", 400)
+		return
+	}
+	similar, err := client.SimilarTo(req.Context(), id, threshold)
+	switch {
+	case errors.Is(err, db.NO_RESULT):
+		http.Error(res, "no such resource", 404)
+		return
+	case errors.Is(err, db.NO_PHASH):
+		http.Error(res, "resource is not a hashed image", 422)
+		return
+	case err != nil:
+		res.WriteHeader(500)
+		log.Println("error finding near-duplicates", err)
+		return
+	}
+	writeJson(res, similar)
+}
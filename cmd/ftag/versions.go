@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+
+	"github.com/blubywaff/ftag/internal/config"
+	"github.com/blubywaff/ftag/internal/db"
+	"github.com/blubywaff/ftag/internal/model"
+)
+
+type Revert struct {
+	ResourceId string
+	Version    int
+}
+
+// old thumbnails and renditions are dropped and made again from the new content
+func contentChanged(req *http.Request, rsc model.Resource) {
+	if err := deriver.Forget(req.Context(), rsc.Id); err != nil {
+		log.Println("could not drop derived files of", rsc.Id, err)
+	}
+	deriveNew([]UploadResult{{Status: 201, Id: rsc.Id, Mimetype: rsc.Mimetype}})
+}
+
+// writes the resource after its content changed, or the error that stopped it
+func writeReplaced(res http.ResponseWriter, req *http.Request, rsc model.Resource, err error) {
+	switch {
+	case errors.Is(err, db.NO_RESULT):
+		http.Error(res, "no such resource", 404)
+	case isTooLarge(err):
+		http.Error(res, "file too large", 413)
+	case errors.Is(err, db.STRIP_FAILED):
+		http.Error(res, "could not remove embedded metadata", 422)
+	case errors.Is(err, db.WRONG_KIND):
+		http.Error(res, "resource is not a file", 409)
+	case err != nil:
+		res.WriteHeader(500)
+		log.Println("error replacing content", err)
+	default:
+		contentChanged(req, rsc)
+		writeJson(res, rsc)
+	}
+}
+
+// ?id= replaces the content of a resource with the first uploadfile of a multipart form.
+// The id, tags and privacy setting stay, the previous content is kept as a version.
+func resourceContent(res http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		res.WriteHeader(405)
+		return
+	}
+	id := req.URL.Query().Get("id")
+	if id == "" {
+		res.WriteHeader(400)
+		return
+	}
+	req.Body = http.MaxBytesReader(res, req.Body, config.Global.Upload.MaxRequestSize)
+	mr, err := req.MultipartReader()
+	if err != nil {
+		http.Error(res, "expected multipart form", 400)
+		return
+	}
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			http.Error(res, "missing uploadfile", 400)
+			return
+		}
+		if isTooLarge(err) {
+			http.Error(res, "upload too large", 413)
+			return
+		}
+		if err != nil {
+			http.Error(res, "malformed multipart form", 400)
+			return
+		}
+		if part.FormName() != "uploadfile" {
+			part.Close()
+			continue
+		}
+		f := &limitReader{part, config.Global.Upload.MaxFileSize}
+		rsc, err := client.ReplaceContent(req.Context(), id, f, db.FileMeta{Filename: part.FileName()})
+		part.Close()
+		writeReplaced(res, req, rsc, err)
+		return
+	}
+}
+
+// ?id= lists the earlier contents of a resource, oldest first.
+// Each is served by /files/<id>?version=<number>
+func resourceVersions(res http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		res.WriteHeader(405)
+		return
+	}
+	id := req.URL.Query().Get("id")
+	if id == "" {
+		res.WriteHeader(400)
+		return
+	}
+	versions, err := client.Versions(req.Context(), id)
+	if errors.Is(err, db.NO_RESULT) {
+		http.Error(res, "no such resource", 404)
+		return
+	}
+	if err != nil {
+		res.WriteHeader(500)
+		log.Println("error listing versions", err)
+		return
+	}
+	writeJson(res, versions)
+}
+
+// makes an earlier version the content again, the content it replaces is kept as a version
+func resourceRevert(res http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		res.WriteHeader(405)
+		return
+	}
+	var rv Revert
+	if err := json.NewDecoder(req.Body).Decode(&rv); err != nil {
+		res.WriteHeader(400)
+		return
+	}
+	rsc, err := client.RevertContent(req.Context(), rv.ResourceId, rv.Version)
+	writeReplaced(res, req, rsc, err)
+}
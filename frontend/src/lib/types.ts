@@ -3,10 +3,82 @@ export interface Resource {
 	Mimetype: string;
 	CreatedAt: string;
 	Tags: string[];
+	Kind: string;
+	Url?: string;
+	Title?: string;
+	Text?: string;
+	Html?: string;
+	Source?: string;
+	Size?: number;
+	Hash?: string;
+	Filename?: string;
+	Width?: number;
+	Height?: number;
+	Duration?: number;
+	Captured?: string;
+	Camera?: string;
+	Phash?: string;
+	Privacy?: string;
+	Files?: NamedFile[];
+	Props?: Record<string, string | number | boolean>;
+}
+export interface PropertyDef {
+	Key: string;
+	Type: 'string' | 'number' | 'date' | 'boolean';
+}
+export interface NamedFile {
+	Name: string;
+	Mimetype: string;
+	AddedAt: string;
+	Size?: number;
+	Hash?: string;
+	Filename?: string;
 }
 export const DefaultResource = {
 	Id: '',
 	Mimetype: '',
 	CreatedAt: '',
-	Tags: []
+	Tags: [],
+	Kind: 'file'
 };
+export interface UploadResult {
+	Filename: string;
+	Status: number;
+	Id: string;
+	Mimetype: string;
+	Duplicate: boolean;
+	Source?: string;
+	Archive?: string;
+	Error?: string;
+	InvalidKeywords?: string[];
+	UnknownKeywords?: string[];
+}
+export interface Version {
+	Number: number;
+	ReplacedAt: string;
+	Mimetype: string;
+	Source?: string;
+	Size?: number;
+	Hash?: string;
+	Filename?: string;
+	Width?: number;
+	Height?: number;
+	Duration?: number;
+}
+export interface Relation {
+	Type: string;
+	From: string;
+	To: string;
+}
+export interface Neighbor {
+	Relation: Relation;
+	Resource: Resource;
+}
+export interface Collection {
+	Id: string;
+	Name: string;
+	Description?: string;
+	CreatedAt: string;
+	Tags: string[];
+	Members: string[];
+}
@@ -7,6 +7,7 @@ toolchain go1.23.1
 require (
 	github.com/apache/tinkerpop/gremlin-go/v3 v3.7.3
 	github.com/google/uuid v1.6.0
+	golang.org/x/image v0.26.0
 )
 
 require (
@@ -0,0 +1,235 @@
+// Expands zip and tar archives into their individual files
+package archive
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"path"
+	"strings"
+
+	"github.com/blubywaff/ftag/internal/probe"
+)
+
+var (
+	UNSAFE_PATH = errors.New("archive entry has an unsafe path")
+	TOO_MANY    = errors.New("archive has too many entries")
+	TOO_LARGE   = errors.New("archive expands beyond size limit")
+	HIGH_RATIO  = errors.New("archive entry is compressed suspiciously well")
+	ENTRY_LARGE = errors.New("archive entry exceeds size limit")
+	NOT_ARCHIVE = errors.New("not a supported archive")
+)
+
+const (
+	Zip   = "zip"
+	Tar   = "tar"
+	TarGz = "tar.gz"
+)
+
+// Guards against archives that expand far beyond their own size
+type Limits struct {
+	MaxEntries   int
+	MaxEntrySize int64
+	// over all entries together
+	MaxTotalSize int64
+	// uncompressed size over compressed size, zip only
+	MaxRatio int64
+}
+
+// Called for every regular file in the archive, name is a cleaned relative path.
+// If the entry itself was rejected then r is nil and err says why.
+// An error returned here stops the walk.
+// TOO_LARGE from reading r means the whole archive is over budget and should be returned.
+type EntryFunc func(name string, r io.Reader, err error) error
+
+// Returns the kind of archive given the start of the file, or "" if it is not one.
+// Formats that are zip archives inside, like docx or epub, are not archives here,
+// they are told apart from plain zip files as probe.Detect does.
+func Detect(head []byte, filename string) string {
+	switch {
+	case bytes.HasPrefix(head, []byte("PK\x03\x04")):
+		if probe.Detect(bytes.NewReader(head), int64(len(head)), filename) != "application/zip" {
+			return ""
+		}
+		return Zip
+	case bytes.HasPrefix(head, []byte("PK\x05\x06")):
+		// empty
+		return Zip
+	case bytes.HasPrefix(head, []byte("\x1f\x8b")):
+		// only a compressed tar, not any gzip
+		zr, err := gzip.NewReader(bytes.NewReader(head))
+		if err != nil {
+			return ""
+		}
+		inner := make([]byte, 262)
+		n, _ := io.ReadFull(zr, inner)
+		if isTar(inner[:n]) {
+			return TarGz
+		}
+	case isTar(head):
+		return Tar
+	}
+	return ""
+}
+
+// the ustar magic of the first header
+func isTar(head []byte) bool {
+	return len(head) >= 262 && string(head[257:262]) == "ustar"
+}
+
+// Rejects absolute paths and anything that would climb out of the archive
+func CleanName(name string) (string, error) {
+	if strings.Contains(name, "\\") || strings.HasPrefix(name, "/") {
+		return "", UNSAFE_PATH
+	}
+	clean := path.Clean(name)
+	if clean == "." || clean == ".." || strings.HasPrefix(clean, "../") {
+		return "", UNSAFE_PATH
+	}
+	return clean, nil
+}
+
+// The directories of an entry, outermost first
+func Dirs(name string) []string {
+	dir := path.Dir(name)
+	if dir == "." {
+		return nil
+	}
+	return strings.Split(dir, "/")
+}
+
+// tracks how much has been expanded so far
+type budget struct {
+	lim     Limits
+	entries int
+	total   int64
+}
+
+func (b *budget) entry() error {
+	b.entries++
+	if b.entries > b.lim.MaxEntries {
+		return TOO_MANY
+	}
+	return nil
+}
+
+// counts every byte read against the entry and total limits
+type countingReader struct {
+	r io.Reader
+	b *budget
+	n int64
+	// entry limit, and the error for going over it
+	max  int64
+	over error
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	c.b.total += int64(n)
+	if c.n > c.max {
+		return n, c.over
+	}
+	if c.b.total > c.b.lim.MaxTotalSize {
+		return n, TOO_LARGE
+	}
+	return n, err
+}
+
+func WalkTar(r io.Reader, kind string, lim Limits, fn EntryFunc) error {
+	if kind == TarGz {
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		r = gz
+	} else if kind != Tar {
+		return NOT_ARCHIVE
+	}
+	b := budget{lim: lim}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		if err := b.entry(); err != nil {
+			return err
+		}
+		name, err := CleanName(hdr.Name)
+		if err == nil && hdr.Size > lim.MaxEntrySize {
+			err = ENTRY_LARGE
+		}
+		if err != nil {
+			if err := fn(hdr.Name, nil, err); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := fn(name, &countingReader{r: tr, b: &b, max: lim.MaxEntrySize, over: ENTRY_LARGE}, nil); err != nil {
+			return err
+		}
+	}
+}
+
+func WalkZip(ra io.ReaderAt, size int64, lim Limits, fn EntryFunc) error {
+	zr, err := zip.NewReader(ra, size)
+	if err != nil {
+		return err
+	}
+	if len(zr.File) > lim.MaxEntries {
+		return TOO_MANY
+	}
+	b := budget{lim: lim}
+	for _, zf := range zr.File {
+		if !zf.Mode().IsRegular() {
+			continue
+		}
+		if err := b.entry(); err != nil {
+			return err
+		}
+		name, err := CleanName(zf.Name)
+		// the declared sizes may lie, countingReader enforces the real ones
+		if err == nil && zf.UncompressedSize64 > uint64(lim.MaxEntrySize) {
+			err = ENTRY_LARGE
+		}
+		if err == nil && zf.CompressedSize64 > 0 && zf.UncompressedSize64/zf.CompressedSize64 > uint64(lim.MaxRatio) {
+			err = HIGH_RATIO
+		}
+		if err != nil {
+			if err := fn(zf.Name, nil, err); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := walkZipEntry(zf, &b, name, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func walkZipEntry(zf *zip.File, b *budget, name string, fn EntryFunc) error {
+	rc, err := zf.Open()
+	if err != nil {
+		return fn(name, nil, err)
+	}
+	defer rc.Close()
+	cr := &countingReader{r: rc, b: b, max: b.lim.MaxEntrySize, over: ENTRY_LARGE}
+	// also bound the real expansion by the compressed size
+	if ratioMax := (int64(zf.CompressedSize64) + 1) * b.lim.MaxRatio; ratioMax < cr.max {
+		cr.max = ratioMax
+		cr.over = HIGH_RATIO
+	}
+	return fn(name, cr, nil)
+}
@@ -0,0 +1,299 @@
+package archive
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"slices"
+	"strings"
+	"testing"
+)
+
+var testLimits = Limits{MaxEntries: 10, MaxEntrySize: 1000, MaxTotalSize: 2000, MaxRatio: 10}
+
+func TestCleanName(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+		err  bool
+	}{
+		{"a.txt", "a.txt", false},
+		{"dir/a.txt", "dir/a.txt", false},
+		{"./dir//a.txt", "dir/a.txt", false},
+		{"dir/../a.txt", "a.txt", false},
+		{"..a.txt", "..a.txt", false},
+		{"../a.txt", "", true},
+		{"dir/../../a.txt", "", true},
+		{"..", "", true},
+		{".", "", true},
+		{"", "", true},
+		{"/etc/passwd", "", true},
+		{"dir\\..\\..\\a.txt", "", true},
+		{"c:\\a.txt", "", true},
+	}
+	for _, tt := range tests {
+		got, err := CleanName(tt.name)
+		if (err != nil) != tt.err || got != tt.want {
+			t.Errorf("CleanName(%q) = %q, %v, want %q", tt.name, got, err, tt.want)
+		}
+		if err != nil && !errors.Is(err, UNSAFE_PATH) {
+			t.Errorf("CleanName(%q) failed with %v", tt.name, err)
+		}
+	}
+}
+
+func TestDirs(t *testing.T) {
+	tests := map[string][]string{
+		"a.txt":       nil,
+		"x/a.txt":     {"x"},
+		"x/y/z/a.txt": {"x", "y", "z"},
+	}
+	for name, want := range tests {
+		if got := Dirs(name); !slices.Equal(got, want) {
+			t.Errorf("Dirs(%q) = %v, want %v", name, got, want)
+		}
+	}
+}
+
+type tarEntry struct {
+	name     string
+	typeflag byte
+	content  string
+	link     string
+}
+
+func tarBytes(entries ...tarEntry) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range entries {
+		tw.WriteHeader(&tar.Header{Name: e.name, Typeflag: e.typeflag, Size: int64(len(e.content)), Linkname: e.link, Mode: 0644})
+		io.WriteString(tw, e.content)
+	}
+	tw.Close()
+	return buf.Bytes()
+}
+
+func gzipBytes(b []byte) []byte {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write(b)
+	zw.Close()
+	return buf.Bytes()
+}
+
+type zipEntry struct {
+	name    string
+	content string
+	symlink bool
+}
+
+func zipBytes(entries ...zipEntry) []byte {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, e := range entries {
+		fh := &zip.FileHeader{Name: e.name, Method: zip.Deflate}
+		if e.symlink {
+			fh.SetMode(0777 | 1<<27)
+		}
+		w, _ := zw.CreateHeader(fh)
+		io.WriteString(w, e.content)
+	}
+	zw.Close()
+	return buf.Bytes()
+}
+
+// what the walk gave for each entry, its content or the error it was rejected with
+type walked struct {
+	name string
+	text string
+}
+
+// reads every entry as WalkTar or WalkZip give them, failing reads are recorded and returned
+func collect(entries *[]walked) EntryFunc {
+	return func(name string, r io.Reader, err error) error {
+		if err != nil {
+			*entries = append(*entries, walked{name, "error: " + err.Error()})
+			return nil
+		}
+		bts, err := io.ReadAll(r)
+		if errors.Is(err, TOO_LARGE) {
+			return err
+		}
+		if err != nil {
+			*entries = append(*entries, walked{name, "error: " + err.Error()})
+			return nil
+		}
+		*entries = append(*entries, walked{name, string(bts)})
+		return nil
+	}
+}
+
+func TestDetect(t *testing.T) {
+	tar := tarBytes(tarEntry{name: "a.txt", content: "a"})
+	tests := []struct {
+		name     string
+		head     []byte
+		filename string
+		want     string
+	}{
+		{"zip", zipBytes(zipEntry{name: "a.txt", content: "a"}), "a.zip", Zip},
+		{"empty zip", zipBytes(), "", Zip},
+		{"tar", tar, "", Tar},
+		{"tar.gz", gzipBytes(tar), "", TarGz},
+		{"gzip of anything else", gzipBytes([]byte(strings.Repeat("text ", 100))), "", ""},
+		{"docx", zipBytes(zipEntry{name: "[Content_Types].xml", content: "<Types/>"}), "a.docx", ""},
+		{"text", []byte("hello"), "", ""},
+		{"empty", nil, "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			head := tt.head[:min(len(tt.head), 512)]
+			if got := Detect(head, tt.filename); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWalkTar(t *testing.T) {
+	tooMany := make([]tarEntry, testLimits.MaxEntries+1)
+	for i := range tooMany {
+		tooMany[i] = tarEntry{name: "f", content: "x"}
+	}
+	tests := []struct {
+		name    string
+		entries []tarEntry
+		want    []walked
+		err     error
+	}{
+		{"files", []tarEntry{{name: "a.txt", content: "a"}, {name: "d/b.txt", content: "b"}}, []walked{{"a.txt", "a"}, {"d/b.txt", "b"}}, nil},
+		{"directories", []tarEntry{{name: "d/", typeflag: tar.TypeDir}, {name: "d/a.txt", content: "a"}}, []walked{{"d/a.txt", "a"}}, nil},
+		{"links", []tarEntry{
+			{name: "passwd", typeflag: tar.TypeSymlink, link: "/etc/passwd"},
+			{name: "shadow", typeflag: tar.TypeLink, link: "/etc/shadow"},
+			{name: "a.txt", content: "a"},
+		}, []walked{{"a.txt", "a"}}, nil},
+		{"traversal", []tarEntry{{name: "../../a.txt", content: "a"}, {name: "/etc/cron.d/x", content: "x"}, {name: "b.txt", content: "b"}}, []walked{
+			{"../../a.txt", "error: " + UNSAFE_PATH.Error()},
+			{"/etc/cron.d/x", "error: " + UNSAFE_PATH.Error()},
+			{"b.txt", "b"},
+		}, nil},
+		{"entry too large", []tarEntry{{name: "big", content: strings.Repeat("x", 1001)}, {name: "a.txt", content: "a"}}, []walked{
+			{"big", "error: " + ENTRY_LARGE.Error()},
+			{"a.txt", "a"},
+		}, nil},
+		{"too many", tooMany, nil, TOO_MANY},
+		{"total too large", []tarEntry{{name: "a", content: strings.Repeat("a", 1000)}, {name: "b", content: strings.Repeat("b", 1000)}, {name: "c", content: "c"}}, nil, TOO_LARGE},
+	}
+	for _, tt := range tests {
+		for _, kind := range []string{Tar, TarGz} {
+			t.Run(tt.name+" "+kind, func(t *testing.T) {
+				content := tarBytes(tt.entries...)
+				if kind == TarGz {
+					content = gzipBytes(content)
+				}
+				var got []walked
+				err := WalkTar(bytes.NewReader(content), kind, testLimits, collect(&got))
+				if !errors.Is(err, tt.err) {
+					t.Fatalf("got error %v, want %v", err, tt.err)
+				}
+				if tt.err == nil && !slices.Equal(got, tt.want) {
+					t.Errorf("got %v, want %v", got, tt.want)
+				}
+			})
+		}
+	}
+}
+
+func TestWalkZip(t *testing.T) {
+	tooMany := make([]zipEntry, testLimits.MaxEntries+1)
+	for i := range tooMany {
+		tooMany[i] = zipEntry{name: "f", content: "x"}
+	}
+	tests := []struct {
+		name    string
+		entries []zipEntry
+		want    []walked
+		err     error
+	}{
+		{"files", []zipEntry{{name: "a.txt", content: "a"}, {name: "d/b.txt", content: "b"}}, []walked{{"a.txt", "a"}, {"d/b.txt", "b"}}, nil},
+		{"directories", []zipEntry{{name: "d/"}, {name: "d/a.txt", content: "a"}}, []walked{{"d/a.txt", "a"}}, nil},
+		{"symlink", []zipEntry{{name: "passwd", content: "/etc/passwd", symlink: true}, {name: "a.txt", content: "a"}}, []walked{{"a.txt", "a"}}, nil},
+		{"traversal", []zipEntry{{name: "../a.txt", content: "a"}, {name: "d\\..\\..\\x", content: "x"}, {name: "b.txt", content: "b"}}, []walked{
+			{"../a.txt", "error: " + UNSAFE_PATH.Error()},
+			{"d\\..\\..\\x", "error: " + UNSAFE_PATH.Error()},
+			{"b.txt", "b"},
+		}, nil},
+		{"entry too large", []zipEntry{{name: "big", content: "\x00" + strings.Repeat("x", 1000)}, {name: "a.txt", content: "a"}}, []walked{
+			{"big", "error: " + ENTRY_LARGE.Error()},
+			{"a.txt", "a"},
+		}, nil},
+		// deflate shrinks a run of one byte far beyond the allowed ratio
+		{"ratio", []zipEntry{{name: "bomb", content: strings.Repeat("\x00", 900)}, {name: "a.txt", content: "a"}}, []walked{
+			{"bomb", "error: " + HIGH_RATIO.Error()},
+			{"a.txt", "a"},
+		}, nil},
+		{"too many", tooMany, nil, TOO_MANY},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			content := zipBytes(tt.entries...)
+			var got []walked
+			err := WalkZip(bytes.NewReader(content), int64(len(content)), testLimits, collect(&got))
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("got error %v, want %v", err, tt.err)
+			}
+			if tt.err == nil && !slices.Equal(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWalkZipTotal(t *testing.T) {
+	// each entry is within its own limits, together they are not
+	var entries []zipEntry
+	for _, name := range []string{"a", "b", "c"} {
+		var b strings.Builder
+		for i := range 900 {
+			b.WriteByte(byte(i*7919 + len(name)))
+		}
+		entries = append(entries, zipEntry{name: name, content: b.String()})
+	}
+	content := zipBytes(entries...)
+	var got []walked
+	if err := WalkZip(bytes.NewReader(content), int64(len(content)), testLimits, collect(&got)); !errors.Is(err, TOO_LARGE) {
+		t.Errorf("got error %v, want %v", err, TOO_LARGE)
+	}
+}
+
+func TestCountingReader(t *testing.T) {
+	tests := []struct {
+		name    string
+		content int
+		max     int64
+		spent   int64
+		err     error
+	}{
+		{"within", 10, 10, 0, nil},
+		{"over entry", 11, 10, 0, ENTRY_LARGE},
+		{"over total", 10, 100, testLimits.MaxTotalSize - 5, TOO_LARGE},
+		{"total just reached", 10, 100, testLimits.MaxTotalSize - 10, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := budget{lim: testLimits, total: tt.spent}
+			cr := &countingReader{r: strings.NewReader(strings.Repeat("x", tt.content)), b: &b, max: tt.max, over: ENTRY_LARGE}
+			_, err := io.ReadAll(cr)
+			if !errors.Is(err, tt.err) {
+				t.Errorf("got error %v, want %v", err, tt.err)
+			}
+			if b.total != tt.spent+int64(tt.content) {
+				t.Errorf("counted %d, want %d", b.total-tt.spent, tt.content)
+			}
+		})
+	}
+}
@@ -0,0 +1,206 @@
+package blob
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/blubywaff/ftag/internal/error"
+)
+
+var INVALID_KEY = errors.New("invalid blob key")
+
+// Holds the raw bytes behind resources.
+// Keys are slash separated and relative, e.g. "<id>" or "staging/<id>".
+type Store interface {
+	// writes all of r under key, failing with fs.ErrExist if it is taken
+	// the blob only appears once it is complete
+	Put(ctx context.Context, key string, r io.Reader) (int64, error)
+	// adds r to the end of an existing blob
+	// returns how much was appended, which may be non-zero even on error
+	Append(ctx context.Context, key string, r io.Reader) (int64, error)
+	Open(ctx context.Context, key string) (Reader, error)
+	Stat(ctx context.Context, key string) (Info, error)
+	// every blob whose key is below the prefix directory, "" lists everything
+	List(ctx context.Context, prefix string) ([]Info, error)
+	Delete(ctx context.Context, key string) error
+}
+
+type Reader interface {
+	io.ReadSeekCloser
+	io.ReaderAt
+}
+
+type Info struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+}
+
+// Stores blobs as plain files below Root
+type Disk struct {
+	Root string
+}
+
+func (d Disk) path(key string) (string, error) {
+	if key == "" || strings.HasPrefix(key, "/") || strings.Contains(key, "\\") {
+		return "", INVALID_KEY
+	}
+	for _, seg := range strings.Split(key, "/") {
+		if seg == "" || seg == "." || seg == ".." {
+			return "", INVALID_KEY
+		}
+	}
+	return filepath.Join(d.Root, filepath.FromSlash(key)), nil
+}
+
+// wraps a reader so that reads fail once ctx is done
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (cr ctxReader) Read(p []byte) (int, error) {
+	if err := cr.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return cr.r.Read(p)
+}
+
+func (d Disk) Put(ctx context.Context, key string, r io.Reader) (int64, error) {
+	p, err := d.path(key)
+	if err != nil {
+		return 0, err
+	}
+	if err := os.MkdirAll(filepath.Dir(p), os.ModePerm); err != nil {
+		return 0, apperror.ErrorWithContext{Original: err, Message: "could not create blob directory"}
+	}
+	if _, err := os.Stat(p); err == nil {
+		return 0, apperror.ErrorWithContext{Original: fs.ErrExist, Message: "could not create file"}
+	}
+	// written next to the blob and linked into place once complete,
+	// so that readers never see a partial blob
+	file, err := os.CreateTemp(filepath.Dir(p), filepath.Base(p)+".*.tmp")
+	if err != nil {
+		return 0, apperror.ErrorWithContext{Original: err, Message: "could not create file"}
+	}
+	defer func() {
+		if err := os.Remove(file.Name()); err != nil {
+			log.Println("could not delete temporary file for: " + key)
+		}
+	}()
+	n, err := io.Copy(file, ctxReader{ctx, r})
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return 0, apperror.ErrorWithContext{Original: err, Message: "failed on full copy"}
+	}
+	// unlike rename this fails if the key was taken in the meantime
+	if err := os.Link(file.Name(), p); err != nil {
+		return 0, apperror.ErrorWithContext{Original: err, Message: "could not create file"}
+	}
+	return n, nil
+}
+
+func (d Disk) Append(ctx context.Context, key string, r io.Reader) (int64, error) {
+	p, err := d.path(key)
+	if err != nil {
+		return 0, err
+	}
+	file, err := os.OpenFile(p, os.O_WRONLY|os.O_APPEND, os.ModePerm)
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(file, ctxReader{ctx, r})
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	return n, err
+}
+
+func (d Disk) Open(ctx context.Context, key string) (Reader, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	p, err := d.path(key)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (d Disk) Stat(ctx context.Context, key string) (Info, error) {
+	p, err := d.path(key)
+	if err != nil {
+		return Info{}, err
+	}
+	fi, err := os.Stat(p)
+	if err != nil {
+		return Info{}, err
+	}
+	return Info{Key: key, Size: fi.Size(), ModTime: fi.ModTime()}, nil
+}
+
+func (d Disk) List(ctx context.Context, prefix string) ([]Info, error) {
+	root := d.Root
+	if prefix != "" {
+		p, err := d.path(prefix)
+		if err != nil {
+			return nil, err
+		}
+		root = p
+	}
+	infos := make([]Info, 0)
+	err := filepath.WalkDir(root, func(p string, de fs.DirEntry, err error) error {
+		// temporary files of Put and evicted derived data come and go while the walk runs
+		if errors.Is(err, fs.ErrNotExist) {
+			if p == root {
+				return fs.SkipAll
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if de.IsDir() {
+			return nil
+		}
+		fi, err := de.Info()
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(d.Root, p)
+		if err != nil {
+			return err
+		}
+		infos = append(infos, Info{Key: filepath.ToSlash(rel), Size: fi.Size(), ModTime: fi.ModTime()})
+		return nil
+	})
+	return infos, err
+}
+
+// does not check ctx so that cleanup still happens after a cancellation
+func (d Disk) Delete(ctx context.Context, key string) error {
+	p, err := d.path(key)
+	if err != nil {
+		return err
+	}
+	return os.Remove(p)
+}
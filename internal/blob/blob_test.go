@@ -0,0 +1,125 @@
+package blob
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func keys(infos []Info) []string {
+	var ks []string
+	for _, bi := range infos {
+		ks = append(ks, bi.Key)
+	}
+	slices.Sort(ks)
+	return ks
+}
+
+func TestPath(t *testing.T) {
+	d := Disk{Root: "root"}
+	for key, ok := range map[string]bool{
+		"id":             true,
+		"staging/id":     true,
+		"files/id/a.txt": true,
+		"":               false,
+		"/id":            false,
+		"a//b":           false,
+		"a/./b":          false,
+		"../id":          false,
+		"a/../../b":      false,
+		"a\\b":           false,
+	} {
+		if _, err := d.path(key); (err == nil) != ok {
+			t.Errorf("path(%q) = %v, want ok %v", key, err, ok)
+		}
+	}
+}
+
+func TestPutOpenDelete(t *testing.T) {
+	ctx := context.Background()
+	d := Disk{Root: t.TempDir()}
+	if n, err := d.Put(ctx, "dir/a", strings.NewReader("hello")); err != nil || n != 5 {
+		t.Fatalf("put gave %d, %v", n, err)
+	}
+	if _, err := d.Put(ctx, "dir/a", strings.NewReader("again")); !errors.Is(err, fs.ErrExist) {
+		t.Errorf("second put gave %v", err)
+	}
+	if n, err := d.Append(ctx, "dir/a", strings.NewReader(" world")); err != nil || n != 6 {
+		t.Fatalf("append gave %d, %v", n, err)
+	}
+	if bi, err := d.Stat(ctx, "dir/a"); err != nil || bi.Size != 11 {
+		t.Errorf("stat gave %+v, %v", bi, err)
+	}
+	if err := d.Delete(ctx, "dir/a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Open(ctx, "dir/a"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("open after delete gave %v", err)
+	}
+}
+
+func TestList(t *testing.T) {
+	ctx := context.Background()
+	d := Disk{Root: t.TempDir()}
+	for _, key := range []string{"a", "b", "staging/c", "versions/a/1"} {
+		if _, err := d.Put(ctx, key, strings.NewReader(key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	all, err := d.List(ctx, "")
+	if err != nil || !slices.Equal(keys(all), []string{"a", "b", "staging/c", "versions/a/1"}) {
+		t.Errorf("list gave %v, %v", keys(all), err)
+	}
+	staging, err := d.List(ctx, "staging")
+	if err != nil || !slices.Equal(keys(staging), []string{"staging/c"}) {
+		t.Errorf("list of staging gave %v, %v", keys(staging), err)
+	}
+	missing, err := d.List(ctx, "missing")
+	if err != nil || len(missing) != 0 {
+		t.Errorf("list of a missing prefix gave %v, %v", keys(missing), err)
+	}
+}
+
+// files and directories removed during the walk are left out rather than failing it
+func TestListWhileRemoving(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	d := Disk{Root: t.TempDir()}
+	var wg sync.WaitGroup
+	for w := range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; ctx.Err() == nil; i++ {
+				dir := filepath.Join(d.Root, "cache", strconv.Itoa(w), strconv.Itoa(i%4))
+				os.MkdirAll(dir, os.ModePerm)
+				for j := range 50 {
+					os.WriteFile(filepath.Join(dir, strconv.Itoa(j)), nil, 0o644)
+				}
+				os.RemoveAll(dir)
+			}
+		}()
+	}
+	// until the churn has started
+	for {
+		if _, err := os.Stat(filepath.Join(d.Root, "cache")); err == nil {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	for start := time.Now(); time.Since(start) < 500*time.Millisecond; {
+		if _, err := d.List(ctx, ""); err != nil {
+			t.Errorf("list failed: %v", err)
+			break
+		}
+	}
+	cancel()
+	wg.Wait()
+}
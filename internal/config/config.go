@@ -2,21 +2,236 @@ package config
 
 import (
 	"encoding/json"
+	"errors"
 	"flag"
 	"log"
 	"os"
+	"time"
 )
 
+// time.Duration that is written as a string (e.g. "30s") in the config file
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = v
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+type Config_Variant struct {
+	Name string
+	// images are shrunk to fit inside this box, never enlarged
+	Width  int
+	Height int
+	// jpeg, png or webp, jpeg if empty
+	Format string
+}
+
+// resized copies of image resources
+type Config_Derive struct {
+	// generate every variant on upload, otherwise each is made on first request
+	Eager bool
+	// jpeg quality, 1 to 100
+	Quality int
+	// larger images are not decoded at all
+	MaxPixels int
+	Variants  []Config_Variant
+	// largest width or height of a resize requested with /files/{id}?w=&h=
+	MaxDimension int
+	// bytes of requested resizes to keep, least recently used are removed first
+	CacheSize int64
+}
+
+type Config_GC struct {
+	// how often unreferenced blobs are collected, 0 disables
+	Interval Duration
+	// unreferenced blobs younger than this are kept
+	Grace Duration
+}
+
 type Config_Gremlin struct {
 	Url string
 }
 
+type Config_Timeout struct {
+	// applied to every request that does not have a more specific timeout
+	Request Duration
+	Upload  Duration
+	// maintenance endpoints that walk the whole library
+	Admin Duration
+}
+
+// values for Config_Privacy.Mode
+const (
+	PrivacyOff = "off"
+	// images are stored with the data already removed
+	PrivacyIngest = "ingest"
+	// images are stored as uploaded and the data is removed whenever they are served
+	PrivacyServe = "serve"
+)
+
+// removal of the location and device data embedded in images,
+// each resource may override it, see model.Resource.Privacy
+type Config_Privacy struct {
+	Mode string
+}
+
+type Config_Scrub struct {
+	// how often every blob is checked against its hash, 0 disables
+	Interval Duration
+	// added to corrupt resources, "" to not tag them
+	Tag string
+}
+
+// near-duplicate images, found by comparing perceptual hashes
+type Config_Similar struct {
+	// most bits out of 64 that may differ for two images to count as alike
+	Threshold int
+	// how often the whole library is grouped, 0 disables
+	Interval Duration
+}
+
+type Config_Storage struct {
+	// directory that blobs are written to
+	Root string
+}
+
+type Config_Upload struct {
+	// in bytes
+	MaxFileSize    int64
+	MaxRequestSize int64
+	// resumable uploads untouched for this long are removed
+	StagingExpiry Duration
+	SweepInterval Duration
+}
+
+// limits on expanding uploaded archives
+type Config_Archive struct {
+	MaxEntries int
+	// total of all entries, in bytes
+	MaxTotalSize int64
+	// largest allowed uncompressed to compressed size ratio
+	MaxRatio int64
+}
+
+// limits on downloading files from urls
+type Config_Fetch struct {
+	Schemes []string
+	// if not empty, only these hosts may be fetched
+	Hosts []string
+	// permits loopback and private network addresses
+	AllowPrivate bool
+	MaxSize      int64
+	Timeout      Duration
+}
+
 type Config struct {
+	Archive Config_Archive
+	Derive  Config_Derive
+	Fetch   Config_Fetch
+	GC      Config_GC
 	Gremlin Config_Gremlin
+	Privacy Config_Privacy
+	Scrub   Config_Scrub
+	Similar Config_Similar
+	Storage Config_Storage
+	Timeout Config_Timeout
+	Upload  Config_Upload
 	UrlBase string
 }
 
-var Global Config
+var Global = Config{
+	Archive: Config_Archive{
+		MaxEntries:   10000,
+		MaxTotalSize: 16 << 30,
+		MaxRatio:     100,
+	},
+	Derive: Config_Derive{
+		Eager:     true,
+		Quality:   85,
+		MaxPixels: 100_000_000,
+		Variants: []Config_Variant{
+			{Name: "thumb", Width: 320, Height: 320},
+		},
+		MaxDimension: 4096,
+		CacheSize:    1 << 30,
+	},
+	Fetch: Config_Fetch{
+		Schemes: []string{"http", "https"},
+		MaxSize: 1 << 30,
+		Timeout: Duration{5 * time.Minute},
+	},
+	GC: Config_GC{
+		Interval: Duration{24 * time.Hour},
+		Grace:    Duration{24 * time.Hour},
+	},
+	Privacy: Config_Privacy{
+		Mode: PrivacyOff,
+	},
+	Scrub: Config_Scrub{
+		Interval: Duration{7 * 24 * time.Hour},
+		Tag:      "meta-corrupt",
+	},
+	Similar: Config_Similar{
+		Threshold: 10,
+		Interval:  Duration{7 * 24 * time.Hour},
+	},
+	Storage: Config_Storage{
+		Root: "files",
+	},
+	Upload: Config_Upload{
+		MaxFileSize:    1 << 30,
+		MaxRequestSize: 4 << 30,
+		StagingExpiry:  Duration{24 * time.Hour},
+		SweepInterval:  Duration{time.Hour},
+	},
+	Timeout: Config_Timeout{
+		Request: Duration{30 * time.Second},
+		Upload:  Duration{30 * time.Minute},
+		Admin:   Duration{time.Hour},
+	},
+}
+
+// values that parse but cannot be used
+func (c Config) check() error {
+	for _, v := range c.Derive.Variants {
+		switch v.Format {
+		case "", "jpeg", "png", "webp":
+		default:
+			return errors.New("unknown format of variant " + v.Name + ": " + v.Format)
+		}
+	}
+	switch c.Privacy.Mode {
+	case PrivacyOff, PrivacyIngest, PrivacyServe:
+	default:
+		return errors.New("unknown privacy mode: " + c.Privacy.Mode)
+	}
+	// a request context that is already done fails every request
+	for name, d := range map[string]Duration{
+		"Timeout.Request": c.Timeout.Request,
+		"Timeout.Upload":  c.Timeout.Upload,
+		"Timeout.Admin":   c.Timeout.Admin,
+		"Fetch.Timeout":   c.Fetch.Timeout,
+	} {
+		if d.Duration <= 0 {
+			return errors.New(name + " must be positive")
+		}
+	}
+	return nil
+}
 
 func Load() {
 	var (
@@ -35,5 +250,10 @@ func Load() {
 	if err != nil {
 		log.Fatal("failed to read config:", err)
 	}
-	json.Unmarshal(bts, &Global)
+	if err := json.Unmarshal(bts, &Global); err != nil {
+		log.Fatal("failed to parse config:", err)
+	}
+	if err := Global.check(); err != nil {
+		log.Fatal("invalid config: ", err)
+	}
 }
@@ -0,0 +1,39 @@
+package config
+
+import (
+	"encoding/json"
+	"slices"
+	"testing"
+)
+
+func TestCheck(t *testing.T) {
+	tests := []struct {
+		name string
+		json string
+		ok   bool
+	}{
+		{"defaults", `{}`, true},
+		{"webp variant", `{"Derive": {"Variants": [{"Name": "w", "Format": "webp"}]}}`, true},
+		{"unknown format", `{"Derive": {"Variants": [{"Name": "g", "Format": "gif"}]}}`, false},
+		{"privacy mode", `{"Privacy": {"Mode": "serve"}}`, true},
+		{"unknown privacy mode", `{"Privacy": {"Mode": "always"}}`, false},
+		{"request timeout", `{"Timeout": {"Request": "1m"}}`, true},
+		{"zero request timeout", `{"Timeout": {"Request": "0s"}}`, false},
+		{"negative upload timeout", `{"Timeout": {"Upload": "-1s"}}`, false},
+		{"zero admin timeout", `{"Timeout": {"Admin": "0"}}`, false},
+		{"zero fetch timeout", `{"Fetch": {"Timeout": "0s"}}`, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := Global
+			// unmarshalling reuses the elements of the slice
+			c.Derive.Variants = slices.Clone(c.Derive.Variants)
+			if err := json.Unmarshal([]byte(tt.json), &c); err != nil {
+				t.Fatal(err)
+			}
+			if err := c.check(); (err == nil) != tt.ok {
+				t.Errorf("check() = %v, want ok %v", err, tt.ok)
+			}
+		})
+	}
+}
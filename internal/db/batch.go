@@ -0,0 +1,82 @@
+package db
+
+import (
+	"context"
+	"io"
+
+	gremlingo "github.com/apache/tinkerpop/gremlin-go/v3/driver"
+	"github.com/blubywaff/ftag/internal/error"
+	"github.com/blubywaff/ftag/internal/model"
+)
+
+// A group of additions sharing one transaction.
+// Nothing is visible until Commit, and Rollback removes every blob written so far.
+type Batch interface {
+	AddFile(ctx context.Context, f io.Reader, tags model.TagSet, meta FileMeta) (AddResult, error)
+	Commit(ctx context.Context) error
+	// safe to call after Commit, in which case it does nothing
+	Rollback() error
+}
+
+type tinkerpopBatch struct {
+	t     *Tinkerpop
+	tx    *gremlingo.Transaction
+	g     *GraphTraversalSource
+	blobs []apperror.IntermediateResult
+}
+
+func (t *Tinkerpop) BeginBatch(ctx context.Context) (Batch, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	tx := t.g.Tx()
+	g, err := tx.Begin()
+	if err != nil {
+		return nil, err
+	}
+	return &tinkerpopBatch{t: t, tx: tx, g: g}, nil
+}
+
+func (b *tinkerpopBatch) AddFile(ctx context.Context, f io.Reader, tags model.TagSet, meta FileMeta) (AddResult, error) {
+	if !model.ValidPrivacy(meta.Privacy) {
+		return AddResult{}, INVALID_PRIVACY
+	}
+	w, ir := b.t.writeFileReversible(ctx, f, meta.Filename, stripAtIngest(meta.Privacy))
+	if err := ir.OpError(); err != nil {
+		return AddResult{}, err
+	}
+	ar, err := b.t.addResource(ctx, b.g, w, tags, meta)
+	if err != nil || ar.Duplicate {
+		ir.Clean()
+		return ar, err
+	}
+	b.blobs = append(b.blobs, ir)
+	return ar, nil
+}
+
+func (b *tinkerpopBatch) Commit(ctx context.Context) error {
+	// last chance to back out before the vertices become visible
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := b.tx.Commit(); err != nil {
+		return err
+	}
+	for i := range b.blobs {
+		b.blobs[i].Commit()
+	}
+	return nil
+}
+
+func (b *tinkerpopBatch) Rollback() error {
+	var err error
+	if b.tx.IsOpen() {
+		err = b.tx.Rollback()
+	}
+	for i := range b.blobs {
+		if cerr := b.blobs[i].Clean(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
@@ -0,0 +1,443 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	gremlingo "github.com/apache/tinkerpop/gremlin-go/v3/driver"
+	"github.com/blubywaff/ftag/internal/model"
+)
+
+var INVALID_COLLECTION = errors.New("invalid collection name or description")
+
+// Returned by ReorderCollection when the order given does not have exactly the current members
+var MEMBERS_CHANGED = errors.New("members of collection differ")
+
+const (
+	maxCollectionName = 1 << 8
+	maxDescription    = 1 << 14
+)
+
+// Collections are "collection" vertices with "contains" edges to their members,
+// each edge holds the position of the member starting from 0.
+
+func validCollection(name string, description string) bool {
+	return name != "" && len(name) <= maxCollectionName && utf8.ValidString(name) &&
+		len(description) <= maxDescription && utf8.ValidString(description)
+}
+
+func toCollection(m map[interface{}]interface{}) (model.Collection, error) {
+	var c model.Collection
+	v, ok := m["c"].(map[interface{}]interface{})
+	if !ok {
+		return c, errors.New("Invalid type collection map")
+	}
+	c.Id, ok = v["col_id"].(string)
+	if !ok {
+		return c, errors.New("Invalid type col id")
+	}
+	c.Name, _ = v["name"].(string)
+	c.Description, _ = v["description"].(string)
+	created, ok := v["created"].(string)
+	if !ok {
+		return c, errors.New("Invalid type created")
+	}
+	var err error
+	c.CreatedAt, err = parseUpload(created)
+	if err != nil {
+		return c, errors.New("Invalid timestamp (parsing)")
+	}
+	t, ok := m["t"].([]interface{})
+	if !ok {
+		return c, errors.New("Invalid type tag slice")
+	}
+	ts, err := FromInterfaceSlice[string](t)
+	if err != nil {
+		return c, errors.New("Invalid tags tagset slice")
+	}
+	if err := c.Tags.FromSlice(ts); err != nil {
+		return c, errors.New("Invalid tags tagset")
+	}
+	members, ok := m["m"].([]interface{})
+	if !ok {
+		return c, errors.New("Invalid type member slice")
+	}
+	c.Members, err = FromInterfaceSlice[string](members)
+	if err != nil {
+		return c, errors.New("Invalid type member id")
+	}
+	return c, nil
+}
+
+func getCollections(ctx context.Context, tr *GraphTraversal) ([]model.Collection, error) {
+	rs, err := toList(ctx, tr.
+		Project("c", "t", "m").
+		By(__.ElementMap()).
+		By(__.In("describes").Values("name").Fold()).
+		By(__.OutE("contains").Order().By("pos", asc).InV().Values("rsc_id").Fold()))
+	if err != nil {
+		return nil, err
+	}
+	collections := make([]model.Collection, 0, len(rs))
+	for _, r := range rs {
+		m, ok := r.GetInterface().(map[interface{}]interface{})
+		if !ok {
+			return nil, errors.New("Invalid type top map")
+		}
+		c, err := toCollection(m)
+		if err != nil {
+			return nil, err
+		}
+		collections = append(collections, c)
+	}
+	return collections, nil
+}
+
+func getCollection(ctx context.Context, g *GraphTraversalSource, id string) (model.Collection, error) {
+	cs, err := getCollections(ctx, g.V().Has("collection", "col_id", id))
+	if err != nil {
+		return model.Collection{}, err
+	}
+	if len(cs) == 0 {
+		return model.Collection{}, NO_RESULT
+	}
+	return cs[0], nil
+}
+
+func (t *Tinkerpop) GetCollection(ctx context.Context, id string) (model.Collection, error) {
+	return getCollection(ctx, t.g, id)
+}
+
+// Every collection, by name
+func (t *Tinkerpop) Collections(ctx context.Context) ([]model.Collection, error) {
+	cs, err := getCollections(ctx, t.g.V().HasLabel("collection"))
+	if err != nil {
+		return nil, err
+	}
+	slices.SortFunc(cs, func(a, b model.Collection) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+	return cs, nil
+}
+
+// Creates an empty collection, only tags that already exist are attached
+func (t *Tinkerpop) CreateCollection(ctx context.Context, name string, description string, tags model.TagSet) (model.Collection, error) {
+	if !validCollection(name, description) {
+		return model.Collection{}, INVALID_COLLECTION
+	}
+	id, err := GenUUID()
+	if err != nil {
+		return model.Collection{}, err
+	}
+	tx := t.g.Tx()
+	g, err := tx.Begin()
+	if err != nil {
+		return model.Collection{}, err
+	}
+	defer tx.Rollback()
+	props := map[string]interface{}{
+		"col_id":      id,
+		"name":        name,
+		"description": description,
+		"created":     time.Now().UTC().Format(TimeFormat),
+	}
+	tr := g.AddV("collection")
+	for _, k := range propKeys(props) {
+		tr = tr.Property(k, props[k])
+	}
+	if err := iterate(ctx, tr); err != nil {
+		return model.Collection{}, err
+	}
+	if err := changeTagsOf(ctx, g, "collection", "col_id", tags, model.TagSet{}, id); err != nil {
+		return model.Collection{}, err
+	}
+	if err := ctx.Err(); err != nil {
+		return model.Collection{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return model.Collection{}, err
+	}
+	return getCollection(ctx, t.g, id)
+}
+
+// Renames a collection and changes its description and tags
+func (t *Tinkerpop) EditCollection(ctx context.Context, id string, name string, description string, addtags model.TagSet, deltags model.TagSet) (model.Collection, error) {
+	if !validCollection(name, description) {
+		return model.Collection{}, INVALID_COLLECTION
+	}
+	tx := t.g.Tx()
+	g, err := tx.Begin()
+	if err != nil {
+		return model.Collection{}, err
+	}
+	defer tx.Rollback()
+	if _, err := getCollection(ctx, g, id); err != nil {
+		return model.Collection{}, err
+	}
+	tr := g.V().Has("collection", "col_id", id).
+		Property(gremlingo.Cardinality.Single, "name", name)
+	if description == "" {
+		tr = tr.SideEffect(__.Properties("description").Drop())
+	} else {
+		tr = tr.Property(gremlingo.Cardinality.Single, "description", description)
+	}
+	if err := iterate(ctx, tr); err != nil {
+		return model.Collection{}, err
+	}
+	if err := changeTagsOf(ctx, g, "collection", "col_id", addtags, deltags, id); err != nil {
+		return model.Collection{}, err
+	}
+	if err := ctx.Err(); err != nil {
+		return model.Collection{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return model.Collection{}, err
+	}
+	return getCollection(ctx, t.g, id)
+}
+
+// Deletes the collection, its members are not touched
+func (t *Tinkerpop) DeleteCollection(ctx context.Context, id string) error {
+	found, err := toList(ctx, t.g.V().Has("collection", "col_id", id).Limit(1))
+	if err != nil {
+		return err
+	}
+	if len(found) == 0 {
+		return NO_RESULT
+	}
+	return iterate(ctx, t.g.V().Has("collection", "col_id", id).Drop())
+}
+
+// member edges changed per traversal
+const memberBatch = 200
+
+// Changes the members of the collection from old to members in that order,
+// only the edges of members that left, joined or moved are touched
+func setMembers(ctx context.Context, g *GraphTraversalSource, id string, old []string, members []string) error {
+	pos := make(map[string]int, len(old))
+	for i, m := range old {
+		pos[m] = i
+	}
+	keep := make(map[string]bool, len(members))
+	for _, m := range members {
+		keep[m] = true
+	}
+	var removed []string
+	for _, m := range old {
+		if !keep[m] {
+			removed = append(removed, m)
+		}
+	}
+	if len(removed) != 0 {
+		err := iterate(ctx, g.V().Has("collection", "col_id", id).
+			OutE("contains").Where(__.InV().Values("rsc_id").Is(within(ToInterfaceSlice(removed)...))).
+			Drop())
+		if err != nil {
+			return err
+		}
+	}
+	var changes []*GraphTraversal
+	for i, m := range members {
+		p, ok := pos[m]
+		switch {
+		case !ok:
+			changes = append(changes, __.AddE("contains").To(__.V().Has("resource", "rsc_id", m)).
+				Property("pos", int64(i)))
+		case p != i:
+			changes = append(changes, __.OutE("contains").Where(__.InV().Has("rsc_id", m)).
+				Property("pos", int64(i)))
+		}
+	}
+	for batch := range slices.Chunk(changes, memberBatch) {
+		tr := g.V().Has("collection", "col_id", id)
+		for _, c := range batch {
+			tr = tr.SideEffect(c)
+		}
+		if err := iterate(ctx, tr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Appends the resources in add that are not members yet and then removes those in remove.
+// Fails with NO_RESULT if the collection or any resource to add does not exist.
+func (t *Tinkerpop) ChangeMembers(ctx context.Context, id string, add []string, remove []string) (model.Collection, error) {
+	tx := t.g.Tx()
+	g, err := tx.Begin()
+	if err != nil {
+		return model.Collection{}, err
+	}
+	defer tx.Rollback()
+	c, err := getCollection(ctx, g, id)
+	if err != nil {
+		return model.Collection{}, err
+	}
+	members := c.Members
+	for _, m := range add {
+		if !slices.Contains(members, m) {
+			members = append(members, m)
+		}
+	}
+	members = slices.DeleteFunc(members, func(m string) bool {
+		return slices.Contains(remove, m)
+	})
+	if unique := slices.Compact(slices.Sorted(slices.Values(add))); len(unique) != 0 {
+		found, err := toList(ctx, g.V().HasLabel("resource").
+			Where(__.Values("rsc_id").Is(within(ToInterfaceSlice(unique)...))).Values("rsc_id").Dedup().Count())
+		if err != nil {
+			return model.Collection{}, err
+		}
+		if n, _ := found[0].GetInt(); n != len(unique) {
+			return model.Collection{}, NO_RESULT
+		}
+	}
+	if err := setMembers(ctx, g, id, c.Members, members); err != nil {
+		return model.Collection{}, err
+	}
+	if err := ctx.Err(); err != nil {
+		return model.Collection{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return model.Collection{}, err
+	}
+	return getCollection(ctx, t.g, id)
+}
+
+// Puts the members in the given order, which must hold every current member exactly once
+func (t *Tinkerpop) ReorderCollection(ctx context.Context, id string, order []string) (model.Collection, error) {
+	tx := t.g.Tx()
+	g, err := tx.Begin()
+	if err != nil {
+		return model.Collection{}, err
+	}
+	defer tx.Rollback()
+	c, err := getCollection(ctx, g, id)
+	if err != nil {
+		return model.Collection{}, err
+	}
+	if !slices.Equal(slices.Sorted(slices.Values(c.Members)), slices.Sorted(slices.Values(order))) {
+		return model.Collection{}, MEMBERS_CHANGED
+	}
+	if err := setMembers(ctx, g, id, c.Members, order); err != nil {
+		return model.Collection{}, err
+	}
+	if err := ctx.Err(); err != nil {
+		return model.Collection{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return model.Collection{}, err
+	}
+	return getCollection(ctx, t.g, id)
+}
+
+// Adds the collections in one transaction keeping their ids, creating any tags they need.
+// Collections whose id is already present are skipped so that an interrupted import can be rerun,
+// members that do not exist are left out.
+// Returns how many collections were added.
+func (t *Tinkerpop) ImportCollections(ctx context.Context, cs []model.Collection) (int, error) {
+	tx := t.g.Tx()
+	g, err := tx.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var names model.TagSet
+	ids := make([]string, len(cs))
+	var members []string
+	for i, c := range cs {
+		if !validCollection(c.Name, c.Description) {
+			return 0, INVALID_COLLECTION
+		}
+		names.Union(c.Tags)
+		ids[i] = c.Id
+		members = append(members, c.Members...)
+	}
+	if err := ensureTags(ctx, g, names); err != nil {
+		return 0, err
+	}
+	found, err := toList(ctx, g.V().HasLabel("collection").
+		Where(__.Values("col_id").Is(within(ToInterfaceSlice(ids)...))).
+		Values("col_id"))
+	if err != nil {
+		return 0, err
+	}
+	present := make(map[string]bool, len(found))
+	for _, f := range found {
+		present[f.GetString()] = true
+	}
+	exists := make(map[string]bool)
+	if len(members) != 0 {
+		found, err = toList(ctx, g.V().HasLabel("resource").
+			Where(__.Values("rsc_id").Is(within(ToInterfaceSlice(members)...))).
+			Values("rsc_id"))
+		if err != nil {
+			return 0, err
+		}
+		for _, f := range found {
+			exists[f.GetString()] = true
+		}
+	}
+
+	added := 0
+	for _, c := range cs {
+		if present[c.Id] {
+			continue
+		}
+		props := map[string]interface{}{
+			"col_id":      c.Id,
+			"name":        c.Name,
+			"description": c.Description,
+			"created":     c.CreatedAt.UTC().Format(TimeFormat),
+		}
+		tr := g.AddV("collection")
+		for _, k := range propKeys(props) {
+			tr = tr.Property(k, props[k])
+		}
+		if err := iterate(ctx, tr); err != nil {
+			return 0, err
+		}
+		if err := changeTagsOf(ctx, g, "collection", "col_id", c.Tags, model.TagSet{}, c.Id); err != nil {
+			return 0, err
+		}
+		var kept []string
+		seen := make(map[string]bool, len(c.Members))
+		for _, m := range c.Members {
+			if exists[m] && !seen[m] {
+				kept = append(kept, m)
+				seen[m] = true
+			}
+		}
+		if err := setMembers(ctx, g, c.Id, nil, kept); err != nil {
+			return 0, err
+		}
+		// guards against the same id twice
+		present[c.Id] = true
+		added++
+	}
+
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return added, nil
+}
+
+// The collections id is a member of, by name
+func (t *Tinkerpop) CollectionsOf(ctx context.Context, id string) ([]model.Collection, error) {
+	cs, err := getCollections(ctx, t.g.V().Has("resource", "rsc_id", id).In("contains"))
+	if err != nil {
+		return nil, err
+	}
+	slices.SortFunc(cs, func(a, b model.Collection) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+	return cs, nil
+}
@@ -3,18 +3,26 @@ package db
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"io"
 	"log"
 	"net/http"
-	"os"
+	"slices"
+	"strings"
+	"sync"
 	"time"
 
 	"errors"
 
 	gremlingo "github.com/apache/tinkerpop/gremlin-go/v3/driver"
+	"github.com/blubywaff/ftag/internal/blob"
 	"github.com/blubywaff/ftag/internal/config"
 	"github.com/blubywaff/ftag/internal/error"
+	"github.com/blubywaff/ftag/internal/exif"
+	"github.com/blubywaff/ftag/internal/markdown"
 	"github.com/blubywaff/ftag/internal/model"
+	"github.com/blubywaff/ftag/internal/probe"
 	"github.com/google/uuid"
 )
 
@@ -61,13 +69,90 @@ var desc = gremlingo.Order.Desc
 var asc = gremlingo.Order.Asc
 var NO_RESULT error = errors.New("database no result")
 
+// Outcome of storing a single file
+type AddResult struct {
+	Resource model.Resource
+	// the content was already stored, Resource is the existing
+	// resource which has had the requested tags added to it, only with FileMeta.Dedupe
+	Duplicate bool
+	// embedded keywords that cannot be tags, with FileMeta.Keywords
+	InvalidKeywords []string
+	// embedded keywords that were not added since there is no such tag
+	UnknownKeywords []string
+}
+
+// Details about a file that cannot be found from its content
+type FileMeta struct {
+	// url the file was downloaded from, if any
+	Source string
+	// name of the file on the uploader's system, if known
+	Filename string
+	// also tag the resource with the keywords embedded in the file
+	Keywords bool
+	// see model.Resource.Privacy
+	Privacy string
+	// if the content is already stored add the tags to that resource instead of adding another
+	Dedupe bool
+}
+
 type Database interface {
-	// returns the id of the newly added file
-	AddFile(ctx context.Context, f io.Reader, tags model.TagSet) (string, error)
+	// returns the newly added resource, or with FileMeta.Dedupe the existing one if the content is already stored
+	AddFile(ctx context.Context, f io.Reader, tags model.TagSet, meta FileMeta) (AddResult, error)
+	// starts a group of additions that are committed or abandoned together
+	BeginBatch(ctx context.Context) (Batch, error)
 	ChangeTags(ctx context.Context, addtags model.TagSet, deltags model.TagSet, id string) error
 	TagQuery(ctx context.Context, query model.Query) ([]model.Resource, error)
+	// the ids of every match of query, ignoring its offset and limit, see Tinkerpop.TagQueryIds
+	TagQueryIds(ctx context.Context, query model.Query) ([]string, error)
 	GetFile(ctx context.Context, id string) (model.Resource, error)
+	// those of ids that exist, in no particular order
+	GetFiles(ctx context.Context, ids []string) ([]model.Resource, error)
 	GetBytes(ctx context.Context, id string) ([]byte, error)
+	SetPrivacy(ctx context.Context, id string, privacy string) error
+	// see Tinkerpop.ReplaceContent
+	ReplaceContent(ctx context.Context, id string, f io.Reader, meta FileMeta) (model.Resource, error)
+	Versions(ctx context.Context, id string) ([]model.Version, error)
+	GetVersion(ctx context.Context, id string, n int) (model.Version, error)
+	RevertContent(ctx context.Context, id string, n int) (model.Resource, error)
+	// see Tinkerpop.Relate
+	Relate(ctx context.Context, rel model.Relation) error
+	Unrelate(ctx context.Context, rel model.Relation) error
+	Neighborhood(ctx context.Context, id string) ([]model.Neighbor, error)
+	RelationsFrom(ctx context.Context, ids []string) ([]model.Relation, error)
+	GetCollection(ctx context.Context, id string) (model.Collection, error)
+	Collections(ctx context.Context) ([]model.Collection, error)
+	CollectionsOf(ctx context.Context, id string) ([]model.Collection, error)
+	CreateCollection(ctx context.Context, name string, description string, tags model.TagSet) (model.Collection, error)
+	EditCollection(ctx context.Context, id string, name string, description string, addtags model.TagSet, deltags model.TagSet) (model.Collection, error)
+	DeleteCollection(ctx context.Context, id string) error
+	ChangeMembers(ctx context.Context, id string, add []string, remove []string) (model.Collection, error)
+	ReorderCollection(ctx context.Context, id string, order []string) (model.Collection, error)
+	// see Tinkerpop.PropertyDefs
+	PropertyDefs(ctx context.Context) ([]model.PropertyDef, error)
+	DefineProperty(ctx context.Context, def model.PropertyDef) error
+	RemoveProperty(ctx context.Context, key string) error
+	ChangeProps(ctx context.Context, id string, set map[string]interface{}, unset []string) error
+	// see Tinkerpop.AddItem
+	AddItem(ctx context.Context, item Item, tags model.TagSet) (AddResult, error)
+	EditItem(ctx context.Context, id string, item Item) (model.Resource, error)
+	// see Tinkerpop.AddNamedFile
+	AddNamedFile(ctx context.Context, id string, name string, f io.Reader, filename string) (model.File, error)
+	GetNamedFile(ctx context.Context, id string, name string) (model.File, error)
+	RemoveNamedFile(ctx context.Context, id string, name string) error
+	// see Tinkerpop.SimilarTo
+	SimilarTo(ctx context.Context, id string, threshold int) ([]Similar, error)
+	// see Tinkerpop.GroupSimilar
+	GroupSimilar(ctx context.Context, threshold int) (SimilarReport, error)
+	ImportResources(ctx context.Context, rs []Imported) (int, error)
+	ImportCollections(ctx context.Context, cs []model.Collection) (int, error)
+	// checks that the graph and blob storage agree, see Tinkerpop.Fsck
+	Fsck(ctx context.Context, repair bool, grace time.Duration) (FsckReport, error)
+	// checks every blob against its recorded hash, see Tinkerpop.Scrub
+	Scrub(ctx context.Context, tag string) (ScrubReport, error)
+	// deletes blobs nothing refers to, see Tinkerpop.GC
+	GC(ctx context.Context, opts GCOptions) (GCReport, error)
+	// detects the mimetype of every resource again, see Tinkerpop.Redetect
+	Redetect(ctx context.Context, dryRun bool) (RedetectReport, error)
 	Close(ctx context.Context) error
 }
 
@@ -103,15 +188,67 @@ func FromInterfaceSlice[T any](in []interface{}) ([]T, error) {
 type Tinkerpop struct {
 	g      *GraphTraversalSource
 	remote *gremlingo.DriverRemoteConnection
+	blobs  blob.Store
+	// content is swapped in place, see ReplaceContent and Scrub
+	replaceMu sync.Mutex
+}
+
+// waits for the traversal to finish, giving up early if ctx is done
+func iterate(ctx context.Context, g *GraphTraversal) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	select {
+	case err := <-g.Iterate():
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
-func ToResources(g *GraphTraversal) ([]model.Resource, error) {
+// like ToList, giving up early if ctx is done
+func toList(ctx context.Context, g *GraphTraversal) ([]*gremlingo.Result, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	type listResult struct {
+		list []*gremlingo.Result
+		err  error
+	}
+	ch := make(chan listResult, 1)
+	go func() {
+		l, err := g.ToList()
+		ch <- listResult{l, err}
+	}()
+	select {
+	case lr := <-ch:
+		return lr.list, lr.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func ToResources(ctx context.Context, g *GraphTraversal) ([]model.Resource, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	rs, err := g.GetResultSet()
 	var resources []model.Resource
 	if err != nil {
 		return nil, errors.New("result set failure")
 	}
-	for r := range rs.Channel() {
+	ch := rs.Channel()
+	for {
+		var r *gremlingo.Result
+		var ok bool
+		select {
+		case r, ok = <-ch:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		if !ok {
+			break
+		}
 		var resource model.Resource
 		m, ok := r.Data.(map[interface{}]interface{})
 		if !ok {
@@ -141,118 +278,325 @@ func ToResources(g *GraphTraversal) ([]model.Resource, error) {
 		if !ok {
 			return nil, errors.New("Invalid type mime")
 		}
+		// optional
+		resource.Source, _ = v["source"].(string)
+		resource.Hash, _ = v["sha256"].(string)
+		resource.Filename, _ = v["filename"].(string)
+		resource.Size = toInt64(v["size"])
+		resource.Width = int(toInt64(v["width"]))
+		resource.Height = int(toInt64(v["height"]))
+		resource.Duration, _ = v["duration"].(float64)
+		resource.Camera, _ = v["camera"].(string)
+		resource.Privacy, _ = v["privacy"].(string)
+		resource.Phash, _ = v["phash"].(string)
+		resource.Kind, _ = v["kind"].(string)
+		if resource.Kind == "" {
+			resource.Kind = model.KindFile
+		}
+		resource.Url, _ = v["url"].(string)
+		resource.Title, _ = v["title"].(string)
+		resource.Text, _ = v["text"].(string)
+		if resource.Kind == model.KindNote {
+			resource.Html = markdown.Render(resource.Text)
+		}
+		resource.Props = toProps(v)
+		if str, ok := v["captured"].(string); ok {
+			if captured, err := parseUpload(str); err == nil {
+				resource.Captured = &captured
+			}
+		}
 		upload, ok := v["upload"].(string)
 		if !ok {
 			return nil, errors.New("Invalid type upload")
 		}
-		err = nil
-		for _, tf := range TimeFormatP {
-			resource.CreatedAt, err = time.Parse(tf, upload)
-			if err == nil {
-				break
-			}
-		}
+		resource.CreatedAt, err = parseUpload(upload)
 		if err != nil {
 			return nil, errors.New("Invalid timestamp (parsing)")
 		}
+		// absent where the projection leaves them out
+		if f, ok := m["f"].([]interface{}); ok {
+			resource.Files, err = toFiles(f)
+			if err != nil {
+				return nil, err
+			}
+		}
 		resources = append(resources, resource)
 	}
-	return resources, nil
+	return resources, rs.GetError()
 }
 
-func (t *Tinkerpop) AddFile(ctx context.Context, f io.Reader, tags model.TagSet) (string, error) {
-	tx := t.g.Tx()
-	g, err := tx.Begin()
+func (t *Tinkerpop) AddFile(ctx context.Context, f io.Reader, tags model.TagSet, meta FileMeta) (AddResult, error) {
+	b, err := t.BeginBatch(ctx)
 	if err != nil {
-		return "", err
+		return AddResult{}, err
 	}
-	defer tx.Rollback()
-	uid, mime, ir := writeFileReversible(f)
-	if err := ir.OpError(); err != nil {
-		return "", err
+	defer b.Rollback()
+	ar, err := b.AddFile(ctx, f, tags, meta)
+	if err != nil {
+		return AddResult{}, err
+	}
+	if err := b.Commit(ctx); err != nil {
+		return AddResult{}, err
+	}
+	return ar, nil
+}
+
+// creates the resource vertex for an already written blob
+// or with meta.Dedupe adds the tags, and the source if it has none, to the resource that already has the same content
+func (t *Tinkerpop) addResource(ctx context.Context, g *GraphTraversalSource, w written, tags model.TagSet, meta FileMeta) (AddResult, error) {
+	var kwtags model.TagSet
+	var invalid []string
+	if meta.Keywords {
+		for _, kw := range w.Exif.Keywords {
+			if err := kwtags.Add(keywordTag(kw)); err != nil {
+				invalid = append(invalid, kw)
+			}
+		}
+		tags = *tags.Duplicate().Union(kwtags)
+	}
+	var existing []*gremlingo.Result
+	if meta.Dedupe {
+		var err error
+		existing, err = toList(ctx, g.V().Has("resource", "sha256", w.Hash).Values("rsc_id").Limit(1))
+		if err != nil {
+			return AddResult{}, err
+		}
+	}
+	if len(existing) != 0 {
+		id := existing[0].GetString()
+		if err := changeTags(ctx, g, tags, model.TagSet{}, id); err != nil {
+			return AddResult{}, err
+		}
+		if meta.Source != "" {
+			// the first source found for the content is kept
+			err := iterate(ctx, g.V().Has("resource", "rsc_id", id).Not(__.Has("source")).
+				Property(gremlingo.Cardinality.Single, "source", meta.Source))
+			if err != nil {
+				return AddResult{}, err
+			}
+		}
+		rsc, err := getFile(ctx, g, id)
+		if err != nil {
+			return AddResult{}, err
+		}
+		return AddResult{Resource: rsc, Duplicate: true, InvalidKeywords: invalid, UnknownKeywords: missingTags(kwtags, rsc.Tags)}, nil
+	}
+	// only tags that already exist are attached
+	names, err := toList(ctx, g.V().HasLabel("tag").
+		Where(__.Values("name").Is(within(ToInterfaceSlice(tags.Inner)...))).
+		Values("name"))
+	if err != nil {
+		return AddResult{}, err
+	}
+	var present model.TagSet
+	for _, n := range names {
+		present.Add(n.GetString())
+	}
+	// TimeFormat only keeps whole seconds
+	created := time.Now().UTC().Truncate(time.Second)
+	var capturedAt *time.Time
+	if !w.Exif.Captured.IsZero() {
+		capturedAt = &w.Exif.Captured
+	}
+	props := w.props(meta)
+	props["rsc_id"] = w.Id
+	props["upload"] = created.Format(TimeFormat)
+	props["privacy"] = meta.Privacy
+	err = insertResource(ctx, g, props, tags)
+	if err != nil {
+		return AddResult{}, err
 	}
-	defer ir.Clean()
-	resource_map := make(map[string]string)
-	resource_map["r"] = uid
-	resource_map["m"] = mime
-	resource_map["u"] = time.Now().UTC().Format(TimeFormat)
-	ce := g.Inject(resource_map).
-		AddV("resource").
-		Property("rsc_id", __.Select("r")).
-		Property("mime", __.Select("m")).
-		Property("upload", __.Select("u")).As("r").
+	return AddResult{Resource: model.Resource{
+		Id:        w.Id,
+		Mimetype:  w.Mimetype,
+		CreatedAt: created,
+		Tags:      present,
+		Source:    meta.Source,
+		Size:      w.Size,
+		Hash:      w.Hash,
+		Filename:  meta.Filename,
+		Width:     w.Info.Width,
+		Height:    w.Info.Height,
+		Duration:  w.Info.Duration,
+		Captured:  capturedAt,
+		Camera:    w.Exif.Camera(),
+		Privacy:   meta.Privacy,
+		Phash:     w.Phash,
+		Kind:      model.KindFile,
+	}, InvalidKeywords: invalid, UnknownKeywords: missingTags(kwtags, present)}, nil
+}
+
+// keywords are free text, spaces become dashes like in the rest of a tag
+func keywordTag(kw string) string {
+	return strings.Join(strings.Fields(kw), "-")
+}
+
+// the tags of want that are not in have
+func missingTags(want model.TagSet, have model.TagSet) []string {
+	var missing []string
+	for _, t := range want.Inner {
+		if !slices.Contains(have.Inner, t) {
+			missing = append(missing, t)
+		}
+	}
+	return missing
+}
+
+// graph numbers may come back as any width
+func toInt64(v interface{}) int64 {
+	switch n := v.(type) {
+	case int64:
+		return n
+	case int32:
+		return int64(n)
+	case int:
+		return int64(n)
+	}
+	return 0
+}
+
+// Adds a resource vertex and links it to those of the tags that exist.
+// Properties that are nil, "" or 0 are left out.
+func insertResource(ctx context.Context, g *GraphTraversalSource, props map[string]interface{}, tags model.TagSet) error {
+	tr := g.AddV("resource")
+	for _, k := range propKeys(props) {
+		tr = tr.Property(k, props[k])
+	}
+	return iterate(ctx, tr.As("r").
 		V().HasLabel("tag").
 		Where(__.Values("name").Is(within(ToInterfaceSlice(tags.Inner)...))).As("t").
-		AddE("describes").From(__.Select("t")).To(__.Select("r")).
-		Iterate()
-	err = <-ce
-	if err != nil {
-		return "", err
+		AddE("describes").From(__.Select("t")).To(__.Select("r")))
+}
+
+// the keys of props that are not nil, "" or 0, sorted
+func propKeys(props map[string]interface{}) []string {
+	keys := make([]string, 0, len(props))
+	for k, v := range props {
+		if v == nil || v == "" || v == int64(0) || v == float64(0) {
+			continue
+		}
+		keys = append(keys, k)
 	}
-	err = tx.Commit()
+	slices.Sort(keys)
+	return keys
+}
+
+// details of a blob written by writeFileReversible
+type written struct {
+	Id       string
+	Mimetype string
+	Hash     string
+	Size     int64
+	Info     probe.Info
+	Exif     exif.Meta
+	// "" if it is not an image that can be decoded
+	Phash string
+}
+
+// The mimetype of a stored blob, see probe.Detect
+func (t *Tinkerpop) detectBlob(ctx context.Context, key string, size int64, filename string) (string, error) {
+	f, err := t.blobs.Open(ctx, key)
 	if err != nil {
 		return "", err
 	}
-	err = ir.Commit()
+	defer f.Close()
+	return probe.Detect(f, size, filename), nil
+}
+
+// the properties of a resource that describe its content, see contentKeys
+func (w written) props(meta FileMeta) map[string]interface{} {
+	var captured string
+	if !w.Exif.Captured.IsZero() {
+		captured = w.Exif.Captured.Format(TimeFormat)
+	}
+	return map[string]interface{}{
+		"mime":     w.Mimetype,
+		"sha256":   w.Hash,
+		"source":   meta.Source,
+		"filename": meta.Filename,
+		"size":     w.Size,
+		"width":    int64(w.Info.Width),
+		"height":   int64(w.Info.Height),
+		"duration": w.Info.Duration,
+		"captured": captured,
+		"camera":   w.Exif.Camera(),
+		"phash":    w.Phash,
+	}
+}
+
+// Reads dimensions, duration and embedded metadata from a stored blob, zero where they cannot be found.
+// The dimensions are those of the image once turned upright.
+func (t *Tinkerpop) probeBlob(ctx context.Context, key string, mimetype string, size int64) (probe.Info, exif.Meta) {
+	f, err := t.blobs.Open(ctx, key)
 	if err != nil {
-		return "", err
+		return probe.Info{}, exif.Meta{}
+	}
+	defer f.Close()
+	info, err := probe.Probe(f, size, mimetype)
+	if err != nil && !errors.Is(err, probe.UNKNOWN_FORMAT) {
+		log.Println("could not probe blob", key, err)
+	}
+	meta, err := exif.Read(f, size, mimetype)
+	if err != nil && !errors.Is(err, exif.UNKNOWN_FORMAT) {
+		log.Println("could not read embedded metadata", key, err)
 	}
-	return "", nil
+	if meta.Orientation >= 5 {
+		info.Width, info.Height = info.Height, info.Width
+	}
+	return info, meta
 }
 
-// Returns id, mimetype, canceller
-func writeFileReversible(f io.Reader) (string, string, apperror.IntermediateResult) {
-	hasFailed := false
-	doFail := func() { hasFailed = true }
+// Returns the details of the stored blob and a canceller
+// The partially written blob is removed if ctx is done before the copy finishes
+// With strip, images are stored without their location and device data
+// filename is only a hint for the mimetype, see probe.Detect
+func (t *Tinkerpop) writeFileReversible(ctx context.Context, f io.Reader, filename string, strip bool) (written, apperror.IntermediateResult) {
+	if err := ctx.Err(); err != nil {
+		return written{}, apperror.IntermediateResultFromError(err)
+	}
 
 	// only need 512 because that is the max considered by `http.DetectContentType`
 	var bts = make([]byte, 512)
-	n, err := f.Read(bts)
+	n, err := io.ReadFull(f, bts)
 	if n == 0 {
-		doFail()
-		return "", "", apperror.IntermediateResultFromError(apperror.ErrorWithContext{Original: err, Message: "empty read for mime type"})
+		if err == io.EOF {
+			err = errors.New("no data")
+		}
+		return written{}, apperror.IntermediateResultFromError(apperror.ErrorWithContext{Original: err, Message: "empty read for mime type"})
 	}
-	if err != nil && err != io.EOF {
-		doFail()
-		return "", "", apperror.IntermediateResultFromError(apperror.ErrorWithContext{Original: err, Message: "failed to read for mime type"})
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return written{}, apperror.IntermediateResultFromError(apperror.ErrorWithContext{Original: err, Message: "failed to read for mime type"})
 	}
+	bts = bts[:n]
+	// enough to recognize the images that can be stripped, the rest is found once it is stored
 	mimetype := http.DetectContentType(bts)
 
 	id, err := GenUUID()
 	if err != nil {
-		return "", "", apperror.IntermediateResultFromError(apperror.ErrorWithContext{Original: err, Message: "could not create uuid"})
-	}
-
-	file, err := os.OpenFile("files/"+id, os.O_WRONLY|os.O_CREATE, os.ModePerm)
-	if err != nil {
-		doFail()
-		return "", "", apperror.IntermediateResultFromError(apperror.ErrorWithContext{Original: err, Message: "could not create file"})
+		return written{}, apperror.IntermediateResultFromError(apperror.ErrorWithContext{Original: err, Message: "could not create uuid"})
 	}
-	defer func(_id string) {
-		if err := file.Close(); err != nil {
-			// This represents a serious program issue
-			log.Panicln("UNEX double close")
-		}
-		if !hasFailed {
-			return
-		}
-		if err := os.Remove(file.Name()); err != nil {
-			log.Println("could not delete on fail: " + _id)
-		}
-	}(id)
 
-	_, err = io.Copy(file, bytes.NewReader(bts))
-	if err != nil {
-		return "", "", apperror.IntermediateResultFromError(apperror.ErrorWithContext{Original: err, Message: "failed on peek copy"})
+	hash := sha256.New()
+	content := io.MultiReader(bytes.NewReader(bts), f)
+	var size int64
+	if strip && exif.Supported(mimetype) {
+		size, err = t.putStripped(ctx, id, mimetype, content, hash)
+	} else {
+		size, err = t.blobs.Put(ctx, id, io.TeeReader(content, hash))
 	}
-	_, err = io.Copy(file, f)
 	if err != nil {
-		return "", "", apperror.IntermediateResultFromError(apperror.ErrorWithContext{Original: err, Message: "failed on full copy"})
+		return written{}, apperror.IntermediateResultFromError(err)
 	}
 
-	return id, mimetype, apperror.IntermediateResult{
+	if detected, err := t.detectBlob(ctx, id, size, filename); err == nil {
+		mimetype = detected
+	}
+	w := written{Id: id, Mimetype: mimetype, Hash: hex.EncodeToString(hash.Sum(nil)), Size: size}
+	w.Info, w.Exif = t.probeBlob(ctx, id, mimetype, size)
+	w.Phash = t.fingerprintBlob(ctx, id, mimetype)
+	return w, apperror.IntermediateResult{
 		Cleanup: func() error {
-			if err := os.Remove(file.Name()); err != nil {
+			if err := t.blobs.Delete(context.Background(), id); err != nil {
 				log.Println("could not delete on fail: " + id)
 				return err
 			}
@@ -262,49 +606,146 @@ func writeFileReversible(f io.Reader) (string, string, apperror.IntermediateResu
 	}
 }
 
-func (t *Tinkerpop) TagQuery(ctx context.Context, query model.Query) ([]model.Resource, error) {
+// the matches of query in order, without its offset and limit
+func (t *Tinkerpop) queryTraversal(ctx context.Context, query model.Query) (*GraphTraversal, error) {
 	var gt *GraphTraversal
 	if query.Include.Len() == 0 {
 		gt = t.g.V().HasLabel("resource")
 	} else {
 		gt = t.g.V().HasLabel("tag").
 			Where(__.Values("name").Is(within(ToInterfaceSlice(query.Include.Inner)...))).
-			Out("describes").GroupCount().Unfold().
+			Out("describes").HasLabel("resource").GroupCount().Unfold().
 			Where(__.Select(values).Is(eq(query.Include.Len()))).
 			Select(keys)
 	}
+	if query.Source != "" {
+		gt = gt.Has("source", TextP.Containing(query.Source))
+	}
+	if query.Filename != "" {
+		gt = gt.Has("filename", TextP.Containing(query.Filename))
+	}
+	switch query.Kind {
+	case "":
+	case model.KindFile:
+		// see itemProps
+		gt = gt.Not(__.Has("kind"))
+	default:
+		gt = gt.Has("kind", query.Kind)
+	}
+	gt = metaFilters(gt, query)
+	gt = relationFilters(gt, query)
+	gt, err := t.propFilters(ctx, gt, query.Props)
+	if err != nil {
+		return nil, err
+	}
+	if query.Collection != "" {
+		gt = gt.Where(__.In("contains").Has("collection", "col_id", query.Collection))
+	}
+
+	if !query.Untagged {
+		gt = gt.Where(__.In("describes"))
+	}
+	gt = gt.Where(
+		__.Not(__.In("describes").Values("name").Is(within(ToInterfaceSlice(query.Exclude.Inner)...))))
+	if query.Collection != "" {
+		// a resource is in a collection at most once
+		gt = gt.Order().By(__.InE("contains").Where(__.OutV().Has("col_id", query.Collection)).Values("pos"), asc)
+	} else {
+		// upload times are to the second, the id keeps pages apart when they tie
+		gt = gt.Order().By("upload", desc).By("rsc_id", asc)
+	}
+	return gt, nil
+}
+
+func (t *Tinkerpop) TagQuery(ctx context.Context, query model.Query) ([]model.Resource, error) {
+	gt, err := t.queryTraversal(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	// project rather than group by tag so that resources without tags are kept with Untagged
+	val := gt.Skip(query.Offset).Limit(query.Limit).
+		Project("r", "t", "f").
+		By(__.ElementMap()).
+		By(__.In("describes").Values("name").Fold()).
+		By(__.Out("file").ElementMap().Fold())
+
+	return ToResources(ctx, val)
+}
 
-	val := gt.As("r").In("describes").Values("name").
-		Group().By(__.Select("r")).Unfold().
-		Where(
-			__.Select(values).
-				All(not(within(ToInterfaceSlice(query.Exclude.Inner)...)))).
-		Order().By(__.Select(keys).Values("upload"), desc).
-		Skip(query.Offset).Limit(query.Limit).
-		As("r").Project("r", "t").
-		By(__.Select(keys).ElementMap()).
-		By(__.Select(values))
+// Unlike paging through TagQuery, walks the matches once,
+// so that resources added or removed meanwhile do not shift the others.
+func (t *Tinkerpop) TagQueryIds(ctx context.Context, query model.Query) ([]string, error) {
+	gt, err := t.queryTraversal(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	rs, err := toList(ctx, gt.Values("rsc_id"))
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, 0, len(rs))
+	for _, r := range rs {
+		ids = append(ids, r.GetString())
+	}
+	return ids, nil
+}
 
-	return ToResources(val)
+// narrows tr to the technical metadata bounds of the query
+func metaFilters(tr *GraphTraversal, query model.Query) *GraphTraversal {
+	bounds := []struct {
+		prop     string
+		min, max interface{}
+		zero     interface{}
+	}{
+		{"width", int64(query.MinWidth), int64(query.MaxWidth), int64(0)},
+		{"height", int64(query.MinHeight), int64(query.MaxHeight), int64(0)},
+		{"size", query.MinSize, query.MaxSize, int64(0)},
+		{"duration", query.MinDuration, query.MaxDuration, float64(0)},
+	}
+	for _, b := range bounds {
+		if b.min != b.zero {
+			tr = tr.Has(b.prop, gte(b.min))
+		}
+		if b.max != b.zero {
+			tr = tr.Has(b.prop, lte(b.max))
+		}
+	}
+	// compares the width of each resource with its own height
+	switch query.Orientation {
+	case model.Landscape:
+		tr = tr.As("o").Where(gt("o")).By("width").By("height")
+	case model.Portrait:
+		tr = tr.As("o").Where(lt("o")).By("width").By("height")
+	case model.Square:
+		tr = tr.As("o").Where(eq("o")).By("width").By("height")
+	}
+	return tr
 }
 
 func (t *Tinkerpop) GetFile(ctx context.Context, id string) (model.Resource, error) {
-	tr := t.g.V().
+	return getFile(ctx, t.g, id)
+}
+
+func (t *Tinkerpop) GetFiles(ctx context.Context, ids []string) ([]model.Resource, error) {
+	return getFiles(ctx, t.g, ids)
+}
+
+func getFile(ctx context.Context, g *GraphTraversalSource, id string) (model.Resource, error) {
+	// project directly so that resources without tags are still found
+	tr := g.V().
 		Has("resource", "rsc_id", id).
-		As("r").
-		In("describes").
-		Values("name").
-		Group().
-		By(__.Select("r")).
-		Unfold().
-		Project("r", "t").
-		By(__.Select(keys).ElementMap()).
-		By(__.Select(values))
-
-	resources, err := ToResources(tr)
+		Project("r", "t", "f").
+		By(__.ElementMap()).
+		By(__.In("describes").Values("name").Fold()).
+		By(__.Out("file").ElementMap().Fold())
+
+	resources, err := ToResources(ctx, tr)
 	if err != nil {
 		return model.Resource{}, err
 	}
+	if len(resources) == 0 {
+		return model.Resource{}, NO_RESULT
+	}
 	return resources[0], nil
 }
 
@@ -315,8 +756,23 @@ func (t *Tinkerpop) ChangeTags(ctx context.Context, addtags model.TagSet, deltag
 		return err
 	}
 	defer tx.Rollback()
-	ce := g.V().HasLabel("resource").
-		Where(__.Values("rsc_id").Is(within([]interface{}{id}...))).As("r").
+	if err := changeTags(ctx, g, addtags, deltags, id); err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func changeTags(ctx context.Context, g *GraphTraversalSource, addtags model.TagSet, deltags model.TagSet, id string) error {
+	return changeTagsOf(ctx, g, "resource", "rsc_id", addtags, deltags, id)
+}
+
+// changeTags for any tagged vertex, found by its label and id property
+func changeTagsOf(ctx context.Context, g *GraphTraversalSource, vlabel string, idKey string, addtags model.TagSet, deltags model.TagSet, id string) error {
+	ce := g.V().HasLabel(vlabel).
+		Where(__.Values(idKey).Is(within([]interface{}{id}...))).As("r").
 		V().HasLabel("tag").
 		Where(__.Values("name").Is(within(ToInterfaceSlice(addtags.Inner)...))).As("t").
 		MergeE(
@@ -326,28 +782,26 @@ func (t *Tinkerpop) ChangeTags(ctx context.Context, addtags model.TagSet, deltag
 				(to):    inV,
 			}).
 		Option(outV, __.Select("t")).
-		Option(inV, __.Select("r")).
-		Iterate()
-	err = <-ce
+		Option(inV, __.Select("r"))
+	err := iterate(ctx, ce)
 	if err != nil {
 		return err
 	}
-	ce = g.V().HasLabel("resource").
-		Where(__.Values("rsc_id").Is(within([]interface{}{id}...))).
+	ce = g.V().HasLabel(vlabel).
+		Where(__.Values(idKey).Is(within([]interface{}{id}...))).
 		InE("describes").
 		Where(__.OutV().Values("name").Is(within(ToInterfaceSlice(deltags.Inner)...))).
-		Drop().
-		Iterate()
-	err = <-ce
-	if err != nil {
-		return err
-	}
-	tx.Commit()
-	return nil
+		Drop()
+	return iterate(ctx, ce)
 }
 
 func (t *Tinkerpop) GetBytes(ctx context.Context, id string) ([]byte, error) {
-	return os.ReadFile("./files/" + id)
+	f, err := t.blobs.Open(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(f)
 }
 
 func (t *Tinkerpop) Close(ctx context.Context) error {
@@ -355,7 +809,7 @@ func (t *Tinkerpop) Close(ctx context.Context) error {
 	return nil
 }
 
-func ConnectDatabases(ctx context.Context) (*Tinkerpop, error) {
+func ConnectDatabases(ctx context.Context, blobs blob.Store) (*Tinkerpop, error) {
 	config := config.Global.Gremlin
 
 	var result Tinkerpop
@@ -363,6 +817,7 @@ func ConnectDatabases(ctx context.Context) (*Tinkerpop, error) {
 	remote, err := gremlingo.NewDriverRemoteConnection(config.Url)
 	result.g = gremlingo.Traversal_().WithRemote(remote)
 	result.remote = remote
+	result.blobs = blobs
 
 	return &result, err
 }
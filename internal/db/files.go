@@ -0,0 +1,241 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"log"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/blubywaff/ftag/internal/model"
+)
+
+var INVALID_FILE_NAME = errors.New("invalid file name")
+var FILE_EXISTS = errors.New("file name already used")
+
+// named files of a resource are kept under files/<id>/<name>
+const filesPrefix = "files"
+
+// lowercase so that names do not differ only by case, the content itself is not a name
+var fileNameRe = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]{0,63}$`)
+
+func ValidFileName(name string) bool {
+	return fileNameRe.MatchString(name)
+}
+
+func FileKey(id string, name string) string {
+	return filesPrefix + "/" + id + "/" + name
+}
+
+// The resource a named file blob belongs to
+func fileOwner(key string) (string, bool) {
+	rest, ok := strings.CutPrefix(key, filesPrefix+"/")
+	if !ok {
+		return "", false
+	}
+	id, _, ok := strings.Cut(rest, "/")
+	return id, ok
+}
+
+func toFile(m map[interface{}]interface{}) (model.File, error) {
+	var f model.File
+	var ok bool
+	f.Name, ok = m["name"].(string)
+	if !ok {
+		return f, errors.New("Invalid type file name")
+	}
+	f.Mimetype, ok = m["mime"].(string)
+	if !ok {
+		return f, errors.New("Invalid type file mime")
+	}
+	added, ok := m["added"].(string)
+	if !ok {
+		return f, errors.New("Invalid type added")
+	}
+	var err error
+	f.AddedAt, err = parseUpload(added)
+	if err != nil {
+		return f, errors.New("Invalid timestamp (parsing)")
+	}
+	f.Hash, _ = m["sha256"].(string)
+	f.Filename, _ = m["filename"].(string)
+	f.Size = toInt64(m["size"])
+	return f, nil
+}
+
+// sorted by name
+func toFiles(in []interface{}) ([]model.File, error) {
+	files := make([]model.File, 0, len(in))
+	for _, i := range in {
+		m, ok := i.(map[interface{}]interface{})
+		if !ok {
+			return nil, errors.New("Invalid type file map")
+		}
+		f, err := toFile(m)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, f)
+	}
+	slices.SortFunc(files, func(a, b model.File) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+	return files, nil
+}
+
+// Adds f to id as the file called name, see ValidFileName.
+// Images are stripped like the content of the resource would be.
+// Returns FILE_EXISTS if the name is taken, remove the file first to replace it.
+func (t *Tinkerpop) AddNamedFile(ctx context.Context, id string, name string, f io.Reader, filename string) (model.File, error) {
+	if !ValidFileName(name) {
+		return model.File{}, INVALID_FILE_NAME
+	}
+	tx := t.g.Tx()
+	g, err := tx.Begin()
+	if err != nil {
+		return model.File{}, err
+	}
+	defer tx.Rollback()
+	rsc, err := getFile(ctx, g, id)
+	if err != nil {
+		return model.File{}, err
+	}
+	for _, ef := range rsc.Files {
+		if ef.Name == name {
+			return model.File{}, FILE_EXISTS
+		}
+	}
+
+	w, written := t.writeFileReversible(ctx, f, filename, stripAtIngest(rsc.Privacy))
+	if err := written.OpError(); err != nil {
+		return model.File{}, err
+	}
+	// only needed until it is copied under its name
+	defer written.Clean()
+	key := FileKey(id, name)
+	kept := t.copyBlob(ctx, w.Id, key)
+	if err := kept.OpError(); errors.Is(err, fs.ErrExist) {
+		// a concurrent add, or the blob of a removed file that GC has not collected yet
+		return model.File{}, FILE_EXISTS
+	} else if err != nil {
+		return model.File{}, err
+	}
+	defer kept.Clean()
+
+	file := model.File{
+		Name:     name,
+		Mimetype: w.Mimetype,
+		AddedAt:  time.Now().UTC().Truncate(time.Second),
+		Size:     w.Size,
+		Hash:     w.Hash,
+		Filename: filename,
+	}
+	if err := insertFile(ctx, g, id, file); err != nil {
+		return model.File{}, err
+	}
+	if err := ctx.Err(); err != nil {
+		return model.File{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return model.File{}, err
+	}
+	kept.Commit()
+	return file, nil
+}
+
+// adds the vertex of a named file of id, its blob must already be stored
+func insertFile(ctx context.Context, g *GraphTraversalSource, id string, f model.File) error {
+	props := map[string]interface{}{
+		"name":     f.Name,
+		"mime":     f.Mimetype,
+		"sha256":   f.Hash,
+		"size":     f.Size,
+		"filename": f.Filename,
+		"added":    f.AddedAt.UTC().Format(TimeFormat),
+	}
+	tr := g.AddV("file")
+	for _, k := range propKeys(props) {
+		tr = tr.Property(k, props[k])
+	}
+	return iterate(ctx, tr.As("f").
+		V().Has("resource", "rsc_id", id).
+		AddE("file").To(__.Select("f")))
+}
+
+// The file of id called name, its content is stored under FileKey
+func (t *Tinkerpop) GetNamedFile(ctx context.Context, id string, name string) (model.File, error) {
+	rs, err := toList(ctx, t.g.V().Has("resource", "rsc_id", id).
+		Out("file").Has("name", name).ElementMap())
+	if err != nil {
+		return model.File{}, err
+	}
+	if len(rs) == 0 {
+		return model.File{}, NO_RESULT
+	}
+	m, ok := rs[0].GetInterface().(map[interface{}]interface{})
+	if !ok {
+		return model.File{}, errors.New("Invalid type file map")
+	}
+	return toFile(m)
+}
+
+// Removes the file of id called name, the resource and its other files stay
+func (t *Tinkerpop) RemoveNamedFile(ctx context.Context, id string, name string) error {
+	if _, err := t.GetNamedFile(ctx, id, name); err != nil {
+		return err
+	}
+	tx := t.g.Tx()
+	g, err := tx.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := iterate(ctx, g.V().Has("resource", "rsc_id", id).Out("file").Has("name", name).Drop()); err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	// left for GC if this fails, nothing refers to it anymore
+	if err := t.blobs.Delete(ctx, FileKey(id, name)); err != nil {
+		log.Println("could not delete removed file", FileKey(id, name), err)
+	}
+	return nil
+}
+
+// the blob keys of every named file, for GC
+func (t *Tinkerpop) fileKeys(ctx context.Context) (map[string]bool, error) {
+	rs, err := toList(ctx, t.g.V().HasLabel("resource").Where(__.Out("file")).
+		Project("r", "n").
+		By(__.ElementMap("rsc_id")).
+		By(__.Out("file").Values("name").Fold()))
+	if err != nil {
+		return nil, err
+	}
+	keys := make(map[string]bool)
+	for _, r := range rs {
+		m, ok := r.GetInterface().(map[interface{}]interface{})
+		if !ok {
+			return nil, errors.New("Invalid type file projection")
+		}
+		rm, _ := m["r"].(map[interface{}]interface{})
+		id, ok := rm["rsc_id"].(string)
+		if !ok {
+			continue
+		}
+		names, _ := m["n"].([]interface{})
+		for _, n := range names {
+			if name, ok := n.(string); ok {
+				keys[FileKey(id, name)] = true
+			}
+		}
+	}
+	return keys, nil
+}
@@ -0,0 +1,341 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"log"
+	"slices"
+	"strings"
+	"time"
+
+	gremlingo "github.com/apache/tinkerpop/gremlin-go/v3/driver"
+	"github.com/blubywaff/ftag/internal/error"
+	"github.com/blubywaff/ftag/internal/model"
+)
+
+// Disagreements between the graph and blob storage
+type FsckReport struct {
+	// blob keys with no resource vertex
+	OrphanBlobs []string
+	// resource ids whose blob is gone
+	MissingBlobs []string
+	// of MissingBlobs, those put back from their newest version by the repair
+	Restored []string
+	// resource ids whose upload time cannot be parsed
+	BadUploads []string
+	// resource ids used by more than one vertex
+	DuplicateIds []string
+	// resource vertices with no rsc_id at all
+	Unidentified int
+	// describes edges that do not go from a tag to a resource or collection
+	DanglingEdges int
+	// resource ids the repair could not fix, such as bookmarks with a bad upload time
+	Unrepaired []string
+	// every problem was fixed
+	Repaired bool
+}
+
+func (r FsckReport) Clean() bool {
+	return len(r.OrphanBlobs) == 0 && len(r.MissingBlobs) == 0 && len(r.BadUploads) == 0 &&
+		len(r.DuplicateIds) == 0 && r.Unidentified == 0 && r.DanglingEdges == 0
+}
+
+func parseUpload(str string) (time.Time, error) {
+	var err error
+	for _, tf := range TimeFormatP {
+		var t time.Time
+		t, err = time.Parse(tf, str)
+		if err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, err
+}
+
+// the subset of a resource vertex that fsck looks at
+type fsckRecord struct {
+	id     string
+	upload string
+	// bookmarks and notes have no blob
+	item bool
+}
+
+func (t *Tinkerpop) fsckRecords(ctx context.Context) ([]fsckRecord, int, error) {
+	rs, err := toList(ctx, t.g.V().HasLabel("resource").ElementMap("rsc_id", "upload", "kind"))
+	if err != nil {
+		return nil, 0, err
+	}
+	records := make([]fsckRecord, 0, len(rs))
+	unidentified := 0
+	for _, r := range rs {
+		m, ok := r.GetInterface().(map[interface{}]interface{})
+		if !ok {
+			return nil, 0, errors.New("Invalid type resource map")
+		}
+		id, ok := m["rsc_id"].(string)
+		if !ok {
+			unidentified++
+			continue
+		}
+		upload, _ := m["upload"].(string)
+		_, item := m["kind"]
+		records = append(records, fsckRecord{id, upload, item})
+	}
+	return records, unidentified, nil
+}
+
+func danglingEdges() *GraphTraversal {
+	return __.HasLabel("describes").Where(__.Or(
+		__.OutV().Not(__.HasLabel("tag")),
+		__.OutV().Not(__.Has("name")),
+		__.InV().Not(__.Or(
+			__.HasLabel("resource").Has("rsc_id"),
+			__.HasLabel("collection").Has("col_id"),
+		)),
+	))
+}
+
+// Compares the graph with blob storage.
+// With repair the problems are fixed as follows:
+//   - orphan blobs older than grace are deleted, younger ones may belong to an upload in progress
+//   - resources with missing blobs are restored from their newest version, those without one are removed
+//   - bad upload times are replaced by the blob's modification time
+//   - duplicate resources are merged into one which has all of their tags
+//   - unidentified resources and dangling edges are removed
+func (t *Tinkerpop) Fsck(ctx context.Context, repair bool, grace time.Duration) (FsckReport, error) {
+	var report FsckReport
+
+	// read the graph first: blobs are written before their vertex is committed,
+	// so every vertex seen here already has its blob listed below
+	records, unidentified, err := t.fsckRecords(ctx)
+	if err != nil {
+		return report, err
+	}
+	report.Unidentified = unidentified
+	cnt, err := toList(ctx, t.g.E().Where(danglingEdges()).Count())
+	if err != nil {
+		return report, err
+	}
+	if len(cnt) != 0 {
+		n, _ := cnt[0].GetInt()
+		report.DanglingEdges = n
+	}
+
+	infos, err := t.blobs.List(ctx, "")
+	if err != nil {
+		return report, err
+	}
+	blobs := make(map[string]time.Time)
+	for _, bi := range infos {
+		// everything else is staging or derived data
+		if !strings.Contains(bi.Key, "/") {
+			blobs[bi.Key] = bi.ModTime
+		}
+	}
+
+	seen := make(map[string]int)
+	for _, r := range records {
+		seen[r.id]++
+		if seen[r.id] == 2 {
+			report.DuplicateIds = append(report.DuplicateIds, r.id)
+		}
+		if seen[r.id] > 1 {
+			continue
+		}
+		if _, ok := blobs[r.id]; !ok && !r.item {
+			report.MissingBlobs = append(report.MissingBlobs, r.id)
+		}
+		if _, err := parseUpload(r.upload); err != nil {
+			report.BadUploads = append(report.BadUploads, r.id)
+		}
+	}
+	// ReplaceContent has no blob under the id for a moment, so those missing are looked at again
+	// with no replacement going on, which also keeps replacements away from the repair
+	if len(report.MissingBlobs) != 0 {
+		t.replaceMu.Lock()
+		defer t.replaceMu.Unlock()
+		missing := make([]string, 0, len(report.MissingBlobs))
+		for _, id := range report.MissingBlobs {
+			bi, err := t.blobs.Stat(ctx, id)
+			if err == nil {
+				blobs[id] = bi.ModTime
+				continue
+			}
+			if !errors.Is(err, fs.ErrNotExist) {
+				return report, err
+			}
+			missing = append(missing, id)
+		}
+		report.MissingBlobs = missing
+	}
+	for key := range blobs {
+		if seen[key] == 0 {
+			report.OrphanBlobs = append(report.OrphanBlobs, key)
+		}
+	}
+	slices.Sort(report.OrphanBlobs)
+
+	if !repair || report.Clean() {
+		return report, nil
+	}
+	if err := t.fsckRepair(ctx, &report, blobs, grace); err != nil {
+		return report, err
+	}
+	report.Repaired = len(report.Unrepaired) == 0
+	return report, nil
+}
+
+// Puts back the content of id from its newest version that still has a blob,
+// which is what an interrupted ReplaceContent leaves behind. That version becomes the content again.
+// Returns the version used, or 0 if there is none. The cleanup deletes the content put back.
+func (t *Tinkerpop) restoreFromVersion(ctx context.Context, g *GraphTraversalSource, id string) (int, apperror.IntermediateResult) {
+	rs, err := toList(ctx, g.V().Has("resource", "rsc_id", id).
+		Out("version").Order().By("num", desc).ElementMap(ToInterfaceSlice(append([]string{"num"}, contentKeys...))...))
+	if err != nil {
+		return 0, apperror.IntermediateResultFromError(err)
+	}
+	for _, r := range rs {
+		m, ok := r.GetInterface().(map[interface{}]interface{})
+		if !ok {
+			return 0, apperror.IntermediateResultFromError(errors.New("Invalid type version map"))
+		}
+		n := int(toInt64(m["num"]))
+		copied := t.copyBlob(ctx, VersionKey(id, n), id)
+		if errors.Is(copied.OpError(), fs.ErrNotExist) {
+			continue
+		}
+		if err := copied.OpError(); err != nil {
+			return 0, copied
+		}
+		props := make(map[string]interface{}, len(contentKeys))
+		for _, k := range contentKeys {
+			if v, ok := m[k]; ok {
+				props[k] = v
+			}
+		}
+		err := setContent(ctx, g, id, props)
+		if err == nil {
+			err = iterate(ctx, g.V().Has("resource", "rsc_id", id).Out("version").Has("num", int64(n)).Drop())
+		}
+		if err != nil {
+			copied.Clean()
+			return 0, apperror.IntermediateResultFromError(err)
+		}
+		return n, copied
+	}
+	return 0, apperror.IntermediateResultFromError(nil)
+}
+
+// fills in report.Restored and report.Unrepaired
+func (t *Tinkerpop) fsckRepair(ctx context.Context, report *FsckReport, blobs map[string]time.Time, grace time.Duration) error {
+	tx := t.g.Tx()
+	g, err := tx.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := iterate(ctx, g.E().Where(danglingEdges()).Drop()); err != nil {
+		return err
+	}
+	if err := iterate(ctx, g.V().HasLabel("resource").Not(__.Has("rsc_id")).Drop()); err != nil {
+		return err
+	}
+	for _, id := range report.DuplicateIds {
+		names, err := toList(ctx, g.V().Has("resource", "rsc_id", id).In("describes").Values("name").Dedup())
+		if err != nil {
+			return err
+		}
+		var tags model.TagSet
+		for _, n := range names {
+			tags.Add(n.GetString())
+		}
+		if err := iterate(ctx, g.V().Has("resource", "rsc_id", id).Range(1, -1).Drop()); err != nil {
+			return err
+		}
+		if err := changeTags(ctx, g, tags, model.TagSet{}, id); err != nil {
+			return err
+		}
+	}
+	restored := make([]string, 0)
+	var copies []apperror.IntermediateResult
+	defer func() {
+		for _, c := range copies {
+			c.Clean()
+		}
+	}()
+	// version blobs to delete once their content is back in place
+	var versionKeys []string
+	removed := make(map[string]bool)
+	for _, id := range report.MissingBlobs {
+		n, copied := t.restoreFromVersion(ctx, g, id)
+		if err := copied.OpError(); err != nil {
+			return err
+		}
+		if n != 0 {
+			copies = append(copies, copied)
+			restored = append(restored, id)
+			versionKeys = append(versionKeys, VersionKey(id, n))
+			continue
+		}
+		if err := iterate(ctx, g.V().Has("resource", "rsc_id", id).Out("version", "file").Drop()); err != nil {
+			return err
+		}
+		if err := iterate(ctx, g.V().Has("resource", "rsc_id", id).Drop()); err != nil {
+			return err
+		}
+		removed[id] = true
+	}
+	unrepaired := make([]string, 0)
+	for _, id := range report.BadUploads {
+		if removed[id] {
+			continue
+		}
+		mt, ok := blobs[id]
+		if !ok && slices.Contains(restored, id) {
+			bi, err := t.blobs.Stat(ctx, id)
+			if err != nil {
+				return err
+			}
+			mt, ok = bi.ModTime, true
+		}
+		if !ok {
+			// a bookmark or note, nothing tells when it was added
+			unrepaired = append(unrepaired, id)
+			continue
+		}
+		err := iterate(ctx, g.V().Has("resource", "rsc_id", id).
+			Property(gremlingo.Cardinality.Single, "upload", mt.UTC().Format(TimeFormat)))
+		if err != nil {
+			return err
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	for i := range copies {
+		copies[i].Commit()
+	}
+	report.Restored = restored
+	report.Unrepaired = unrepaired
+	for _, key := range versionKeys {
+		if err := t.blobs.Delete(ctx, key); err != nil {
+			log.Println("could not delete restored version: " + key)
+		}
+	}
+
+	cutoff := time.Now().Add(-grace)
+	for _, key := range report.OrphanBlobs {
+		if blobs[key].After(cutoff) {
+			continue
+		}
+		if err := t.blobs.Delete(ctx, key); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			log.Println("could not delete orphan blob: " + key)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/blubywaff/ftag/internal/derive"
+)
+
+type GCOptions struct {
+	// only report what would be deleted
+	DryRun bool
+	// unreferenced blobs younger than this may belong to an upload in progress
+	Grace time.Duration
+	// staged uploads and archives untouched for this long are abandoned
+	StagingGrace time.Duration
+}
+
+type GCItem struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+}
+
+type GCReport struct {
+	DryRun bool
+	// blobs that were, or with DryRun would be, deleted
+	Collected []GCItem
+	// referenced by nothing but still within the grace period
+	Young          int
+	ReclaimedBytes int64
+}
+
+// Deletes blobs that no resource refers to, including variants and versions of removed resources
+// and named files that were removed.
+// Blobs under meta/ are never collected.
+func (t *Tinkerpop) GC(ctx context.Context, opts GCOptions) (GCReport, error) {
+	report := GCReport{DryRun: opts.DryRun, Collected: make([]GCItem, 0)}
+
+	// graph first, for the same reason as in Fsck
+	records, _, err := t.fsckRecords(ctx)
+	if err != nil {
+		return report, err
+	}
+	referenced := make(map[string]bool, len(records))
+	for _, r := range records {
+		referenced[r.id] = true
+	}
+	files, err := t.fileKeys(ctx)
+	if err != nil {
+		return report, err
+	}
+
+	infos, err := t.blobs.List(ctx, "")
+	if err != nil {
+		return report, err
+	}
+	// a staged upload is its data plus "<id>.json", and is as fresh as the newer of the two
+	staged := make(map[string]time.Time)
+	for _, bi := range infos {
+		if stem, ok := stagingStem(bi.Key); ok && bi.ModTime.After(staged[stem]) {
+			staged[stem] = bi.ModTime
+		}
+	}
+	now := time.Now()
+	for _, bi := range infos {
+		grace := opts.Grace
+		modTime := bi.ModTime
+		stem, isStaged := stagingStem(bi.Key)
+		owner, hasOwner := derive.ResourceId(bi.Key)
+		if !hasOwner {
+			owner, hasOwner = versionOwner(bi.Key)
+		}
+		_, isFile := fileOwner(bi.Key)
+		switch {
+		case isStaged:
+			grace = opts.StagingGrace
+			modTime = staged[stem]
+		case isFile:
+			if files[bi.Key] {
+				continue
+			}
+		case hasOwner:
+			if referenced[owner] {
+				continue
+			}
+		case strings.Contains(bi.Key, "/"):
+			continue
+		case referenced[bi.Key]:
+			continue
+		}
+		if modTime.After(now.Add(-grace)) {
+			report.Young++
+			continue
+		}
+		if !opts.DryRun {
+			err := t.blobs.Delete(ctx, bi.Key)
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+			if err != nil {
+				log.Println("could not collect blob: " + bi.Key)
+				continue
+			}
+		}
+		report.Collected = append(report.Collected, GCItem{Key: bi.Key, Size: bi.Size, ModTime: bi.ModTime})
+		report.ReclaimedBytes += bi.Size
+	}
+	return report, nil
+}
+
+func stagingStem(key string) (string, bool) {
+	rest, ok := strings.CutPrefix(key, "staging/")
+	if !ok {
+		return "", false
+	}
+	stem, _, _ := strings.Cut(rest, ".")
+	return stem, true
+}
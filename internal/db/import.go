@@ -0,0 +1,138 @@
+package db
+
+import (
+	"context"
+	"maps"
+
+	"github.com/blubywaff/ftag/internal/error"
+	"github.com/blubywaff/ftag/internal/model"
+)
+
+// A resource brought over from elsewhere, keeping its id and upload time.
+// The blob must already be stored under the resource id, unless it is a bookmark or note,
+// and those of its named files under FileKey.
+type Imported struct {
+	Resource model.Resource
+	// sha256 of the blob
+	Hash string
+}
+
+// Adds the resources in one transaction, creating any tags they need.
+// Their custom properties must already be defined, see DefineProperty.
+// Resources whose id is already present are skipped so that an interrupted import can be rerun.
+// Returns how many resources were added.
+func (t *Tinkerpop) ImportResources(ctx context.Context, rs []Imported) (int, error) {
+	tx := t.g.Tx()
+	g, err := tx.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var names model.TagSet
+	ids := make([]string, len(rs))
+	for i, r := range rs {
+		names.Union(r.Resource.Tags)
+		ids[i] = r.Resource.Id
+	}
+
+	if err := ensureTags(ctx, g, names); err != nil {
+		return 0, err
+	}
+	defs, err := propertyDefs(ctx, g)
+	if err != nil {
+		return 0, err
+	}
+
+	found, err := toList(ctx, g.V().HasLabel("resource").
+		Where(__.Values("rsc_id").Is(within(ToInterfaceSlice(ids)...))).
+		Values("rsc_id"))
+	if err != nil {
+		return 0, err
+	}
+	present := make(map[string]bool, len(found))
+	for _, f := range found {
+		present[f.GetString()] = true
+	}
+
+	added := 0
+	for _, r := range rs {
+		if present[r.Resource.Id] {
+			continue
+		}
+		props := map[string]interface{}{
+			"rsc_id":  r.Resource.Id,
+			"mime":    r.Resource.Mimetype,
+			"upload":  r.Resource.CreatedAt.UTC().Format(TimeFormat),
+			"sha256":  r.Hash,
+			"source":  r.Resource.Source,
+			"privacy": r.Resource.Privacy,
+		}
+		if r.Resource.Kind != "" && r.Resource.Kind != model.KindFile {
+			item := Item{Kind: r.Resource.Kind, Url: r.Resource.Url, Title: r.Resource.Title, Text: r.Resource.Text}
+			if !item.valid() {
+				return 0, INVALID_ITEM
+			}
+			maps.Copy(props, item.props())
+		}
+		// the properties must be defined already
+		for k, v := range r.Resource.Props {
+			typ, ok := defs[k]
+			if !ok {
+				return 0, apperror.ErrorWithContext{Original: UNKNOWN_PROPERTY, Message: k}
+			}
+			props[propPrefix+k], ok = propValue(typ, v)
+			if !ok {
+				return 0, apperror.ErrorWithContext{Original: INVALID_PROPERTY_VALUE, Message: k}
+			}
+		}
+		err := insertResource(ctx, g, props, r.Resource.Tags)
+		if err != nil {
+			return 0, err
+		}
+		names := make(map[string]bool, len(r.Resource.Files))
+		for _, f := range r.Resource.Files {
+			if !ValidFileName(f.Name) {
+				return 0, INVALID_FILE_NAME
+			}
+			if names[f.Name] {
+				return 0, FILE_EXISTS
+			}
+			names[f.Name] = true
+			if err := insertFile(ctx, g, r.Resource.Id, f); err != nil {
+				return 0, err
+			}
+		}
+		// guards against the same id twice in one batch
+		present[r.Resource.Id] = true
+		added++
+	}
+
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return added, nil
+}
+
+// creates the tag vertices that do not exist yet
+func ensureTags(ctx context.Context, g *GraphTraversalSource, names model.TagSet) error {
+	found, err := toList(ctx, g.V().HasLabel("tag").
+		Where(__.Values("name").Is(within(ToInterfaceSlice(names.Inner)...))).
+		Values("name"))
+	if err != nil {
+		return err
+	}
+	var existing model.TagSet
+	for _, f := range found {
+		existing.Add(f.GetString())
+	}
+	missing := names.Duplicate().Difference(existing)
+	if missing.Len() == 0 {
+		return nil
+	}
+	return iterate(ctx, g.Inject(ToInterfaceSlice(missing.Inner)...).As("n").
+		AddV("tag").Property("name", __.Select("n")))
+}
@@ -0,0 +1,146 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"time"
+	"unicode/utf8"
+
+	gremlingo "github.com/apache/tinkerpop/gremlin-go/v3/driver"
+	"github.com/blubywaff/ftag/internal/model"
+)
+
+var INVALID_ITEM = errors.New("invalid bookmark or note")
+var WRONG_KIND = errors.New("resource is of another kind")
+
+// limits on the text of bookmarks and notes, in bytes
+const (
+	maxTitle = 1 << 10
+	maxUrl   = 1 << 13
+	MaxText  = 1 << 20
+)
+
+// mimetypes their content is served as, see model.Resource.Kind
+var itemMimetypes = map[string]string{
+	model.KindBookmark: "text/uri-list",
+	model.KindNote:     "text/markdown",
+}
+
+// A resource without a blob, a bookmark or a note
+type Item struct {
+	Kind string
+	// for bookmarks, http or https
+	Url   string
+	Title string
+	// markdown, for notes
+	Text string
+}
+
+func (i Item) valid() bool {
+	if !utf8.ValidString(i.Title) || len(i.Title) > maxTitle {
+		return false
+	}
+	switch i.Kind {
+	case model.KindBookmark:
+		u, err := url.Parse(i.Url)
+		return err == nil && len(i.Url) <= maxUrl && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "" && i.Text == ""
+	case model.KindNote:
+		return utf8.ValidString(i.Text) && len(i.Text) <= MaxText && (i.Text != "" || i.Title != "") && i.Url == ""
+	}
+	return false
+}
+
+// Files have no kind property, as those from before there were other kinds,
+// so that only items need to be told apart
+func (i Item) props() map[string]interface{} {
+	return map[string]interface{}{
+		"kind":  i.Kind,
+		"mime":  itemMimetypes[i.Kind],
+		"url":   i.Url,
+		"title": i.Title,
+		"text":  i.Text,
+		"size":  int64(len(i.Text)),
+	}
+}
+
+// Adds a bookmark or note, tagged like a file would be.
+// Adding a bookmark for a url that is already bookmarked adds the tags to that one instead.
+func (t *Tinkerpop) AddItem(ctx context.Context, item Item, tags model.TagSet) (AddResult, error) {
+	if !item.valid() {
+		return AddResult{}, INVALID_ITEM
+	}
+	tx := t.g.Tx()
+	g, err := tx.Begin()
+	if err != nil {
+		return AddResult{}, err
+	}
+	defer tx.Rollback()
+
+	id := ""
+	duplicate := false
+	if item.Kind == model.KindBookmark {
+		existing, err := toList(ctx, g.V().Has("resource", "url", item.Url).Values("rsc_id").Limit(1))
+		if err != nil {
+			return AddResult{}, err
+		}
+		if len(existing) != 0 {
+			id = existing[0].GetString()
+			duplicate = true
+		}
+	}
+	if duplicate {
+		err = changeTags(ctx, g, tags, model.TagSet{}, id)
+	} else {
+		id, err = GenUUID()
+		if err != nil {
+			return AddResult{}, err
+		}
+		props := item.props()
+		props["rsc_id"] = id
+		props["upload"] = time.Now().UTC().Format(TimeFormat)
+		err = insertResource(ctx, g, props, tags)
+	}
+	if err != nil {
+		return AddResult{}, err
+	}
+	if err := ctx.Err(); err != nil {
+		return AddResult{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return AddResult{}, err
+	}
+	rsc, err := t.GetFile(ctx, id)
+	if err != nil {
+		return AddResult{}, err
+	}
+	return AddResult{Resource: rsc, Duplicate: duplicate}, nil
+}
+
+// Replaces the url, title and text of a bookmark or note, its kind cannot change.
+// Returns WRONG_KIND if id is not of item.Kind.
+func (t *Tinkerpop) EditItem(ctx context.Context, id string, item Item) (model.Resource, error) {
+	if !item.valid() {
+		return model.Resource{}, INVALID_ITEM
+	}
+	rsc, err := t.GetFile(ctx, id)
+	if err != nil {
+		return model.Resource{}, err
+	}
+	if rsc.Kind != item.Kind {
+		return model.Resource{}, WRONG_KIND
+	}
+	tr := t.g.V().Has("resource", "rsc_id", id)
+	props := item.props()
+	for _, k := range []string{"url", "title", "text", "size"} {
+		if v := props[k]; v == "" || v == int64(0) {
+			tr = tr.SideEffect(__.Properties(k).Drop())
+		} else {
+			tr = tr.Property(gremlingo.Cardinality.Single, k, v)
+		}
+	}
+	if err := iterate(ctx, tr); err != nil {
+		return model.Resource{}, err
+	}
+	return t.GetFile(ctx, id)
+}
@@ -0,0 +1,83 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"io"
+
+	gremlingo "github.com/apache/tinkerpop/gremlin-go/v3/driver"
+	"github.com/blubywaff/ftag/internal/config"
+	"github.com/blubywaff/ftag/internal/error"
+	"github.com/blubywaff/ftag/internal/exif"
+	"github.com/blubywaff/ftag/internal/model"
+)
+
+var INVALID_PRIVACY = errors.New("invalid privacy setting")
+var STRIP_FAILED = errors.New("embedded metadata could not be removed")
+
+// Whether a file added with the per-resource setting privacy is stored stripped
+func stripAtIngest(privacy string) bool {
+	return privacy == model.PrivacyStrip ||
+		privacy != model.PrivacyKeep && config.Global.Privacy.Mode == config.PrivacyIngest
+}
+
+// Whether the stored content of rsc has to be stripped before it is served
+func StripWhenServed(rsc model.Resource) bool {
+	if !exif.Supported(rsc.Mimetype) {
+		return false
+	}
+	return rsc.Privacy == model.PrivacyStrip ||
+		rsc.Privacy != model.PrivacyKeep && config.Global.Privacy.Mode == config.PrivacyServe
+}
+
+// The content of r with the location and device data removed, read from r as it goes.
+// Fails with STRIP_FAILED if the metadata is malformed, since then it may not all be found.
+func Stripped(r io.ReaderAt, size int64, mimetype string) (*io.SectionReader, error) {
+	patches, err := exif.Strip(r, size, mimetype)
+	if err != nil {
+		return nil, apperror.ErrorWithContext{Original: STRIP_FAILED, Message: err.Error()}
+	}
+	return exif.Patched(r, size, patches), nil
+}
+
+// Stores r under id with the location and device data removed, writing the stored bytes to hash.
+// The original is staged first since the metadata has to be found before anything is written.
+func (t *Tinkerpop) putStripped(ctx context.Context, id string, mimetype string, r io.Reader, hash io.Writer) (int64, error) {
+	staged := "staging/" + id + ".strip"
+	size, err := t.blobs.Put(ctx, staged, r)
+	if err != nil {
+		return 0, err
+	}
+	// a copy left behind is collected by GC
+	defer t.blobs.Delete(context.Background(), staged)
+	f, err := t.blobs.Open(ctx, staged)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	clean, err := Stripped(f, size, mimetype)
+	if err != nil {
+		return 0, err
+	}
+	return t.blobs.Put(ctx, id, io.TeeReader(clean, hash))
+}
+
+// Sets the per-resource override of config.Config_Privacy, "" removes it.
+// Content already stripped at ingest is not restored.
+func (t *Tinkerpop) SetPrivacy(ctx context.Context, id string, privacy string) error {
+	if !model.ValidPrivacy(privacy) {
+		return INVALID_PRIVACY
+	}
+	found, err := toList(ctx, t.g.V().Has("resource", "rsc_id", id).Limit(1))
+	if err != nil {
+		return err
+	}
+	if len(found) == 0 {
+		return NO_RESULT
+	}
+	tr := t.g.V().Has("resource", "rsc_id", id)
+	if privacy == "" {
+		return iterate(ctx, tr.Properties("privacy").Drop())
+	}
+	return iterate(ctx, tr.Property(gremlingo.Cardinality.Single, "privacy", privacy))
+}
@@ -0,0 +1,283 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	gremlingo "github.com/apache/tinkerpop/gremlin-go/v3/driver"
+	"github.com/blubywaff/ftag/internal/error"
+	"github.com/blubywaff/ftag/internal/model"
+)
+
+var UNKNOWN_PROPERTY = errors.New("property is not defined")
+var INVALID_PROPERTY = errors.New("invalid property definition")
+var INVALID_PROPERTY_VALUE = errors.New("value does not have the type of the property")
+var PROPERTY_EXISTS = errors.New("property already defined with another type")
+
+// custom properties are stored on the resource vertex under this prefix and their key,
+// so that they cannot clash with the built in ones
+const propPrefix = "prop_"
+
+// longest value of a string property, in bytes
+const maxPropString = 1 << 12
+
+// definitions are "propdef" vertices, by key
+func propertyDefs(ctx context.Context, g *GraphTraversalSource) (map[string]string, error) {
+	rs, err := toList(ctx, g.V().HasLabel("propdef").ElementMap("key", "type"))
+	if err != nil {
+		return nil, err
+	}
+	defs := make(map[string]string, len(rs))
+	for _, r := range rs {
+		m, ok := r.GetInterface().(map[interface{}]interface{})
+		if !ok {
+			return nil, errors.New("Invalid type propdef map")
+		}
+		key, _ := m["key"].(string)
+		typ, _ := m["type"].(string)
+		defs[key] = typ
+	}
+	return defs, nil
+}
+
+// Every defined property, by key
+func (t *Tinkerpop) PropertyDefs(ctx context.Context) ([]model.PropertyDef, error) {
+	defs, err := propertyDefs(ctx, t.g)
+	if err != nil {
+		return nil, err
+	}
+	list := make([]model.PropertyDef, 0, len(defs))
+	for k, typ := range defs {
+		list = append(list, model.PropertyDef{Key: k, Type: typ})
+	}
+	slices.SortFunc(list, func(a, b model.PropertyDef) int {
+		return strings.Compare(a.Key, b.Key)
+	})
+	return list, nil
+}
+
+// Allows resources to have the property, defining it again with the same type does nothing.
+// The type of a property cannot change, remove it first.
+func (t *Tinkerpop) DefineProperty(ctx context.Context, def model.PropertyDef) error {
+	if !model.ValidPropKey(def.Key) || !model.ValidPropType(def.Type) {
+		return INVALID_PROPERTY
+	}
+	tx := t.g.Tx()
+	g, err := tx.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	defs, err := propertyDefs(ctx, g)
+	if err != nil {
+		return err
+	}
+	if typ, ok := defs[def.Key]; ok {
+		if typ != def.Type {
+			return PROPERTY_EXISTS
+		}
+		return nil
+	}
+	if err := iterate(ctx, g.AddV("propdef").Property("key", def.Key).Property("type", def.Type)); err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Removes the definition and the values every resource has for it
+func (t *Tinkerpop) RemoveProperty(ctx context.Context, key string) error {
+	tx := t.g.Tx()
+	g, err := tx.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	defs, err := propertyDefs(ctx, g)
+	if err != nil {
+		return err
+	}
+	if _, ok := defs[key]; !ok {
+		return NO_RESULT
+	}
+	if err := iterate(ctx, g.V().HasLabel("resource").Properties(propPrefix+key).Drop()); err != nil {
+		return err
+	}
+	if err := iterate(ctx, g.V().Has("propdef", "key", key).Drop()); err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// dates may be given without a time
+func parsePropDate(str string) (string, bool) {
+	for _, tf := range slices.Concat(TimeFormatP, []string{time.DateOnly}) {
+		if d, err := time.Parse(tf, str); err == nil {
+			return d.UTC().Format(TimeFormat), true
+		}
+	}
+	return "", false
+}
+
+// converts v as decoded from json to how a property of type typ is stored
+func propValue(typ string, v interface{}) (interface{}, bool) {
+	switch typ {
+	case model.PropString:
+		s, ok := v.(string)
+		return s, ok && s != "" && len(s) <= maxPropString && utf8.ValidString(s)
+	case model.PropNumber:
+		n, ok := v.(float64)
+		return n, ok && !math.IsNaN(n) && !math.IsInf(n, 0)
+	case model.PropDate:
+		s, ok := v.(string)
+		if !ok {
+			return nil, false
+		}
+		return parsePropDate(s)
+	case model.PropBoolean:
+		b, ok := v.(bool)
+		return b, ok
+	}
+	return nil, false
+}
+
+// like propValue, for the text of a query condition
+func propQueryValue(typ string, str string) (interface{}, bool) {
+	switch typ {
+	case model.PropNumber:
+		n, err := strconv.ParseFloat(str, 64)
+		if err != nil {
+			return nil, false
+		}
+		return propValue(typ, n)
+	case model.PropBoolean:
+		b, err := strconv.ParseBool(str)
+		return b, err == nil
+	}
+	return propValue(typ, str)
+}
+
+// Sets and removes custom properties of id, see PropertyDefs.
+// Values are as decoded from json, dates are strings in RFC 3339 or just the date.
+func (t *Tinkerpop) ChangeProps(ctx context.Context, id string, set map[string]interface{}, unset []string) error {
+	tx := t.g.Tx()
+	g, err := tx.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	found, err := toList(ctx, g.V().Has("resource", "rsc_id", id).Limit(1))
+	if err != nil {
+		return err
+	}
+	if len(found) == 0 {
+		return NO_RESULT
+	}
+	defs, err := propertyDefs(ctx, g)
+	if err != nil {
+		return err
+	}
+
+	tr := g.V().Has("resource", "rsc_id", id)
+	for _, k := range unset {
+		if _, ok := defs[k]; !ok {
+			return apperror.ErrorWithContext{Original: UNKNOWN_PROPERTY, Message: k}
+		}
+		tr = tr.SideEffect(__.Properties(propPrefix + k).Drop())
+	}
+	keys := make([]string, 0, len(set))
+	for k := range set {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	for _, k := range keys {
+		typ, ok := defs[k]
+		if !ok {
+			return apperror.ErrorWithContext{Original: UNKNOWN_PROPERTY, Message: k}
+		}
+		v, ok := propValue(typ, set[k])
+		if !ok {
+			return apperror.ErrorWithContext{Original: INVALID_PROPERTY_VALUE, Message: k}
+		}
+		tr = tr.Property(gremlingo.Cardinality.Single, propPrefix+k, v)
+	}
+	if err := iterate(ctx, tr); err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// the custom properties in a resource map, nil if there are none
+func toProps(v map[interface{}]interface{}) map[string]interface{} {
+	var props map[string]interface{}
+	for k, val := range v {
+		ks, ok := k.(string)
+		if !ok {
+			continue
+		}
+		key, ok := strings.CutPrefix(ks, propPrefix)
+		if !ok {
+			continue
+		}
+		if props == nil {
+			props = make(map[string]interface{})
+		}
+		props[key] = val
+	}
+	return props
+}
+
+// narrows tr to the resources meeting every condition
+func (t *Tinkerpop) propFilters(ctx context.Context, tr *GraphTraversal, conds []model.PropCondition) (*GraphTraversal, error) {
+	if len(conds) == 0 {
+		return tr, nil
+	}
+	defs, err := propertyDefs(ctx, t.g)
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range conds {
+		typ, ok := defs[c.Key]
+		if !ok {
+			return nil, apperror.ErrorWithContext{Original: UNKNOWN_PROPERTY, Message: c.Key}
+		}
+		v, ok := propQueryValue(typ, c.Value)
+		if !ok {
+			return nil, apperror.ErrorWithContext{Original: INVALID_PROPERTY_VALUE, Message: c.Key}
+		}
+		ordered := typ != model.PropBoolean
+		var p interface{}
+		switch {
+		case c.Op == "=":
+			p = eq(v)
+		case c.Op == "!=":
+			p = neq(v)
+		case c.Op == ">" && ordered:
+			p = gt(v)
+		case c.Op == ">=" && ordered:
+			p = gte(v)
+		case c.Op == "<" && ordered:
+			p = lt(v)
+		case c.Op == "<=" && ordered:
+			p = lte(v)
+		default:
+			return nil, apperror.ErrorWithContext{Original: INVALID_PROPERTY_VALUE, Message: c.Key + " cannot be compared with " + c.Op}
+		}
+		tr = tr.Has(propPrefix+c.Key, p)
+	}
+	return tr, nil
+}
@@ -0,0 +1,76 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+
+	gremlingo "github.com/apache/tinkerpop/gremlin-go/v3/driver"
+)
+
+type MimeChange struct {
+	Id  string
+	Old string
+	New string
+}
+
+type RedetectReport struct {
+	DryRun  bool
+	Checked int
+	// resources whose stored mimetype differs from the detected one
+	Changed []MimeChange
+	// resources with no blob at all, see Fsck
+	Missing []string
+}
+
+// Detects the mimetype of every file again, see probe.Detect.
+// Unless dryRun the new mimetypes are recorded, along with any dimensions
+// and duration that could not be read under the old one.
+func (t *Tinkerpop) Redetect(ctx context.Context, dryRun bool) (RedetectReport, error) {
+	report := RedetectReport{DryRun: dryRun, Changed: make([]MimeChange, 0)}
+	rs, err := toList(ctx, t.g.V().HasLabel("resource").Not(__.Has("kind")).ElementMap("rsc_id", "mime", "filename"))
+	if err != nil {
+		return report, err
+	}
+	for _, r := range rs {
+		m, ok := r.GetInterface().(map[interface{}]interface{})
+		if !ok {
+			return report, errors.New("Invalid type resource map")
+		}
+		id, ok := m["rsc_id"].(string)
+		if !ok {
+			// reported by fsck
+			continue
+		}
+		old, _ := m["mime"].(string)
+		filename, _ := m["filename"].(string)
+		bi, err := t.blobs.Stat(ctx, id)
+		if errors.Is(err, fs.ErrNotExist) {
+			report.Missing = append(report.Missing, id)
+			continue
+		}
+		if err != nil {
+			return report, err
+		}
+		detected, err := t.detectBlob(ctx, id, bi.Size, filename)
+		if err != nil {
+			return report, err
+		}
+		report.Checked++
+		if detected == old {
+			continue
+		}
+		report.Changed = append(report.Changed, MimeChange{id, old, detected})
+		if dryRun {
+			continue
+		}
+		err = iterate(ctx, t.g.V().Has("resource", "rsc_id", id).Property(gremlingo.Cardinality.Single, "mime", detected))
+		if err != nil {
+			return report, err
+		}
+		if err := t.backfillMeta(ctx, id, detected, bi.Size); err != nil {
+			return report, err
+		}
+	}
+	return report, nil
+}
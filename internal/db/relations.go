@@ -0,0 +1,201 @@
+package db
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"slices"
+	"strings"
+
+	"github.com/blubywaff/ftag/internal/model"
+)
+
+var INVALID_RELATION = errors.New("invalid relation")
+var RELATION_CONFLICT = errors.New("relation conflicts with an existing one")
+
+// Relations are edges from From to To labelled with their type.
+// None of them may form a cycle, a resource has at most one parent,
+// and a sequence has at most one next and one previous resource at each point.
+func (t *Tinkerpop) Relate(ctx context.Context, rel model.Relation) error {
+	if !model.ValidRelation(rel.Type) || rel.From == rel.To {
+		return INVALID_RELATION
+	}
+	tx := t.g.Tx()
+	g, err := tx.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	found, err := toList(ctx, g.V().HasLabel("resource").
+		Where(__.Values("rsc_id").Is(within(rel.From, rel.To))).Values("rsc_id").Dedup().Count())
+	if err != nil {
+		return err
+	}
+	if n, _ := found[0].GetInt(); n != 2 {
+		return NO_RESULT
+	}
+	exists, err := toList(ctx, g.V().Has("resource", "rsc_id", rel.From).
+		Out(rel.Type).Has("rsc_id", rel.To).Limit(1))
+	if err != nil {
+		return err
+	}
+	if len(exists) != 0 {
+		return nil
+	}
+
+	conflicts := []*GraphTraversal{
+		// To already leads back to From
+		g.V().Has("resource", "rsc_id", rel.To).
+			Repeat(__.Out(rel.Type).SimplePath()).Emit().Has("rsc_id", rel.From),
+	}
+	switch rel.Type {
+	case model.RelParentOf:
+		conflicts = append(conflicts, g.V().Has("resource", "rsc_id", rel.To).In(rel.Type))
+	case model.RelNextInSequence:
+		conflicts = append(conflicts,
+			g.V().Has("resource", "rsc_id", rel.To).In(rel.Type),
+			g.V().Has("resource", "rsc_id", rel.From).Out(rel.Type))
+	}
+	for _, c := range conflicts {
+		rs, err := toList(ctx, c.Limit(1))
+		if err != nil {
+			return err
+		}
+		if len(rs) != 0 {
+			return RELATION_CONFLICT
+		}
+	}
+
+	err = iterate(ctx, g.V().Has("resource", "rsc_id", rel.To).As("to").
+		V().Has("resource", "rsc_id", rel.From).
+		AddE(rel.Type).To(__.Select("to")))
+	if err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Removes the relation, NO_RESULT if there is none
+func (t *Tinkerpop) Unrelate(ctx context.Context, rel model.Relation) error {
+	if !model.ValidRelation(rel.Type) {
+		return INVALID_RELATION
+	}
+	tr := t.g.V().Has("resource", "rsc_id", rel.From).
+		OutE(rel.Type).Where(__.InV().Has("rsc_id", rel.To))
+	found, err := toList(ctx, tr.Clone().Limit(1))
+	if err != nil {
+		return err
+	}
+	if len(found) == 0 {
+		return NO_RESULT
+	}
+	return iterate(ctx, tr.Drop())
+}
+
+// The resources related to id in either direction, by type and then by id
+func (t *Tinkerpop) Neighborhood(ctx context.Context, id string) ([]model.Neighbor, error) {
+	if _, err := t.GetFile(ctx, id); err != nil {
+		return nil, err
+	}
+	rs, err := toList(ctx, t.g.V().Has("resource", "rsc_id", id).
+		BothE(ToInterfaceSlice(model.Relations)...).
+		Project("type", "from", "to").
+		By(__.Label()).
+		By(__.OutV().Values("rsc_id")).
+		By(__.InV().Values("rsc_id")))
+	if err != nil {
+		return nil, err
+	}
+	rels := make([]model.Relation, 0, len(rs))
+	others := make([]string, 0, len(rs))
+	for _, r := range rs {
+		m, ok := r.GetInterface().(map[interface{}]interface{})
+		if !ok {
+			return nil, errors.New("Invalid type relation map")
+		}
+		var rel model.Relation
+		rel.Type, _ = m["type"].(string)
+		rel.From, _ = m["from"].(string)
+		rel.To, _ = m["to"].(string)
+		rels = append(rels, rel)
+		if rel.From == id {
+			others = append(others, rel.To)
+		} else {
+			others = append(others, rel.From)
+		}
+	}
+	resources, err := getFiles(ctx, t.g, others)
+	if err != nil {
+		return nil, err
+	}
+	byId := make(map[string]model.Resource, len(resources))
+	for _, r := range resources {
+		byId[r.Id] = r
+	}
+	neighbors := make([]model.Neighbor, 0, len(rels))
+	for i, rel := range rels {
+		neighbors = append(neighbors, model.Neighbor{Relation: rel, Resource: byId[others[i]]})
+	}
+	slices.SortFunc(neighbors, func(a, b model.Neighbor) int {
+		return cmp.Or(
+			strings.Compare(a.Relation.Type, b.Relation.Type),
+			strings.Compare(a.Resource.Id, b.Resource.Id),
+		)
+	})
+	return neighbors, nil
+}
+
+// The relations starting at any of ids, by from, type and to
+func (t *Tinkerpop) RelationsFrom(ctx context.Context, ids []string) ([]model.Relation, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	rs, err := toList(ctx, t.g.V().HasLabel("resource").
+		Where(__.Values("rsc_id").Is(within(ToInterfaceSlice(ids)...))).
+		OutE(ToInterfaceSlice(model.Relations)...).
+		Project("type", "from", "to").
+		By(__.Label()).
+		By(__.OutV().Values("rsc_id")).
+		By(__.InV().Values("rsc_id")))
+	if err != nil {
+		return nil, err
+	}
+	rels := make([]model.Relation, 0, len(rs))
+	for _, r := range rs {
+		m, ok := r.GetInterface().(map[interface{}]interface{})
+		if !ok {
+			return nil, errors.New("Invalid type relation map")
+		}
+		var rel model.Relation
+		rel.Type, _ = m["type"].(string)
+		rel.From, _ = m["from"].(string)
+		rel.To, _ = m["to"].(string)
+		rels = append(rels, rel)
+	}
+	slices.SortFunc(rels, func(a, b model.Relation) int {
+		return cmp.Or(
+			strings.Compare(a.From, b.From),
+			strings.Compare(a.Type, b.Type),
+			strings.Compare(a.To, b.To),
+		)
+	})
+	return rels, nil
+}
+
+// narrows tr to the relation filters of the query
+func relationFilters(tr *GraphTraversal, query model.Query) *GraphTraversal {
+	if query.TopLevel {
+		tr = tr.Not(__.In(model.RelParentOf))
+	}
+	if query.ChildOf != "" {
+		tr = tr.Where(__.In(model.RelParentOf).Has("rsc_id", query.ChildOf))
+	}
+	if query.NoDuplicates {
+		tr = tr.Not(__.Out(model.RelDuplicateOf))
+	}
+	return tr
+}
@@ -0,0 +1,178 @@
+package db
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/fs"
+	"time"
+
+	gremlingo "github.com/apache/tinkerpop/gremlin-go/v3/driver"
+	"github.com/blubywaff/ftag/internal/model"
+)
+
+type ScrubFailure struct {
+	Id       string
+	Expected string
+	Actual   string
+	Size     int64
+}
+
+type ScrubReport struct {
+	Started  time.Time
+	Finished time.Time
+	Checked  int
+	// blobs whose content no longer matches the recorded hash
+	Corrupt []ScrubFailure
+	// resources with no blob at all, see Fsck
+	Missing []string
+	// resources that had no hash or technical metadata yet, which has now been recorded
+	Backfilled int
+}
+
+func (t *Tinkerpop) hashBlob(ctx context.Context, key string) (string, int64, error) {
+	f, err := t.blobs.Open(ctx, key)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(h.Sum(nil)), n, nil
+}
+
+// Rereads every blob and compares it with the hash recorded on its resource.
+// Resources without a hash or technical metadata get them recorded.
+// If tag is not empty it is added to every corrupt resource, creating the tag if needed.
+func (t *Tinkerpop) Scrub(ctx context.Context, tag string) (ScrubReport, error) {
+	report := ScrubReport{Started: time.Now().UTC()}
+	rs, err := toList(ctx, t.g.V().HasLabel("resource").Not(__.Has("kind")).ElementMap("rsc_id", "sha256", "mime", "size"))
+	if err != nil {
+		return report, err
+	}
+	for _, r := range rs {
+		m, ok := r.GetInterface().(map[interface{}]interface{})
+		if !ok {
+			return report, errors.New("Invalid type resource map")
+		}
+		id, ok := m["rsc_id"].(string)
+		if !ok {
+			// reported by fsck
+			continue
+		}
+		expected, _ := m["sha256"].(string)
+		actual, size, err := t.hashBlob(ctx, id)
+		if expected != "" && (err == nil && actual != expected || errors.Is(err, fs.ErrNotExist)) {
+			// the content may have been replaced while it was read
+			expected, actual, size, err = t.rehash(ctx, id)
+			if errors.Is(err, NO_RESULT) {
+				continue
+			}
+		}
+		if errors.Is(err, fs.ErrNotExist) {
+			report.Missing = append(report.Missing, id)
+			continue
+		}
+		if err != nil {
+			return report, err
+		}
+		report.Checked++
+		if _, ok := m["size"]; !ok {
+			mimetype, _ := m["mime"].(string)
+			if err := t.backfillMeta(ctx, id, mimetype, size); err != nil {
+				return report, err
+			}
+			if expected != "" {
+				report.Backfilled++
+			}
+		}
+		if expected == "" {
+			// unless a replacement has recorded one meanwhile
+			err := iterate(ctx, t.g.V().Has("resource", "rsc_id", id).Not(__.Has("sha256")).
+				Property(gremlingo.Cardinality.Single, "sha256", actual))
+			if err != nil {
+				return report, err
+			}
+			report.Backfilled++
+			continue
+		}
+		if actual != expected {
+			report.Corrupt = append(report.Corrupt, ScrubFailure{Id: id, Expected: expected, Actual: actual, Size: size})
+		}
+	}
+
+	if tag != "" && len(report.Corrupt) != 0 {
+		if err := t.tagAll(ctx, tag, report.Corrupt); err != nil {
+			return report, err
+		}
+	}
+	report.Finished = time.Now().UTC()
+	return report, nil
+}
+
+// Hashes the blob of id again together with the hash recorded for it, with no replacement in between
+func (t *Tinkerpop) rehash(ctx context.Context, id string) (string, string, int64, error) {
+	t.replaceMu.Lock()
+	defer t.replaceMu.Unlock()
+	rs, err := toList(ctx, t.g.V().Has("resource", "rsc_id", id).Values("sha256"))
+	if err != nil {
+		return "", "", 0, err
+	}
+	if len(rs) == 0 {
+		// removed meanwhile
+		return "", "", 0, NO_RESULT
+	}
+	expected, ok := rs[0].GetInterface().(string)
+	if !ok {
+		return "", "", 0, errors.New("Invalid type sha256")
+	}
+	actual, size, err := t.hashBlob(ctx, id)
+	return expected, actual, size, err
+}
+
+// records the technical metadata of resources stored before it was collected
+func (t *Tinkerpop) backfillMeta(ctx context.Context, id string, mimetype string, size int64) error {
+	info, meta := t.probeBlob(ctx, id, mimetype, size)
+	tr := t.g.V().Has("resource", "rsc_id", id).Property(gremlingo.Cardinality.Single, "size", size)
+	if !meta.Captured.IsZero() {
+		tr = tr.Property(gremlingo.Cardinality.Single, "captured", meta.Captured.Format(TimeFormat))
+	}
+	if camera := meta.Camera(); camera != "" {
+		tr = tr.Property(gremlingo.Cardinality.Single, "camera", camera)
+	}
+	if info.Width != 0 && info.Height != 0 {
+		tr = tr.Property(gremlingo.Cardinality.Single, "width", int64(info.Width)).
+			Property(gremlingo.Cardinality.Single, "height", int64(info.Height))
+	}
+	if info.Duration != 0 {
+		tr = tr.Property(gremlingo.Cardinality.Single, "duration", info.Duration)
+	}
+	return iterate(ctx, tr)
+}
+
+func (t *Tinkerpop) tagAll(ctx context.Context, tag string, failures []ScrubFailure) error {
+	var tags model.TagSet
+	if err := tags.Add(tag); err != nil {
+		return err
+	}
+	tx := t.g.Tx()
+	g, err := tx.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := ensureTags(ctx, g, tags); err != nil {
+		return err
+	}
+	for _, f := range failures {
+		if err := changeTags(ctx, g, tags, model.TagSet{}, f.Id); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,164 @@
+package db
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"log"
+	"slices"
+	"strings"
+	"time"
+
+	gremlingo "github.com/apache/tinkerpop/gremlin-go/v3/driver"
+	"github.com/blubywaff/ftag/internal/config"
+	"github.com/blubywaff/ftag/internal/derive"
+	"github.com/blubywaff/ftag/internal/model"
+	"github.com/blubywaff/ftag/internal/phash"
+)
+
+var NO_PHASH = errors.New("resource has no perceptual hash")
+
+type Similar struct {
+	Resource model.Resource
+	// bits that differ between the perceptual hashes
+	Distance int
+}
+
+type SimilarReport struct {
+	Started   time.Time
+	Finished  time.Time
+	Threshold int
+	// images that had no perceptual hash yet, which has now been recorded
+	Hashed int
+	// ids of resources that look alike, see phash.Group
+	Groups [][]string
+}
+
+// The perceptual hash of a stored image, "" if it cannot be decoded
+func (t *Tinkerpop) fingerprintBlob(ctx context.Context, key string, mimetype string) string {
+	if !derive.Supported(mimetype) {
+		return ""
+	}
+	f, err := t.blobs.Open(ctx, key)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	h, err := derive.Fingerprint(f, config.Global.Derive.MaxPixels)
+	if err != nil {
+		if !errors.Is(err, derive.NOT_IMAGE) && !errors.Is(err, derive.TOO_MANY_PIXELS) {
+			log.Println("could not hash image", key, err)
+		}
+		return ""
+	}
+	return phash.Format(h)
+}
+
+// the perceptual hash of every resource that has one, by id
+func (t *Tinkerpop) phashes(ctx context.Context) (map[string]uint64, error) {
+	rs, err := toList(ctx, t.g.V().HasLabel("resource").Has("phash").ElementMap("rsc_id", "phash"))
+	if err != nil {
+		return nil, err
+	}
+	hashes := make(map[string]uint64, len(rs))
+	for _, r := range rs {
+		m, ok := r.GetInterface().(map[interface{}]interface{})
+		if !ok {
+			return nil, errors.New("Invalid type resource map")
+		}
+		id, _ := m["rsc_id"].(string)
+		str, _ := m["phash"].(string)
+		h, err := phash.Parse(str)
+		if id == "" || err != nil {
+			continue
+		}
+		hashes[id] = h
+	}
+	return hashes, nil
+}
+
+func getFiles(ctx context.Context, g *GraphTraversalSource, ids []string) ([]model.Resource, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	return ToResources(ctx, g.V().HasLabel("resource").
+		Where(__.Values("rsc_id").Is(within(ToInterfaceSlice(ids)...))).
+		Project("r", "t", "f").
+		By(__.ElementMap()).
+		By(__.In("describes").Values("name").Fold()).
+		By(__.Out("file").ElementMap().Fold()))
+}
+
+// Resources whose image differs from that of id by at most threshold bits, closest first.
+// Fails with NO_RESULT if there is no such resource and NO_PHASH if it is not a hashed image.
+func (t *Tinkerpop) SimilarTo(ctx context.Context, id string, threshold int) ([]Similar, error) {
+	rsc, err := t.GetFile(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	h, err := phash.Parse(rsc.Phash)
+	if err != nil {
+		return nil, NO_PHASH
+	}
+	hashes, err := t.phashes(ctx)
+	if err != nil {
+		return nil, err
+	}
+	distances := make(map[string]int)
+	var ids []string
+	for other, oh := range hashes {
+		if d := phash.Distance(h, oh); other != id && d <= threshold {
+			distances[other] = d
+			ids = append(ids, other)
+		}
+	}
+	rs, err := getFiles(ctx, t.g, ids)
+	if err != nil {
+		return nil, err
+	}
+	similar := make([]Similar, 0, len(rs))
+	for _, r := range rs {
+		similar = append(similar, Similar{r, distances[r.Id]})
+	}
+	slices.SortFunc(similar, func(a, b Similar) int {
+		return cmp.Or(cmp.Compare(a.Distance, b.Distance), strings.Compare(a.Resource.Id, b.Resource.Id))
+	})
+	return similar, nil
+}
+
+// Groups every image in the library with those that look alike, for review.
+// Images added before perceptual hashing get their hash recorded first.
+func (t *Tinkerpop) GroupSimilar(ctx context.Context, threshold int) (SimilarReport, error) {
+	report := SimilarReport{Started: time.Now().UTC(), Threshold: threshold, Groups: make([][]string, 0)}
+	rs, err := toList(ctx, t.g.V().HasLabel("resource").Not(__.Has("phash")).ElementMap("rsc_id", "mime"))
+	if err != nil {
+		return report, err
+	}
+	for _, r := range rs {
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+		m, ok := r.GetInterface().(map[interface{}]interface{})
+		if !ok {
+			return report, errors.New("Invalid type resource map")
+		}
+		id, _ := m["rsc_id"].(string)
+		mimetype, _ := m["mime"].(string)
+		h := t.fingerprintBlob(ctx, id, mimetype)
+		if id == "" || h == "" {
+			continue
+		}
+		err := iterate(ctx, t.g.V().Has("resource", "rsc_id", id).Property(gremlingo.Cardinality.Single, "phash", h))
+		if err != nil {
+			return report, err
+		}
+		report.Hashed++
+	}
+	hashes, err := t.phashes(ctx)
+	if err != nil {
+		return report, err
+	}
+	report.Groups = phash.Group(hashes, threshold)
+	report.Finished = time.Now().UTC()
+	return report, nil
+}
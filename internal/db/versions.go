@@ -0,0 +1,311 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	gremlingo "github.com/apache/tinkerpop/gremlin-go/v3/driver"
+	"github.com/blubywaff/ftag/internal/error"
+	"github.com/blubywaff/ftag/internal/model"
+)
+
+// earlier content is kept under versions/<id>/<number>
+const versionPrefix = "versions"
+
+// properties of a resource that change with its content, these are kept on each version
+var contentKeys = []string{"mime", "sha256", "source", "filename", "size", "width", "height", "duration", "captured", "camera", "phash"}
+
+func VersionKey(id string, n int) string {
+	return versionPrefix + "/" + id + "/" + strconv.Itoa(n)
+}
+
+// The resource a version blob belongs to
+func versionOwner(key string) (string, bool) {
+	rest, ok := strings.CutPrefix(key, versionPrefix+"/")
+	if !ok {
+		return "", false
+	}
+	id, _, ok := strings.Cut(rest, "/")
+	return id, ok
+}
+
+// Copies the blob from to the new key to, the cleanup deletes the copy
+func (t *Tinkerpop) copyBlob(ctx context.Context, from string, to string) apperror.IntermediateResult {
+	f, err := t.blobs.Open(ctx, from)
+	if err != nil {
+		return apperror.IntermediateResultFromError(err)
+	}
+	defer f.Close()
+	if _, err := t.blobs.Put(ctx, to, f); err != nil {
+		return apperror.IntermediateResultFromError(err)
+	}
+	return apperror.IntermediateResult{
+		Cleanup: func() error {
+			if err := t.blobs.Delete(context.Background(), to); err != nil {
+				log.Println("could not delete on fail: " + to)
+				return err
+			}
+			return nil
+		},
+	}
+}
+
+// Overwrites the blob id with the content of with.
+// The cleanup puts back the content kept under backup, as is done straight away if the copy fails.
+// The blob is briefly missing while it is swapped.
+func (t *Tinkerpop) replaceBlob(ctx context.Context, id string, with string, backup string) apperror.IntermediateResult {
+	restore := func() error {
+		if err := t.blobs.Delete(context.Background(), id); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		restored := t.copyBlob(context.Background(), backup, id)
+		if err := restored.OpError(); err != nil {
+			log.Println("could not restore blob " + id + " from " + backup)
+			return err
+		}
+		return nil
+	}
+	if err := t.blobs.Delete(ctx, id); err != nil {
+		return apperror.IntermediateResultFromError(err)
+	}
+	copied := t.copyBlob(ctx, with, id)
+	if err := copied.OpError(); err != nil {
+		restore()
+		return apperror.IntermediateResultFromError(err)
+	}
+	return apperror.IntermediateResult{Cleanup: restore}
+}
+
+// records the current content of id as version n
+func addVersion(ctx context.Context, g *GraphTraversalSource, id string, n int) error {
+	rs, err := toList(ctx, g.V().Has("resource", "rsc_id", id).ElementMap(ToInterfaceSlice(contentKeys)...))
+	if err != nil {
+		return err
+	}
+	if len(rs) == 0 {
+		return NO_RESULT
+	}
+	m, ok := rs[0].GetInterface().(map[interface{}]interface{})
+	if !ok {
+		return errors.New("Invalid type resource map")
+	}
+	tr := g.AddV("version").
+		Property("num", int64(n)).
+		Property("replaced", time.Now().UTC().Format(TimeFormat))
+	for _, k := range contentKeys {
+		if v, ok := m[k]; ok {
+			tr = tr.Property(k, v)
+		}
+	}
+	return iterate(ctx, tr.As("v").
+		V().Has("resource", "rsc_id", id).
+		AddE("version").To(__.Select("v")))
+}
+
+// replaces every content property of id with props, see contentKeys
+func setContent(ctx context.Context, g *GraphTraversalSource, id string, props map[string]interface{}) error {
+	err := iterate(ctx, g.V().Has("resource", "rsc_id", id).Properties(ToInterfaceSlice(contentKeys)...).Drop())
+	if err != nil {
+		return err
+	}
+	tr := g.V().Has("resource", "rsc_id", id)
+	for _, k := range propKeys(props) {
+		tr = tr.Property(gremlingo.Cardinality.Single, k, props[k])
+	}
+	return iterate(ctx, tr)
+}
+
+// Copies the current content of id to a new version and commits it in a transaction of its own,
+// so that the old content is recorded before the blob of id is touched.
+// Version blobs that already exist are skipped, never overwritten, whatever left them there.
+func (t *Tinkerpop) keepVersion(ctx context.Context, id string) (int, error) {
+	tx := t.g.Tx()
+	g, err := tx.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	rs, err := toList(ctx, g.V().Has("resource", "rsc_id", id).Out("version").Values("num").Fold())
+	if err != nil {
+		return 0, err
+	}
+	n := 1
+	if len(rs) != 0 {
+		nums, _ := rs[0].GetInterface().([]interface{})
+		for _, num := range nums {
+			n = max(n, int(toInt64(num))+1)
+		}
+	}
+	var kept apperror.IntermediateResult
+	for ; ; n++ {
+		kept = t.copyBlob(ctx, id, VersionKey(id, n))
+		if !errors.Is(kept.OpError(), fs.ErrExist) {
+			break
+		}
+	}
+	if err := kept.OpError(); err != nil {
+		return 0, err
+	}
+	defer kept.Clean()
+	if err := addVersion(ctx, g, id, n); err != nil {
+		return 0, err
+	}
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	kept.Commit()
+	return n, nil
+}
+
+// Replaces the content of id, keeping its id, tags and privacy setting.
+// Returns WRONG_KIND for bookmarks and notes, see EditItem.
+// The current content becomes the next version, see Versions.
+// If anything fails once the blob has been overwritten, the old content is put back
+// and that version stays, the same as the current content.
+func (t *Tinkerpop) ReplaceContent(ctx context.Context, id string, f io.Reader, meta FileMeta) (model.Resource, error) {
+	old, err := t.GetFile(ctx, id)
+	if err != nil {
+		return model.Resource{}, err
+	}
+	if old.Kind != model.KindFile {
+		return model.Resource{}, WRONG_KIND
+	}
+
+	w, written := t.writeFileReversible(ctx, f, meta.Filename, stripAtIngest(old.Privacy))
+	if err := written.OpError(); err != nil {
+		return model.Resource{}, err
+	}
+	// only needed until it is copied over the current content
+	defer written.Clean()
+
+	// two replacements at once would swap the blob under each other
+	t.replaceMu.Lock()
+	defer t.replaceMu.Unlock()
+	old, err = t.GetFile(ctx, id)
+	if err != nil {
+		return model.Resource{}, err
+	}
+	if w.Hash == old.Hash {
+		return old, nil
+	}
+	n, err := t.keepVersion(ctx, id)
+	if err != nil {
+		return model.Resource{}, err
+	}
+
+	tx := t.g.Tx()
+	g, err := tx.Begin()
+	if err != nil {
+		return model.Resource{}, err
+	}
+	defer tx.Rollback()
+	if err := setContent(ctx, g, id, w.props(meta)); err != nil {
+		return model.Resource{}, err
+	}
+	// the old content is safe as version n from here on
+	swapped := t.replaceBlob(ctx, id, w.Id, VersionKey(id, n))
+	if err := swapped.OpError(); err != nil {
+		return model.Resource{}, err
+	}
+	defer swapped.Clean()
+	if err := ctx.Err(); err != nil {
+		return model.Resource{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return model.Resource{}, err
+	}
+	swapped.Commit()
+	return getFile(ctx, t.g, id)
+}
+
+func toVersion(m map[interface{}]interface{}) (model.Version, error) {
+	var v model.Version
+	v.Number = int(toInt64(m["num"]))
+	replaced, ok := m["replaced"].(string)
+	if !ok {
+		return v, errors.New("Invalid type replaced")
+	}
+	var err error
+	v.ReplacedAt, err = parseUpload(replaced)
+	if err != nil {
+		return v, errors.New("Invalid timestamp (parsing)")
+	}
+	v.Mimetype, _ = m["mime"].(string)
+	v.Source, _ = m["source"].(string)
+	v.Hash, _ = m["sha256"].(string)
+	v.Filename, _ = m["filename"].(string)
+	v.Size = toInt64(m["size"])
+	v.Width = int(toInt64(m["width"]))
+	v.Height = int(toInt64(m["height"]))
+	v.Duration, _ = m["duration"].(float64)
+	return v, nil
+}
+
+func toVersions(rs []*gremlingo.Result) ([]model.Version, error) {
+	versions := make([]model.Version, 0, len(rs))
+	for _, r := range rs {
+		m, ok := r.GetInterface().(map[interface{}]interface{})
+		if !ok {
+			return nil, errors.New("Invalid type version map")
+		}
+		v, err := toVersion(m)
+		if err != nil {
+			return nil, err
+		}
+		versions = append(versions, v)
+	}
+	return versions, nil
+}
+
+// The earlier contents of id, oldest first
+func (t *Tinkerpop) Versions(ctx context.Context, id string) ([]model.Version, error) {
+	if _, err := t.GetFile(ctx, id); err != nil {
+		return nil, err
+	}
+	rs, err := toList(ctx, t.g.V().Has("resource", "rsc_id", id).
+		Out("version").Order().By("num", asc).ElementMap())
+	if err != nil {
+		return nil, err
+	}
+	return toVersions(rs)
+}
+
+// Version n of id, its content is stored under VersionKey
+func (t *Tinkerpop) GetVersion(ctx context.Context, id string, n int) (model.Version, error) {
+	rs, err := toList(ctx, t.g.V().Has("resource", "rsc_id", id).
+		Out("version").Has("num", int64(n)).ElementMap())
+	if err != nil {
+		return model.Version{}, err
+	}
+	versions, err := toVersions(rs)
+	if err != nil {
+		return model.Version{}, err
+	}
+	if len(versions) == 0 {
+		return model.Version{}, NO_RESULT
+	}
+	return versions[0], nil
+}
+
+// Makes version n the content of id again, the content it replaces becomes a new version
+func (t *Tinkerpop) RevertContent(ctx context.Context, id string, n int) (model.Resource, error) {
+	v, err := t.GetVersion(ctx, id, n)
+	if err != nil {
+		return model.Resource{}, err
+	}
+	f, err := t.blobs.Open(ctx, VersionKey(id, n))
+	if err != nil {
+		return model.Resource{}, err
+	}
+	defer f.Close()
+	return t.ReplaceContent(ctx, id, f, FileMeta{Source: v.Source, Filename: v.Filename})
+}
@@ -0,0 +1,139 @@
+package derive
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"log"
+	"slices"
+	"sync"
+
+	"github.com/blubywaff/ftag/internal/blob"
+)
+
+// Keeps blobs under CachePrefix within MaxSize bytes,
+// deleting the least recently used when it grows beyond that
+type Cache struct {
+	Store   blob.Store
+	MaxSize int64
+
+	mu sync.Mutex
+	// of *cacheEntry, most recently used first
+	lru     *list.List
+	entries map[string]*list.Element
+	size    int64
+}
+
+type cacheEntry struct {
+	key  string
+	size int64
+}
+
+func (c *Cache) init() {
+	if c.lru == nil {
+		c.lru = list.New()
+		c.entries = make(map[string]*list.Element)
+	}
+}
+
+// Picks up blobs cached by an earlier run, taking their modification time as the last use
+func (c *Cache) Load(ctx context.Context) error {
+	infos, err := c.Store.List(ctx, CachePrefix)
+	if err != nil {
+		return err
+	}
+	slices.SortFunc(infos, func(a, b blob.Info) int { return b.ModTime.Compare(a.ModTime) })
+	c.mu.Lock()
+	c.init()
+	for _, bi := range infos {
+		if _, ok := c.entries[bi.Key]; ok {
+			continue
+		}
+		c.entries[bi.Key] = c.lru.PushBack(&cacheEntry{bi.Key, bi.Size})
+		c.size += bi.Size
+	}
+	evicted := c.evict()
+	c.mu.Unlock()
+	c.remove(evicted)
+	return nil
+}
+
+func (c *Cache) Open(ctx context.Context, key string) (blob.Reader, error) {
+	f, err := c.Store.Open(ctx, key)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.init()
+	el, ok := c.entries[key]
+	switch {
+	case errors.Is(err, fs.ErrNotExist) && ok:
+		// deleted from outside, e.g. by gc
+		c.size -= el.Value.(*cacheEntry).size
+		c.lru.Remove(el)
+		delete(c.entries, key)
+	case err == nil && ok:
+		c.lru.MoveToFront(el)
+	}
+	return f, err
+}
+
+func (c *Cache) Put(ctx context.Context, key string, r io.Reader) error {
+	n, err := c.Store.Put(ctx, key, r)
+	if errors.Is(err, fs.ErrExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.init()
+	c.entries[key] = c.lru.PushFront(&cacheEntry{key, n})
+	c.size += n
+	evicted := c.evict()
+	c.mu.Unlock()
+	c.remove(evicted)
+	return nil
+}
+
+// drops entries until the cache fits, must hold mu
+func (c *Cache) evict() []string {
+	var keys []string
+	for c.size > c.MaxSize && c.lru.Len() != 0 {
+		e := c.lru.Remove(c.lru.Back()).(*cacheEntry)
+		delete(c.entries, e.key)
+		c.size -= e.size
+		keys = append(keys, e.key)
+	}
+	return keys
+}
+
+func (c *Cache) remove(keys []string) {
+	for _, key := range keys {
+		if err := c.Store.Delete(context.Background(), key); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			log.Println("could not evict cached blob: " + key)
+		}
+	}
+}
+
+// Deletes the cached resizes of id, e.g. once its content has changed
+func (c *Cache) Forget(ctx context.Context, id string) error {
+	infos, err := c.Store.List(ctx, CachePrefix+"/"+id)
+	if err != nil {
+		return err
+	}
+	keys := make([]string, 0, len(infos))
+	c.mu.Lock()
+	c.init()
+	for _, bi := range infos {
+		if el, ok := c.entries[bi.Key]; ok {
+			c.size -= el.Value.(*cacheEntry).size
+			c.lru.Remove(el)
+			delete(c.entries, bi.Key)
+		}
+		keys = append(keys, bi.Key)
+	}
+	c.mu.Unlock()
+	c.remove(keys)
+	return nil
+}
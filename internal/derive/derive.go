@@ -0,0 +1,258 @@
+// Resized copies of image resources, kept in blob storage next to the originals
+package derive
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image"
+	"image/color"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/fs"
+	"strings"
+	"sync"
+
+	"github.com/blubywaff/ftag/internal/blob"
+	"github.com/blubywaff/ftag/internal/exif"
+	"github.com/blubywaff/ftag/internal/phash"
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+var (
+	NOT_IMAGE          = errors.New("resource is not a supported image")
+	TOO_MANY_PIXELS    = errors.New("image is too large to decode")
+	UNKNOWN_VARIANT    = errors.New("unknown variant")
+	INVALID_OPTIONS    = errors.New("invalid resize options")
+	UNSUPPORTED_FORMAT = errors.New("unsupported output format")
+)
+
+// Fixed variants live under this prefix as "variants/<id>/<variant>"
+// and resizes made on request under "cache/<id>/<options>".
+const (
+	Prefix      = "variants"
+	CachePrefix = "cache"
+)
+
+func Key(id, variant string) string { return Prefix + "/" + id + "/" + variant }
+
+// The resource id a derived blob belongs to
+func ResourceId(key string) (string, bool) {
+	rest, ok := strings.CutPrefix(key, Prefix+"/")
+	if !ok {
+		rest, ok = strings.CutPrefix(key, CachePrefix+"/")
+	}
+	if !ok {
+		return "", false
+	}
+	id, _, ok := strings.Cut(rest, "/")
+	return id, ok
+}
+
+// Mimetypes that can be decoded
+func Supported(mimetype string) bool {
+	switch mimetype {
+	case "image/png", "image/jpeg", "image/gif", "image/webp":
+		return true
+	}
+	return false
+}
+
+type Variant struct {
+	Name string
+	// the image is shrunk to fit inside this box, never enlarged
+	Width  int
+	Height int
+	// Jpeg if empty
+	Format string
+}
+
+func (v Variant) Mimetype() string {
+	if v.Format == "" {
+		return "image/" + Jpeg
+	}
+	return "image/" + v.Format
+}
+
+type Deriver struct {
+	Store    blob.Store
+	Variants []Variant
+	// jpeg quality, 1 to 100
+	Quality int
+	// images with more pixels than this are not decoded, as a guard against decompression bombs
+	MaxPixels int
+	// largest width or height that Render will produce
+	MaxDimension int
+	// holds the output of Render
+	Cache *Cache
+
+	mu sync.Mutex
+	// keys being generated, closed when done
+	pending map[string]chan struct{}
+}
+
+func (d *Deriver) variant(name string) (Variant, bool) {
+	for _, v := range d.Variants {
+		if v.Name == name {
+			return v, true
+		}
+	}
+	return Variant{}, false
+}
+
+// Opens a variant of the resource, generating it first if it does not exist yet
+func (d *Deriver) Open(ctx context.Context, id string, name string) (blob.Reader, error) {
+	v, ok := d.variant(name)
+	if !ok {
+		return nil, UNKNOWN_VARIANT
+	}
+	f, err := d.Store.Open(ctx, Key(id, v.Name))
+	if !errors.Is(err, fs.ErrNotExist) {
+		return f, err
+	}
+	if err := d.generate(ctx, id, v); err != nil {
+		return nil, err
+	}
+	return d.Store.Open(ctx, Key(id, v.Name))
+}
+
+// Deletes every variant and cached resize of the resource, e.g. once its content has changed
+func (d *Deriver) Forget(ctx context.Context, id string) error {
+	infos, err := d.Store.List(ctx, Prefix+"/"+id)
+	if err != nil {
+		return err
+	}
+	for _, bi := range infos {
+		if err := d.Store.Delete(ctx, bi.Key); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	return d.Cache.Forget(ctx, id)
+}
+
+// Generates every variant of the resource that does not exist yet
+func (d *Deriver) Generate(ctx context.Context, id string) error {
+	for _, v := range d.Variants {
+		if _, err := d.Store.Stat(ctx, Key(id, v.Name)); err == nil {
+			continue
+		}
+		if err := d.generate(ctx, id, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// waits for anyone else generating key, returns false if the caller should generate it
+func (d *Deriver) claim(ctx context.Context, key string) (bool, error) {
+	d.mu.Lock()
+	if d.pending == nil {
+		d.pending = make(map[string]chan struct{})
+	}
+	done, ok := d.pending[key]
+	if !ok {
+		d.pending[key] = make(chan struct{})
+		d.mu.Unlock()
+		return false, nil
+	}
+	d.mu.Unlock()
+	select {
+	case <-done:
+		return true, nil
+	case <-ctx.Done():
+		return true, ctx.Err()
+	}
+}
+
+func (d *Deriver) release(key string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	close(d.pending[key])
+	delete(d.pending, key)
+}
+
+func (d *Deriver) generate(ctx context.Context, id string, v Variant) error {
+	key := Key(id, v.Name)
+	waited, err := d.claim(ctx, key)
+	if waited {
+		return err
+	}
+	defer d.release(key)
+
+	f, err := d.Store.Open(ctx, id)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	img, orientation, err := decode(f, d.MaxPixels)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	out := resizeOriented(img, orientation, Options{Width: v.Width, Height: v.Height, Fit: Contain})
+	format := v.Format
+	if format == "" {
+		format = Jpeg
+	}
+	if err := d.encode(&buf, out, format); err != nil {
+		return err
+	}
+	// someone may have generated it since the caller looked
+	if _, err := d.Store.Put(ctx, key, &buf); err != nil && !errors.Is(err, fs.ErrExist) {
+		return err
+	}
+	return nil
+}
+
+// Checks the dimensions before committing to decoding the whole image.
+// Also returns the exif orientation, 0 if there is none.
+func decode(r blob.Reader, maxPixels int) (image.Image, int, error) {
+	cfg, format, err := image.DecodeConfig(r)
+	if err != nil {
+		return nil, 0, NOT_IMAGE
+	}
+	if cfg.Width*cfg.Height > maxPixels {
+		return nil, 0, TOO_MANY_PIXELS
+	}
+	size, err := r.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, 0, err
+	}
+	// a broken exif block just leaves the image as stored
+	meta, _ := exif.Read(r, size, "image/"+format)
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, 0, err
+	}
+	img, _, err := image.Decode(r)
+	return img, meta.Orientation, err
+}
+
+func (d *Deriver) encode(w io.Writer, img image.Image, format string) error {
+	switch format {
+	case Jpeg:
+		// jpeg has no transparency, so it is flattened onto white
+		flat := image.NewRGBA(img.Bounds())
+		draw.Draw(flat, flat.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+		draw.Draw(flat, flat.Bounds(), img, img.Bounds().Min, draw.Over)
+		return jpeg.Encode(w, flat, &jpeg.Options{Quality: d.Quality})
+	case Png:
+		return png.Encode(w, img)
+	case Webp:
+		return encodeWebp(w, img)
+	}
+	return UNSUPPORTED_FORMAT
+}
+
+// The perceptual hash of the image in r as it looks upright, see phash.DHash.
+// Fails like Deriver.Open for images that are not supported or too large.
+func Fingerprint(r blob.Reader, maxPixels int) (uint64, error) {
+	img, orientation, err := decode(r, maxPixels)
+	if err != nil {
+		return 0, err
+	}
+	small := resizeOriented(img, orientation, Options{Width: phash.Width, Height: phash.Height, Fit: Fill})
+	return phash.DHash(small), nil
+}
@@ -0,0 +1,57 @@
+package derive
+
+import (
+	"image"
+	"image/draw"
+)
+
+// Resizes an image stored with the given exif orientation so that the result is upright.
+// The turn is done after scaling since it is slow and the result is usually much smaller.
+func resizeOriented(img image.Image, orientation int, o Options) image.Image {
+	if orientation < 2 || orientation > 8 {
+		return Resize(img, o)
+	}
+	// the stored image is sideways, so the box is too
+	if orientation >= 5 {
+		o.Width, o.Height = o.Height, o.Width
+	}
+	return orient(Resize(img, o), orientation)
+}
+
+// Turns and mirrors img upright according to its exif orientation
+func orient(img image.Image, orientation int) image.Image {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+	src := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.Draw(src, src.Bounds(), img, b.Min, draw.Src)
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch orientation {
+			case 2:
+				dx, dy = w-1-x, y
+			case 3:
+				dx, dy = w-1-x, h-1-y
+			case 4:
+				dx, dy = x, h-1-y
+			case 5:
+				dx, dy = y, x
+			case 6:
+				dx, dy = h-1-y, x
+			case 7:
+				dx, dy = h-1-y, w-1-x
+			case 8:
+				dx, dy = y, w-1-x
+			default:
+				dx, dy = x, y
+			}
+			copy(dst.Pix[dst.PixOffset(dx, dy):][:4], src.Pix[src.PixOffset(x, y):][:4])
+		}
+	}
+	return dst
+}
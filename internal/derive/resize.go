@@ -0,0 +1,153 @@
+package derive
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image"
+	"io"
+	"io/fs"
+	"strconv"
+
+	"golang.org/x/image/draw"
+)
+
+// how the image is made to fit the requested box
+const (
+	// inside the box keeping the aspect ratio, never enlarged
+	Contain = "contain"
+	// fills the box keeping the aspect ratio, the overflow is cropped from the center
+	Cover = "cover"
+	// stretched to exactly the box
+	Fill = "fill"
+)
+
+// output formats
+const (
+	Jpeg = "jpeg"
+	Png  = "png"
+	// lossless, see encodeWebp
+	Webp = "webp"
+)
+
+func ValidFormat(format string) bool {
+	return format == Jpeg || format == Png || format == Webp
+}
+
+type Options struct {
+	// 0 leaves that side unconstrained, at least one must be given
+	Width  int
+	Height int
+	Fit    string
+	Format string
+}
+
+func (o Options) Mimetype() string {
+	return "image/" + o.Format
+}
+
+func (o Options) check(maxDimension int) error {
+	if o.Width < 0 || o.Height < 0 || o.Width == 0 && o.Height == 0 {
+		return INVALID_OPTIONS
+	}
+	if o.Width > maxDimension || o.Height > maxDimension {
+		return INVALID_OPTIONS
+	}
+	switch o.Fit {
+	case Contain:
+	case Cover, Fill:
+		if o.Width == 0 || o.Height == 0 {
+			return INVALID_OPTIONS
+		}
+	default:
+		return INVALID_OPTIONS
+	}
+	if !ValidFormat(o.Format) {
+		return UNSUPPORTED_FORMAT
+	}
+	return nil
+}
+
+func (o Options) key(id string) string {
+	return CachePrefix + "/" + id + "/" + strconv.Itoa(o.Width) + "x" + strconv.Itoa(o.Height) + "-" + o.Fit + "." + o.Format
+}
+
+// Scales img according to o.Fit, the format is not used
+func Resize(img image.Image, o Options) image.Image {
+	src := img.Bounds()
+	w, h := src.Dx(), src.Dy()
+	switch o.Fit {
+	case Contain:
+		if o.Width != 0 && w > o.Width {
+			w, h = o.Width, max(1, h*o.Width/w)
+		}
+		if o.Height != 0 && h > o.Height {
+			w, h = max(1, w*o.Height/h), o.Height
+		}
+	case Cover:
+		// the largest part of the source with the aspect ratio of the box
+		cw, ch := w, h
+		if w*o.Height > o.Width*h {
+			cw = max(1, h*o.Width/o.Height)
+		} else {
+			ch = max(1, w*o.Height/o.Width)
+		}
+		src = image.Rect(0, 0, cw, ch).Add(src.Min).Add(image.Pt((w-cw)/2, (h-ch)/2))
+		w, h = o.Width, o.Height
+		if w > cw {
+			w, h = cw, max(1, h*cw/w)
+		}
+	case Fill:
+		w, h = o.Width, o.Height
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), img, src, draw.Src, nil)
+	return dst
+}
+
+type readSeekNopCloser struct {
+	*bytes.Reader
+}
+
+func (readSeekNopCloser) Close() error { return nil }
+
+// Resizes and re-encodes the resource, reusing an earlier result from Cache if there is one
+func (d *Deriver) Render(ctx context.Context, id string, o Options) (io.ReadSeekCloser, error) {
+	if err := o.check(d.MaxDimension); err != nil {
+		return nil, err
+	}
+	key := o.key(id)
+	f, err := d.Cache.Open(ctx, key)
+	if !errors.Is(err, fs.ErrNotExist) {
+		return f, err
+	}
+	waited, err := d.claim(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if waited {
+		// whoever rendered it may have failed, then this one tries again
+		return d.Render(ctx, id, o)
+	}
+	defer d.release(key)
+
+	src, err := d.Store.Open(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close()
+	img, orientation, err := decode(src, d.MaxPixels)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := d.encode(&buf, resizeOriented(img, orientation, o), o.Format); err != nil {
+		return nil, err
+	}
+	bts := buf.Bytes()
+	if err := d.Cache.Put(ctx, key, bytes.NewReader(bts)); err != nil {
+		return nil, err
+	}
+	// served from memory since the cache may already have evicted it
+	return readSeekNopCloser{bytes.NewReader(bts)}, nil
+}
@@ -0,0 +1,344 @@
+package derive
+
+import (
+	"encoding/binary"
+	"errors"
+	"image"
+	"io"
+
+	"golang.org/x/image/draw"
+)
+
+// Lossless webp, see https://developers.google.com/speed/webp/docs/webp_lossless_bitstream_specification
+// Only the subtract green and predictor transforms are used and every pixel is coded as a literal,
+// so photos come out larger than as jpeg, about the size of a png.
+
+// largest width or height a webp can have
+const webpMaxDimension = 1 << 14
+
+// the predictor used for every pixel, ClampAddSubtractFull(L, T, TL)
+const webpPredictor = 12
+
+// the predictor transform covers the image in tiles of 1 << webpTileBits pixels
+const webpTileBits = 9
+
+// the order code length code lengths are written in
+var webpCodeLengthOrder = [19]int{17, 18, 0, 1, 2, 3, 4, 5, 16, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}
+
+// literal green values and lz77 lengths, red, blue, alpha and lz77 distances
+var webpAlphabets = [5]int{256 + 24, 256, 256, 256, 40}
+
+// writes the least significant bits first
+type bitWriter struct {
+	buf  []byte
+	acc  uint64
+	bits uint
+}
+
+func (b *bitWriter) write(v uint32, n uint) {
+	b.acc |= uint64(v) << b.bits
+	b.bits += n
+	for b.bits >= 8 {
+		b.buf = append(b.buf, byte(b.acc))
+		b.acc >>= 8
+		b.bits -= 8
+	}
+}
+
+func (b *bitWriter) bytes() []byte {
+	if b.bits > 0 {
+		b.buf = append(b.buf, byte(b.acc))
+		b.acc, b.bits = 0, 0
+	}
+	return b.buf
+}
+
+// Huffman code lengths for freq that are no longer than limit.
+// Too long codes are avoided by raising the rarest frequencies until the tree is flat enough.
+func codeLengths(freq []int, limit int) []uint8 {
+	type node struct {
+		weight int
+		parent int
+	}
+	lengths := make([]uint8, len(freq))
+	for floor := 1; ; floor *= 2 {
+		nodes := make([]node, 0, 2*len(freq))
+		leaves := make([]int, len(freq))
+		active := make([]int, 0, len(freq))
+		for s, f := range freq {
+			leaves[s] = -1
+			if f > 0 {
+				leaves[s] = len(nodes)
+				active = append(active, len(nodes))
+				nodes = append(nodes, node{max(f, floor), -1})
+			}
+		}
+		for len(active) > 1 {
+			// the two lightest
+			a, b := 0, 1
+			if nodes[active[b]].weight < nodes[active[a]].weight {
+				a, b = b, a
+			}
+			for i := 2; i < len(active); i++ {
+				switch w := nodes[active[i]].weight; {
+				case w < nodes[active[a]].weight:
+					a, b = i, a
+				case w < nodes[active[b]].weight:
+					b = i
+				}
+			}
+			parent := len(nodes)
+			nodes = append(nodes, node{nodes[active[a]].weight + nodes[active[b]].weight, -1})
+			nodes[active[a]].parent = parent
+			nodes[active[b]].parent = parent
+			active[a] = parent
+			active = append(active[:b], active[b+1:]...)
+		}
+		longest := 0
+		for s, leaf := range leaves {
+			depth := 0
+			for n := leaf; n >= 0 && nodes[n].parent >= 0; n = nodes[n].parent {
+				depth++
+			}
+			lengths[s] = uint8(depth)
+			longest = max(longest, depth)
+		}
+		if longest <= limit {
+			return lengths
+		}
+	}
+}
+
+// A prefix code as written, codes are bit reversed since they are read from their first bit
+type prefixCode struct {
+	lengths []uint8
+	codes   []uint16
+}
+
+func (c *prefixCode) put(w *bitWriter, symbol int) {
+	w.write(uint32(c.codes[symbol]), uint(c.lengths[symbol]))
+}
+
+// the canonical codes for lengths
+func canonicalCodes(lengths []uint8) []uint16 {
+	var count [16]int
+	for _, l := range lengths {
+		count[l]++
+	}
+	count[0] = 0
+	var next [16]int
+	code := 0
+	for l := 1; l < 16; l++ {
+		code = (code + count[l-1]) << 1
+		next[l] = code
+	}
+	codes := make([]uint16, len(lengths))
+	for s, l := range lengths {
+		if l == 0 {
+			continue
+		}
+		c := next[l]
+		next[l]++
+		rev := 0
+		for i := 0; i < int(l); i++ {
+			rev |= (c >> i & 1) << (int(l) - 1 - i)
+		}
+		codes[s] = uint16(rev)
+	}
+	return codes
+}
+
+// Writes a prefix code for symbols occurring freq times and returns it
+func writePrefixCode(w *bitWriter, freq []int) prefixCode {
+	used := make([]int, 0, 2)
+	for s, f := range freq {
+		if f > 0 {
+			used = append(used, s)
+			if len(used) > 2 {
+				break
+			}
+		}
+	}
+	code := prefixCode{lengths: make([]uint8, len(freq)), codes: make([]uint16, len(freq))}
+	if len(used) <= 2 && (len(used) == 0 || used[len(used)-1] < 256) {
+		// a simple code, with a single symbol it takes no bits at all
+		if len(used) == 0 {
+			used = append(used, 0)
+		}
+		w.write(1, 1)
+		w.write(uint32(len(used)-1), 1)
+		if used[0] < 2 {
+			w.write(0, 1)
+			w.write(uint32(used[0]), 1)
+		} else {
+			w.write(1, 1)
+			w.write(uint32(used[0]), 8)
+		}
+		if len(used) == 2 {
+			w.write(uint32(used[1]), 8)
+			code.lengths[used[0]], code.lengths[used[1]] = 1, 1
+			code.codes[used[1]] = 1
+		}
+		return code
+	}
+
+	code.lengths = codeLengths(freq, 15)
+	code.codes = canonicalCodes(code.lengths)
+	// the lengths are written with a code of their own, without the repeat codes
+	lengthFreq := make([]int, 19)
+	for _, l := range code.lengths {
+		lengthFreq[l]++
+	}
+	// a lone length would get no bits, so another is made available though never used
+	distinct := 0
+	for _, f := range lengthFreq {
+		if f > 0 {
+			distinct++
+		}
+	}
+	if distinct == 1 {
+		if lengthFreq[0] == 0 {
+			lengthFreq[0] = 1
+		} else {
+			lengthFreq[1] = 1
+		}
+	}
+	lengthCode := prefixCode{lengths: codeLengths(lengthFreq, 7)}
+	lengthCode.codes = canonicalCodes(lengthCode.lengths)
+	n := 4
+	for i, s := range webpCodeLengthOrder {
+		if lengthCode.lengths[s] != 0 {
+			n = max(n, i+1)
+		}
+	}
+	w.write(0, 1)
+	w.write(uint32(n-4), 4)
+	for _, s := range webpCodeLengthOrder[:n] {
+		w.write(uint32(lengthCode.lengths[s]), 3)
+	}
+	// every symbol has its length written
+	w.write(0, 1)
+	for _, l := range code.lengths {
+		lengthCode.put(w, int(l))
+	}
+	return code
+}
+
+func clampAddSubtract(a, b, c uint8) uint8 {
+	return uint8(min(max(int(a)+int(b)-int(c), 0), 255))
+}
+
+// Encodes img as a lossless webp
+func encodeWebp(w io.Writer, img image.Image) error {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width < 1 || height < 1 || width > webpMaxDimension || height > webpMaxDimension {
+		return errors.New("image dimensions not supported by webp")
+	}
+	src, ok := img.(*image.NRGBA)
+	// a sub image shares the pixels of its parent past its own
+	if !ok || src.Stride != 4*width || len(src.Pix) != 4*width*height {
+		src = image.NewNRGBA(image.Rect(0, 0, width, height))
+		draw.Draw(src, src.Bounds(), img, bounds.Min, draw.Src)
+	}
+	opaque := true
+	// subtract green
+	pix := make([]byte, len(src.Pix))
+	for p := 0; p < len(pix); p += 4 {
+		g := src.Pix[p+1]
+		pix[p+0] = src.Pix[p+0] - g
+		pix[p+1] = g
+		pix[p+2] = src.Pix[p+2] - g
+		pix[p+3] = src.Pix[p+3]
+		opaque = opaque && pix[p+3] == 0xff
+	}
+	// predictor, the residuals are what is coded
+	res := make([]byte, len(pix))
+	stride := 4 * width
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			p := y*stride + 4*x
+			for c := 0; c < 4; c++ {
+				var pred uint8
+				switch {
+				case x == 0 && y == 0:
+					if c == 3 {
+						pred = 0xff
+					}
+				case y == 0:
+					pred = pix[p-4+c]
+				case x == 0:
+					pred = pix[p-stride+c]
+				default:
+					pred = clampAddSubtract(pix[p-4+c], pix[p-stride+c], pix[p-stride-4+c])
+				}
+				res[p+c] = pix[p+c] - pred
+			}
+		}
+	}
+
+	var bw bitWriter
+	bw.write(0x2f, 8)
+	bw.write(uint32(width-1), 14)
+	bw.write(uint32(height-1), 14)
+	if opaque {
+		bw.write(0, 1)
+	} else {
+		bw.write(1, 1)
+	}
+	bw.write(0, 3)
+
+	bw.write(1, 1)
+	bw.write(2, 2)
+	bw.write(1, 1)
+	bw.write(0, 2)
+	bw.write(webpTileBits-2, 3)
+	// the tile image, every tile has the same predictor so each channel takes no bits
+	bw.write(0, 1)
+	for i, alphabet := range webpAlphabets {
+		freq := make([]int, alphabet)
+		if i == 0 {
+			freq[webpPredictor] = 1
+		} else {
+			freq[0] = 1
+		}
+		writePrefixCode(&bw, freq)
+	}
+	bw.write(0, 1)
+
+	// no color cache and a single group of prefix codes
+	bw.write(0, 1)
+	bw.write(0, 1)
+	// green, red, blue and alpha in the order they are coded
+	channels := [4]int{1, 0, 2, 3}
+	var codes [4]prefixCode
+	for i, c := range channels {
+		freq := make([]int, webpAlphabets[i])
+		for p := c; p < len(res); p += 4 {
+			freq[res[p]]++
+		}
+		codes[i] = writePrefixCode(&bw, freq)
+	}
+	writePrefixCode(&bw, make([]int, webpAlphabets[4]))
+	for p := 0; p < len(res); p += 4 {
+		for i, c := range channels {
+			codes[i].put(&bw, int(res[p+c]))
+		}
+	}
+
+	data := bw.bytes()
+	padded := len(data) + len(data)&1
+	header := make([]byte, 20)
+	copy(header[0:], "RIFF")
+	binary.LittleEndian.PutUint32(header[4:], uint32(4+8+padded))
+	copy(header[8:], "WEBPVP8L")
+	binary.LittleEndian.PutUint32(header[16:], uint32(len(data)))
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	if len(data) != padded {
+		data = append(data, 0)
+	}
+	_, err := w.Write(data)
+	return err
+}
@@ -0,0 +1,70 @@
+package derive
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"math/rand"
+	"testing"
+
+	"golang.org/x/image/webp"
+)
+
+func TestEncodeWebpRoundTrip(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	gradient := image.NewNRGBA(image.Rect(0, 0, 300, 200))
+	noise := image.NewNRGBA(image.Rect(0, 0, 17, 9))
+	for y := 0; y < 200; y++ {
+		for x := 0; x < 300; x++ {
+			gradient.SetNRGBA(x, y, color.NRGBA{uint8(x), uint8(y), uint8(x + y), 255})
+		}
+	}
+	for i := range noise.Pix {
+		noise.Pix[i] = uint8(rng.Intn(256))
+	}
+	flat := image.NewNRGBA(image.Rect(0, 0, 1, 1))
+	flat.SetNRGBA(0, 0, color.NRGBA{10, 20, 30, 255})
+	cropped := gradient.SubImage(image.Rect(10, 10, 50, 30))
+
+	tests := []struct {
+		name string
+		img  image.Image
+	}{
+		{"gradient", gradient},
+		{"noise with alpha", noise},
+		{"single pixel", flat},
+		{"sub image", cropped},
+		{"full width sub image", gradient.SubImage(image.Rect(0, 20, 300, 40))},
+		{"gray", image.NewGray(image.Rect(0, 0, 5, 600))},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := encodeWebp(&buf, tt.img); err != nil {
+				t.Fatal(err)
+			}
+			got, err := webp.Decode(&buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b := tt.img.Bounds()
+			if got.Bounds().Dx() != b.Dx() || got.Bounds().Dy() != b.Dy() {
+				t.Fatalf("size %v, want %v", got.Bounds(), b)
+			}
+			for y := 0; y < b.Dy(); y++ {
+				for x := 0; x < b.Dx(); x++ {
+					want := color.NRGBAModel.Convert(tt.img.At(b.Min.X+x, b.Min.Y+y))
+					if c := color.NRGBAModel.Convert(got.At(x, y)); c != want {
+						t.Fatalf("pixel %d,%d is %v, want %v", x, y, c, want)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestEncodeWebpTooLarge(t *testing.T) {
+	if err := encodeWebp(&bytes.Buffer{}, image.NewGray(image.Rect(0, 0, webpMaxDimension+1, 1))); err == nil {
+		t.Fatal("expected an error")
+	}
+}
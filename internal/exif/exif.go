@@ -0,0 +1,276 @@
+// Reads the EXIF, IPTC and XMP metadata embedded in jpeg, png and webp images
+package exif
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"io"
+	"slices"
+	"strings"
+	"time"
+)
+
+var UNKNOWN_FORMAT = errors.New("format cannot carry metadata")
+
+// embedded blocks larger than this are ignored
+const maxBlock = 1 << 20
+
+// Zero fields were not present
+type Meta struct {
+	Make  string
+	Model string
+	// when the picture was taken, in UTC if the camera did not record its offset
+	Captured time.Time
+	// 1 to 8 as defined by EXIF, 1 is upright
+	Orientation int
+	HasGPS      bool
+	// decimal degrees, south and west are negative
+	Latitude  float64
+	Longitude float64
+	// IPTC keywords and XMP dc:subject, without duplicates
+	Keywords []string
+}
+
+// The make and model as one string, without the make repeated
+func (m Meta) Camera() string {
+	if strings.HasPrefix(strings.ToLower(m.Model), strings.ToLower(m.Make)) {
+		return m.Model
+	}
+	return strings.TrimSpace(m.Make + " " + m.Model)
+}
+
+func (m *Meta) addKeywords(kws ...string) {
+	for _, kw := range kws {
+		kw = strings.TrimSpace(kw)
+		if kw != "" && !slices.Contains(m.Keywords, kw) {
+			m.Keywords = append(m.Keywords, kw)
+		}
+	}
+}
+
+// kinds of embedded block
+const (
+	blockExif = iota
+	blockXmp
+	blockPhotoshop
+	// a png iTXt chunk, which may hold xmp
+	blockPngText
+)
+
+type block struct {
+	kind int
+	data []byte
+	// where data starts in the file
+	off int64
+	// for png, the chunk type which is covered by its crc along with data
+	pngType string
+}
+
+// Whether Read and Strip understand the mimetype
+func Supported(mimetype string) bool {
+	return mimetype == "image/jpeg" || mimetype == "image/png" || mimetype == "image/webp"
+}
+
+// Calls fn for every metadata block of the image
+func walk(r io.ReaderAt, size int64, mimetype string, fn func(b block)) error {
+	switch mimetype {
+	case "image/jpeg":
+		return walkJpeg(r, size, fn)
+	case "image/png":
+		return walkPng(r, size, fn)
+	case "image/webp":
+		return walkWebp(r, size, fn)
+	}
+	return UNKNOWN_FORMAT
+}
+
+// Reads the metadata of an image according to its mimetype.
+// Returns UNKNOWN_FORMAT for mimetypes that are not understood.
+func Read(r io.ReaderAt, size int64, mimetype string) (Meta, error) {
+	var m Meta
+	err := walk(r, size, mimetype, func(b block) {
+		switch b.kind {
+		case blockExif:
+			readTiff(b.data, &m)
+		case blockXmp:
+			readXmp(b.data, &m)
+		case blockPhotoshop:
+			readPhotoshop(b.data, &m)
+		case blockPngText:
+			if xmp, ok := pngXmp(b.data); ok {
+				readXmp(xmp, &m)
+			}
+		}
+	})
+	return m, err
+}
+
+func readBlock(r io.ReaderAt, off int64, n int64) ([]byte, error) {
+	if n < 0 || n > maxBlock {
+		return nil, errors.New("metadata block too large")
+	}
+	buf := make([]byte, n)
+	_, err := r.ReadAt(buf, off)
+	return buf, err
+}
+
+const (
+	exifHeader = "Exif\x00\x00"
+	xmpHeader  = "http://ns.adobe.com/xap/1.0/\x00"
+	psHeader   = "Photoshop 3.0\x00"
+)
+
+func walkJpeg(r io.ReaderAt, size int64, fn func(b block)) error {
+	var hdr [4]byte
+	if _, err := r.ReadAt(hdr[:2], 0); err != nil {
+		return err
+	}
+	if hdr[0] != 0xFF || hdr[1] != 0xD8 {
+		return UNKNOWN_FORMAT
+	}
+	for off := int64(2); off+4 <= size; {
+		if _, err := r.ReadAt(hdr[:], off); err != nil {
+			return err
+		}
+		if hdr[0] != 0xFF {
+			return errors.New("invalid jpeg marker")
+		}
+		marker := hdr[1]
+		// start of scan, everything after is image data
+		if marker == 0xDA || marker == 0xD9 {
+			return nil
+		}
+		length := int64(binary.BigEndian.Uint16(hdr[2:4]))
+		if marker == 0xE1 || marker == 0xED {
+			seg, err := readBlock(r, off+4, length-2)
+			if err != nil {
+				return err
+			}
+			for _, h := range []struct {
+				marker byte
+				header string
+				kind   int
+			}{{0xE1, exifHeader, blockExif}, {0xE1, xmpHeader, blockXmp}, {0xED, psHeader, blockPhotoshop}} {
+				if marker == h.marker && bytes.HasPrefix(seg, []byte(h.header)) {
+					fn(block{kind: h.kind, data: seg[len(h.header):], off: off + 4 + int64(len(h.header))})
+				}
+			}
+		}
+		off += 2 + length
+	}
+	return nil
+}
+
+func walkPng(r io.ReaderAt, size int64, fn func(b block)) error {
+	var hdr [8]byte
+	if _, err := r.ReadAt(hdr[:], 0); err != nil {
+		return err
+	}
+	if string(hdr[:]) != "\x89PNG\r\n\x1a\n" {
+		return UNKNOWN_FORMAT
+	}
+	for off := int64(8); off+8 <= size; {
+		if _, err := r.ReadAt(hdr[:], off); err != nil {
+			return err
+		}
+		length := int64(binary.BigEndian.Uint32(hdr[0:4]))
+		typ := string(hdr[4:8])
+		switch typ {
+		case "eXIf", "iTXt":
+			data, err := readBlock(r, off+8, length)
+			if err != nil {
+				return err
+			}
+			kind := blockExif
+			if typ == "iTXt" {
+				kind = blockPngText
+			}
+			fn(block{kind: kind, data: data, off: off + 8, pngType: typ})
+		case "IEND":
+			return nil
+		}
+		// length, type, data and crc
+		off += 12 + length
+	}
+	return nil
+}
+
+const pngXmpKeyword = "XML:com.adobe.xmp"
+
+// where the text of an iTXt chunk holding xmp starts, and whether it is compressed
+func pngXmpText(data []byte) (int, bool, bool) {
+	keyword, _, ok := bytes.Cut(data, []byte{0})
+	if !ok || string(keyword) != pngXmpKeyword || len(data) < len(keyword)+3 {
+		return 0, false, false
+	}
+	i := len(keyword) + 1
+	compressed := data[i] == 1
+	// skip the compression flag and method, then the language tag and translated keyword
+	i += 2
+	for n := 0; n < 2; n++ {
+		j := bytes.IndexByte(data[i:], 0)
+		if j < 0 {
+			return 0, false, false
+		}
+		i += j + 1
+	}
+	return i, compressed, true
+}
+
+// the xmp held by an iTXt chunk
+func pngXmp(data []byte) ([]byte, bool) {
+	start, compressed, ok := pngXmpText(data)
+	if !ok {
+		return nil, false
+	}
+	if !compressed {
+		return data[start:], true
+	}
+	zr, err := zlib.NewReader(bytes.NewReader(data[start:]))
+	if err != nil {
+		return nil, false
+	}
+	defer zr.Close()
+	text, err := io.ReadAll(io.LimitReader(zr, maxBlock))
+	return text, err == nil
+}
+
+func walkWebp(r io.ReaderAt, size int64, fn func(b block)) error {
+	var hdr [12]byte
+	if _, err := r.ReadAt(hdr[:], 0); err != nil {
+		return err
+	}
+	if string(hdr[0:4]) != "RIFF" || string(hdr[8:12]) != "WEBP" {
+		return UNKNOWN_FORMAT
+	}
+	for off := int64(12); off+8 <= size; {
+		if _, err := r.ReadAt(hdr[:8], off); err != nil {
+			return err
+		}
+		length := int64(binary.LittleEndian.Uint32(hdr[4:8]))
+		switch string(hdr[0:4]) {
+		case "EXIF":
+			data, err := readBlock(r, off+8, length)
+			if err != nil {
+				return err
+			}
+			// some writers keep the jpeg style header
+			skip := 0
+			if bytes.HasPrefix(data, []byte(exifHeader)) {
+				skip = len(exifHeader)
+			}
+			fn(block{kind: blockExif, data: data[skip:], off: off + 8 + int64(skip)})
+		case "XMP ":
+			data, err := readBlock(r, off+8, length)
+			if err != nil {
+				return err
+			}
+			fn(block{kind: blockXmp, data: data, off: off + 8})
+		}
+		// chunks are padded to an even size
+		off += 8 + length + length%2
+	}
+	return nil
+}
@@ -0,0 +1,296 @@
+package exif
+
+import (
+	"bytes"
+	"encoding/binary"
+	"slices"
+	"testing"
+	"time"
+)
+
+type byteOrder interface {
+	binary.ByteOrder
+	binary.AppendByteOrder
+}
+
+type entry struct {
+	tag   uint16
+	typ   uint16
+	count uint32
+	// nil links to the next ifd given to buildTiff
+	value []byte
+}
+
+func asciiEntry(tag uint16, s string) entry {
+	return entry{tag, typeAscii, uint32(len(s) + 1), []byte(s + "\x00")}
+}
+
+func shortEntry(order byteOrder, tag uint16, v uint16) entry {
+	return entry{tag, typeShort, 1, order.AppendUint16(nil, v)}
+}
+
+// degrees, minutes and seconds
+func dmsEntry(order byteOrder, tag uint16, d, m, s uint32) entry {
+	var v []byte
+	for _, n := range []uint32{d, m, s} {
+		v = order.AppendUint32(v, n)
+		v = order.AppendUint32(v, 1)
+	}
+	return entry{tag, typeRational, 3, v}
+}
+
+func linkEntry(tag uint16) entry {
+	return entry{tag, typeLong, 1, nil}
+}
+
+// Lays out the ifds one after another, values that do not fit in their entry go at the end
+func buildTiff(order byteOrder, ifds ...[]entry) []byte {
+	offs := make([]int, len(ifds))
+	pos := 8
+	for i, ifd := range ifds {
+		offs[i] = pos
+		pos += 2 + 12*len(ifd) + 4
+	}
+	data := make([]byte, pos)
+	if order == byteOrder(binary.LittleEndian) {
+		copy(data, "II")
+	} else {
+		copy(data, "MM")
+	}
+	order.PutUint16(data[2:], 42)
+	order.PutUint32(data[4:], 8)
+	link := 1
+	for i, ifd := range ifds {
+		o := offs[i]
+		order.PutUint16(data[o:], uint16(len(ifd)))
+		for j, e := range ifd {
+			p := o + 2 + 12*j
+			value := e.value
+			if value == nil {
+				value = order.AppendUint32(nil, uint32(offs[link]))
+				link++
+			}
+			order.PutUint16(data[p:], e.tag)
+			order.PutUint16(data[p+2:], e.typ)
+			order.PutUint32(data[p+4:], e.count)
+			if len(value) <= 4 {
+				copy(data[p+8:], value)
+			} else {
+				order.PutUint32(data[p+8:], uint32(len(data)))
+				data = append(data, value...)
+			}
+		}
+	}
+	return data
+}
+
+// a camera picture taken in the southern and western hemispheres
+func testTiff(order byteOrder) []byte {
+	return buildTiff(order,
+		[]entry{
+			asciiEntry(tagMake, "Canon"),
+			asciiEntry(tagModel, "Canon EOS 5D"),
+			shortEntry(order, tagOrientation, 6),
+			linkEntry(tagExifIFD),
+			linkEntry(tagGpsIFD),
+		},
+		[]entry{
+			asciiEntry(tagOriginal, "2021:03:04 05:06:07"),
+			asciiEntry(tagOffset, "+02:00"),
+		},
+		[]entry{
+			asciiEntry(tagLatRef, "S"),
+			dmsEntry(order, tagLat, 33, 51, 36),
+			asciiEntry(tagLonRef, "W"),
+			dmsEntry(order, tagLon, 70, 30, 0),
+		},
+	)
+}
+
+func TestReadTiff(t *testing.T) {
+	want := Meta{
+		Make:        "Canon",
+		Model:       "Canon EOS 5D",
+		Captured:    time.Date(2021, 3, 4, 3, 6, 7, 0, time.UTC),
+		Orientation: 6,
+		HasGPS:      true,
+		Latitude:    -(33 + 51.0/60 + 36.0/3600),
+		Longitude:   -70.5,
+	}
+	le := testTiff(binary.LittleEndian)
+	tests := []struct {
+		name string
+		data []byte
+		want Meta
+	}{
+		{"little endian", le, want},
+		{"big endian", testTiff(binary.BigEndian), want},
+		{"no header", []byte("II*"), Meta{}},
+		{"bad byte order", append([]byte("XX"), le[2:]...), Meta{}},
+		{"cut in ifd0", le[:20], Meta{}},
+		{"orientation out of range", buildTiff(binary.LittleEndian, []entry{shortEntry(binary.LittleEndian, tagOrientation, 9)}), Meta{}},
+		{"captured without offset", buildTiff(binary.LittleEndian,
+			[]entry{linkEntry(tagExifIFD)},
+			[]entry{asciiEntry(tagOriginal, "2021:03:04 05:06:07")},
+		), Meta{Captured: time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC)}},
+		{"gps without longitude", buildTiff(binary.LittleEndian,
+			[]entry{linkEntry(tagGpsIFD)},
+			[]entry{dmsEntry(binary.LittleEndian, tagLat, 1, 2, 3)},
+		), Meta{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var m Meta
+			readTiff(tt.data, &m)
+			if m.Make != tt.want.Make || m.Model != tt.want.Model || !m.Captured.Equal(tt.want.Captured) ||
+				m.Orientation != tt.want.Orientation || m.HasGPS != tt.want.HasGPS {
+				t.Errorf("got %+v, want %+v", m, tt.want)
+			}
+			if diff := m.Latitude - tt.want.Latitude + m.Longitude - tt.want.Longitude; diff > 1e-9 || diff < -1e-9 {
+				t.Errorf("got %v %v, want %v %v", m.Latitude, m.Longitude, tt.want.Latitude, tt.want.Longitude)
+			}
+		})
+	}
+}
+
+// a jpeg with the tiff in an app1 segment, then the start of the scan
+func testJpeg(tiff []byte) []byte {
+	seg := append([]byte(exifHeader), tiff...)
+	data := []byte{0xFF, 0xD8, 0xFF, 0xE1}
+	data = binary.BigEndian.AppendUint16(data, uint16(len(seg)+2))
+	data = append(data, seg...)
+	return append(data, 0xFF, 0xDA, 0, 2)
+}
+
+func TestCamera(t *testing.T) {
+	tests := []struct {
+		make, model, want string
+	}{
+		{"Canon", "Canon EOS 5D", "Canon EOS 5D"},
+		{"NIKON CORPORATION", "NIKON D750", "NIKON CORPORATION NIKON D750"},
+		{"Apple", "iPhone 12", "Apple iPhone 12"},
+		{"", "Model", "Model"},
+		{"Make", "", "Make"},
+	}
+	for _, tt := range tests {
+		if got := (Meta{Make: tt.make, Model: tt.model}).Camera(); got != tt.want {
+			t.Errorf("Camera(%q, %q) = %q, want %q", tt.make, tt.model, got, tt.want)
+		}
+	}
+}
+
+// a photoshop segment with one iptc resource holding the datasets
+func testPhotoshop(datasets ...[]byte) []byte {
+	var iptc []byte
+	for _, d := range datasets {
+		iptc = append(iptc, d...)
+	}
+	data := []byte("8BIM")
+	data = binary.BigEndian.AppendUint16(data, iptcResource)
+	// empty name, padded
+	data = append(data, 0, 0)
+	data = binary.BigEndian.AppendUint32(data, uint32(len(iptc)))
+	data = append(data, iptc...)
+	if len(iptc)%2 != 0 {
+		data = append(data, 0)
+	}
+	return data
+}
+
+func dataset(id uint16, value string) []byte {
+	d := []byte{0x1C}
+	d = binary.BigEndian.AppendUint16(d, id)
+	d = binary.BigEndian.AppendUint16(d, uint16(len(value)))
+	return append(d, value...)
+}
+
+func TestReadPhotoshop(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want []string
+	}{
+		{"keywords", testPhotoshop(dataset(iptcKeywords, "beach"), dataset(0x0205, "title"), dataset(iptcKeywords, " sun "), dataset(iptcKeywords, "beach")), []string{"beach", "sun"}},
+		{"odd length", testPhotoshop(dataset(iptcKeywords, "odd")), []string{"odd"}},
+		{"extended length", testPhotoshop([]byte{0x1C, 0x02, 0x19, 0x80, 0x04}), nil},
+		{"dataset cut", testPhotoshop(dataset(iptcKeywords, "cut")[:6]), nil},
+		{"resource cut", testPhotoshop(dataset(iptcKeywords, "whole"))[:14], nil},
+		{"not 8BIM", []byte("8BIX\x04\x04\x00\x00\x00\x00\x00\x00"), nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var m Meta
+			readPhotoshop(tt.data, &m)
+			if !slices.Equal(m.Keywords, tt.want) {
+				t.Errorf("got %q, want %q", m.Keywords, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadXmp(t *testing.T) {
+	tests := []struct {
+		name string
+		xmp  string
+		want []string
+	}{
+		{"subject", `<x:xmpmeta xmlns:x="adobe:ns:meta/"><rdf:RDF xmlns:rdf="` + nsRdf + `"><rdf:Description xmlns:dc="` + nsDc + `">` +
+			`<dc:subject><rdf:Bag><rdf:li>one</rdf:li><rdf:li>two</rdf:li></rdf:Bag></dc:subject>` +
+			`<dc:title><rdf:Alt><rdf:li>not a keyword</rdf:li></rdf:Alt></dc:title>` +
+			`</rdf:Description></rdf:RDF></x:xmpmeta>`, []string{"one", "two"}},
+		{"malformed", `<dc:subject xmlns:dc="` + nsDc + `"><rdf:li xmlns:rdf="` + nsRdf + `">kept</rdf:li><broken`, []string{"kept"}},
+		{"empty", ``, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var m Meta
+			readXmp([]byte(tt.xmp), &m)
+			if !slices.Equal(m.Keywords, tt.want) {
+				t.Errorf("got %q, want %q", m.Keywords, tt.want)
+			}
+		})
+	}
+}
+
+func FuzzReadTiff(f *testing.F) {
+	f.Add(testTiff(binary.LittleEndian))
+	f.Add(testTiff(binary.BigEndian))
+	f.Add([]byte("II*\x00\x08\x00\x00\x00\xff\xff"))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var m Meta
+		readTiff(data, &m)
+		stripTiff(slices.Clone(data))
+	})
+}
+
+func FuzzIptc(f *testing.F) {
+	f.Add(testPhotoshop(dataset(iptcKeywords, "beach"), dataset(0x025A, "Paris")))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var m Meta
+		readPhotoshop(data, &m)
+		clean := slices.Clone(data)
+		stripPhotoshop(clean)
+		if len(clean) != len(data) {
+			t.Errorf("length changed from %d to %d", len(data), len(clean))
+		}
+	})
+}
+
+func FuzzRead(f *testing.F) {
+	f.Add(testJpeg(testTiff(binary.LittleEndian)), "image/jpeg")
+	f.Add([]byte("\x89PNG\r\n\x1a\n\x00\x00\x00\x04eXIfII*\x00\x00\x00\x00\x00"), "image/png")
+	f.Add([]byte("RIFF\x00\x00\x00\x00WEBPEXIF\x04\x00\x00\x00II*\x00"), "image/webp")
+	f.Fuzz(func(t *testing.T, data []byte, mimetype string) {
+		r := bytes.NewReader(data)
+		Read(r, int64(len(data)), mimetype)
+		patches, err := Strip(r, int64(len(data)), mimetype)
+		if err != nil {
+			return
+		}
+		for _, p := range patches {
+			if p.Off < 0 || p.Off+int64(len(p.Data)) > int64(len(data)) {
+				t.Errorf("patch at %d of %d bytes outside %d", p.Off, len(p.Data), len(data))
+			}
+		}
+	})
+}
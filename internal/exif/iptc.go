@@ -0,0 +1,98 @@
+package exif
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/xml"
+)
+
+const (
+	// photoshop image resource holding IPTC-IIM records
+	iptcResource = 0x0404
+	// record 2, dataset 25
+	iptcKeywords = 0x0219
+)
+
+// calls fn with the id and content of each "8BIM" image resource of a photoshop segment
+func photoshopResources(data []byte, fn func(id uint16, value []byte)) {
+	for len(data) >= 12 && string(data[0:4]) == "8BIM" {
+		id := binary.BigEndian.Uint16(data[4:6])
+		// pascal string padded to an even length, including its length byte
+		nameLen := int(data[6]) + 1
+		nameLen += nameLen % 2
+		if 6+nameLen+4 > len(data) {
+			return
+		}
+		rest := data[6+nameLen:]
+		size := int(binary.BigEndian.Uint32(rest[0:4]))
+		if size > len(rest)-4 {
+			return
+		}
+		fn(id, rest[4:4+size])
+		size += size % 2
+		if size > len(rest)-4 {
+			return
+		}
+		data = rest[4+size:]
+	}
+}
+
+// calls fn with the record and dataset number and content of each IPTC-IIM dataset
+func iptcDatasets(data []byte, fn func(dataset uint16, value []byte)) {
+	for len(data) >= 5 && data[0] == 0x1C {
+		dataset := binary.BigEndian.Uint16(data[1:3])
+		size := int(binary.BigEndian.Uint16(data[3:5]))
+		// extended lengths are only used for large binary records
+		if size&0x8000 != 0 || size > len(data)-5 {
+			return
+		}
+		fn(dataset, data[5:5+size])
+		data = data[5+size:]
+	}
+}
+
+func readPhotoshop(data []byte, m *Meta) {
+	photoshopResources(data, func(id uint16, value []byte) {
+		if id != iptcResource {
+			return
+		}
+		iptcDatasets(value, func(dataset uint16, value []byte) {
+			if dataset == iptcKeywords {
+				m.addKeywords(string(value))
+			}
+		})
+	})
+}
+
+const (
+	nsDc  = "http://purl.org/dc/elements/1.1/"
+	nsRdf = "http://www.w3.org/1999/02/22-rdf-syntax-ns#"
+)
+
+// collects the rdf:li items of dc:subject
+func readXmp(data []byte, m *Meta) {
+	dec := xml.NewDecoder(bytes.NewReader(data))
+	inSubject, inItem := false, false
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return
+		}
+		switch tok := tok.(type) {
+		case xml.StartElement:
+			if tok.Name.Space == nsDc && tok.Name.Local == "subject" {
+				inSubject = true
+			}
+			inItem = inSubject && tok.Name.Space == nsRdf && tok.Name.Local == "li"
+		case xml.EndElement:
+			if tok.Name.Space == nsDc && tok.Name.Local == "subject" {
+				inSubject = false
+			}
+			inItem = false
+		case xml.CharData:
+			if inItem {
+				m.addKeywords(string(tok))
+			}
+		}
+	}
+}
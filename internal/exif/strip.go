@@ -0,0 +1,164 @@
+package exif
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"slices"
+)
+
+// tags identifying the camera, its owner or the software, blanked by Strip
+var deviceTags = []uint16{
+	tagMake, tagModel,
+	0x0131, // Software
+	0x013B, // Artist
+	0x013C, // HostComputer
+	0x927C, // MakerNote
+	0xA430, // CameraOwnerName
+	0xA431, // BodySerialNumber
+	0xA433, // LensMake
+	0xA434, // LensModel
+	0xA435, // LensSerialNumber
+}
+
+// iptc datasets naming a place, record 2
+var locationDatasets = []uint16{0x021A, 0x021B, 0x025A, 0x025C, 0x025F, 0x0264, 0x0265}
+
+const (
+	// photoshop resources that hold a copy of the exif or xmp
+	exifResource = 0x0422
+	xmpResource  = 0x0424
+)
+
+// replaces xmp of at least this size, otherwise it is only blanked
+const emptyXmp = `<?xpacket begin="" id="W5M0MpCehiHzreSzNTczkc9d"?><x:xmpmeta xmlns:x="adobe:ns:meta/"/><?xpacket end="w"?>`
+
+// Bytes to overwrite in a file, the length of the file does not change
+type Patch struct {
+	Off  int64
+	Data []byte
+}
+
+// Finds the patches that remove location and device data from an image.
+// Capture time, orientation and keywords in EXIF and IPTC are kept, XMP is removed entirely.
+// Returns UNKNOWN_FORMAT for mimetypes that are not understood.
+func Strip(r io.ReaderAt, size int64, mimetype string) ([]Patch, error) {
+	var patches []Patch
+	err := walk(r, size, mimetype, func(b block) {
+		clean := slices.Clone(b.data)
+		switch b.kind {
+		case blockExif:
+			stripTiff(clean)
+		case blockXmp:
+			stripXmp(clean)
+		case blockPhotoshop:
+			stripPhotoshop(clean)
+		case blockPngText:
+			stripPngText(clean)
+		}
+		if bytes.Equal(clean, b.data) {
+			return
+		}
+		patches = append(patches, Patch{b.off, clean})
+		if b.pngType != "" {
+			crc := crc32.NewIEEE()
+			crc.Write([]byte(b.pngType))
+			crc.Write(clean)
+			patches = append(patches, Patch{b.off + int64(len(clean)), binary.BigEndian.AppendUint32(nil, crc.Sum32())})
+		}
+	})
+	return patches, err
+}
+
+func stripTiff(data []byte) {
+	t, ok := newTiff(data)
+	if !ok {
+		return
+	}
+	ifd0 := t.ifd0()
+	ifds := []map[uint16]field{ifd0}
+	if f, ok := ifd0[tagExifIFD]; ok {
+		ifds = append(ifds, t.ifd(t.uint(f)))
+	}
+	for _, ifd := range ifds {
+		for _, tag := range deviceTags {
+			if f, ok := ifd[tag]; ok {
+				clear(f.value)
+			}
+		}
+	}
+	// the gps ifd is left in place with no entries and no next ifd,
+	// whose offset readers look for right after the count
+	if f, ok := ifd0[tagGpsIFD]; ok {
+		off := t.uint(f)
+		for _, gf := range t.ifd(off) {
+			clear(gf.value)
+		}
+		if int64(off) < int64(len(data)) {
+			clear(data[off:min(int64(off)+6, int64(len(data)))])
+		}
+	}
+}
+
+func stripXmp(data []byte) {
+	for i := range data {
+		data[i] = ' '
+	}
+	if len(data) >= len(emptyXmp) {
+		copy(data, emptyXmp)
+	}
+}
+
+func stripPhotoshop(data []byte) {
+	photoshopResources(data, func(id uint16, value []byte) {
+		switch id {
+		case exifResource:
+			stripTiff(value)
+		case xmpResource:
+			stripXmp(value)
+		case iptcResource:
+			iptcDatasets(value, func(dataset uint16, value []byte) {
+				if slices.Contains(locationDatasets, dataset) {
+					for i := range value {
+						value[i] = ' '
+					}
+				}
+			})
+		}
+	})
+}
+
+// compressed xmp cannot be blanked in place, so the chunk is switched to uncompressed
+func stripPngText(data []byte) {
+	start, _, ok := pngXmpText(data)
+	if !ok {
+		return
+	}
+	flag := len(pngXmpKeyword) + 1
+	data[flag], data[flag+1] = 0, 0
+	stripXmp(data[start:])
+}
+
+type patchedReader struct {
+	r       io.ReaderAt
+	patches []Patch
+}
+
+func (p patchedReader) ReadAt(b []byte, off int64) (int, error) {
+	n, err := p.r.ReadAt(b, off)
+	for _, pt := range p.patches {
+		// overlap of [off, off+n) and the patch
+		lo := max(off, pt.Off)
+		hi := min(off+int64(n), pt.Off+int64(len(pt.Data)))
+		if lo < hi {
+			copy(b[lo-off:hi-off], pt.Data[lo-pt.Off:hi-pt.Off])
+		}
+	}
+	return n, err
+}
+
+// The file with the patches applied, read from r as it goes
+func Patched(r io.ReaderAt, size int64, patches []Patch) *io.SectionReader {
+	return io.NewSectionReader(patchedReader{r, patches}, 0, size)
+}
@@ -0,0 +1,64 @@
+package exif
+
+import (
+	"bytes"
+	"encoding/binary"
+	"slices"
+	"testing"
+)
+
+func TestStripTiff(t *testing.T) {
+	for _, order := range []byteOrder{binary.LittleEndian, binary.BigEndian} {
+		data := testTiff(order)
+		stripTiff(data)
+		var m Meta
+		readTiff(data, &m)
+		if m.Make != "" || m.Model != "" || m.HasGPS {
+			t.Errorf("%v: device or location left: %+v", order, m)
+		}
+		if m.Orientation != 6 || m.Captured.IsZero() {
+			t.Errorf("%v: orientation or capture time removed: %+v", order, m)
+		}
+		t2, _ := newTiff(data)
+		gps := t2.uint(t2.ifd0()[tagGpsIFD])
+		// no entries and no next ifd
+		if !bytes.Equal(data[gps:gps+6], make([]byte, 6)) {
+			t.Errorf("%v: gps ifd not emptied: % x", order, data[gps:gps+6])
+		}
+	}
+}
+
+func TestReadAndStripJpeg(t *testing.T) {
+	data := testJpeg(testTiff(binary.LittleEndian))
+	m, err := Read(bytes.NewReader(data), int64(len(data)), "image/jpeg")
+	if err != nil || m.Camera() != "Canon EOS 5D" || !m.HasGPS {
+		t.Fatalf("Read = %+v, %v", m, err)
+	}
+	patches, err := Strip(bytes.NewReader(data), int64(len(data)), "image/jpeg")
+	if err != nil || len(patches) == 0 {
+		t.Fatalf("Strip = %v, %v", patches, err)
+	}
+	m, err = Read(Patched(bytes.NewReader(data), int64(len(data)), patches), int64(len(data)), "image/jpeg")
+	if err != nil || m.Camera() != "" || m.HasGPS || m.Orientation != 6 {
+		t.Errorf("Read after Strip = %+v, %v", m, err)
+	}
+	if _, err := Read(bytes.NewReader(data), int64(len(data)), "image/gif"); err != UNKNOWN_FORMAT {
+		t.Errorf("gif: %v", err)
+	}
+	if _, err := Read(bytes.NewReader([]byte("GIF89a")), 6, "image/jpeg"); err != UNKNOWN_FORMAT {
+		t.Errorf("not a jpeg: %v", err)
+	}
+}
+
+func TestStripPhotoshop(t *testing.T) {
+	data := testPhotoshop(dataset(iptcKeywords, "beach"), dataset(0x025A, "Paris"))
+	stripPhotoshop(data)
+	var m Meta
+	readPhotoshop(data, &m)
+	if !slices.Equal(m.Keywords, []string{"beach"}) {
+		t.Errorf("keywords changed: %q", m.Keywords)
+	}
+	if bytes.Contains(data, []byte("Paris")) {
+		t.Errorf("city left in %q", data)
+	}
+}
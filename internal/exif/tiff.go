@@ -0,0 +1,180 @@
+package exif
+
+import (
+	"encoding/binary"
+	"strings"
+	"time"
+)
+
+// exif tags, see the EXIF 2.32 specification
+const (
+	tagMake        = 0x010F
+	tagModel       = 0x0110
+	tagOrientation = 0x0112
+	tagExifIFD     = 0x8769
+	tagGpsIFD      = 0x8825
+	tagOriginal    = 0x9003
+	tagOffset      = 0x9011
+	tagLatRef      = 0x0001
+	tagLat         = 0x0002
+	tagLonRef      = 0x0003
+	tagLon         = 0x0004
+)
+
+// field types
+const (
+	typeAscii    = 2
+	typeShort    = 3
+	typeLong     = 4
+	typeRational = 5
+)
+
+var typeSizes = map[uint16]int{1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 7: 1, 9: 4, 10: 8}
+
+type tiff struct {
+	data  []byte
+	order binary.ByteOrder
+}
+
+type field struct {
+	typ   uint16
+	count int
+	// the value itself, already resolved if it did not fit in the entry
+	value []byte
+	// where value starts in the tiff data
+	off int64
+}
+
+func newTiff(data []byte) (tiff, bool) {
+	if len(data) < 8 {
+		return tiff{}, false
+	}
+	t := tiff{data: data}
+	switch string(data[0:2]) {
+	case "II":
+		t.order = binary.LittleEndian
+	case "MM":
+		t.order = binary.BigEndian
+	default:
+		return tiff{}, false
+	}
+	return t, true
+}
+
+func (t tiff) ifd0() map[uint16]field {
+	return t.ifd(t.order.Uint32(t.data[4:8]))
+}
+
+// Malformed parts are skipped, whatever could be read is kept in m
+func readTiff(data []byte, m *Meta) {
+	t, ok := newTiff(data)
+	if !ok {
+		return
+	}
+	ifd0 := t.ifd0()
+	m.Make = t.ascii(ifd0[tagMake])
+	m.Model = t.ascii(ifd0[tagModel])
+	if o := t.uint(ifd0[tagOrientation]); o >= 1 && o <= 8 {
+		m.Orientation = int(o)
+	}
+	if f, ok := ifd0[tagExifIFD]; ok {
+		sub := t.ifd(t.uint(f))
+		m.Captured = captured(t.ascii(sub[tagOriginal]), t.ascii(sub[tagOffset]))
+	}
+	if f, ok := ifd0[tagGpsIFD]; ok {
+		gps := t.ifd(t.uint(f))
+		lat, latOk := t.degrees(gps[tagLat])
+		lon, lonOk := t.degrees(gps[tagLon])
+		if latOk && lonOk {
+			if t.ascii(gps[tagLatRef]) == "S" {
+				lat = -lat
+			}
+			if t.ascii(gps[tagLonRef]) == "W" {
+				lon = -lon
+			}
+			m.HasGPS, m.Latitude, m.Longitude = true, lat, lon
+		}
+	}
+}
+
+// the entries of the ifd at off, by tag
+func (t tiff) ifd(off uint32) map[uint16]field {
+	fields := make(map[uint16]field)
+	if int64(off)+2 > int64(len(t.data)) {
+		return fields
+	}
+	n := int(t.order.Uint16(t.data[off:]))
+	for i := 0; i < n; i++ {
+		e := int64(off) + 2 + int64(i)*12
+		if e+12 > int64(len(t.data)) {
+			break
+		}
+		entry := t.data[e : e+12]
+		typ := t.order.Uint16(entry[2:4])
+		count := int64(t.order.Uint32(entry[4:8]))
+		size, ok := typeSizes[typ]
+		if !ok {
+			continue
+		}
+		total := count * int64(size)
+		voff := e + 8
+		if total > 4 {
+			voff = int64(t.order.Uint32(entry[8:12]))
+			if voff+total > int64(len(t.data)) {
+				continue
+			}
+		}
+		value := t.data[voff : voff+total]
+		fields[t.order.Uint16(entry[0:2])] = field{typ, int(count), value, voff}
+	}
+	return fields
+}
+
+func (t tiff) ascii(f field) string {
+	if f.typ != typeAscii {
+		return ""
+	}
+	s, _, _ := strings.Cut(string(f.value), "\x00")
+	return strings.TrimSpace(s)
+}
+
+func (t tiff) uint(f field) uint32 {
+	switch {
+	case f.typ == typeShort && len(f.value) >= 2:
+		return uint32(t.order.Uint16(f.value))
+	case f.typ == typeLong && len(f.value) >= 4:
+		return t.order.Uint32(f.value)
+	}
+	return 0
+}
+
+// degrees, minutes and seconds as three rationals
+func (t tiff) degrees(f field) (float64, bool) {
+	if f.typ != typeRational || f.count != 3 {
+		return 0, false
+	}
+	var v float64
+	for i, scale := range []float64{1, 60, 3600} {
+		num := t.order.Uint32(f.value[i*8:])
+		den := t.order.Uint32(f.value[i*8+4:])
+		if den == 0 {
+			return 0, false
+		}
+		v += float64(num) / float64(den) / scale
+	}
+	return v, true
+}
+
+// exif dates look like "2006:01:02 15:04:05", the offset like "+01:00"
+func captured(date string, offset string) time.Time {
+	if offset != "" {
+		if t, err := time.Parse("2006:01:02 15:04:05-07:00", date+offset); err == nil {
+			return t.UTC()
+		}
+	}
+	t, err := time.Parse("2006:01:02 15:04:05", date)
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
@@ -0,0 +1,180 @@
+// Downloads remote files on behalf of users, restricted by a Policy
+// so that the server cannot be used to reach internal services.
+package fetch
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+)
+
+var (
+	DISALLOWED_URL = errors.New("url not allowed by fetch policy")
+	TOO_LARGE      = errors.New("remote file exceeds size limit")
+	BAD_STATUS     = errors.New("remote server did not return the file")
+)
+
+type Policy struct {
+	Schemes []string
+	// if not empty, only these hosts may be fetched
+	Hosts []string
+	// permits loopback, private and link-local addresses
+	AllowPrivate bool
+	MaxSize      int64
+	// covers the whole download, not just the connection
+	Timeout time.Duration
+}
+
+type Fetcher struct {
+	policy Policy
+	client *http.Client
+}
+
+// ranges that are not covered by the net.IP methods but can still reach internal hosts
+var internalNets = []*net.IPNet{
+	// carrier grade nat
+	mustCIDR("100.64.0.0/10"),
+	// benchmarking, used by some networks internally
+	mustCIDR("198.18.0.0/15"),
+	// nat64, which embeds an ipv4 address of any kind
+	mustCIDR("64:ff9b::/96"),
+	mustCIDR("64:ff9b:1::/48"),
+}
+
+func mustCIDR(s string) *net.IPNet {
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		panic(err)
+	}
+	return n
+}
+
+func disallowedIP(ip net.IP) bool {
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsMulticast() {
+		return true
+	}
+	return slices.ContainsFunc(internalNets, func(n *net.IPNet) bool { return n.Contains(ip) })
+}
+
+func New(p Policy) *Fetcher {
+	f := &Fetcher{policy: p}
+	dialer := &net.Dialer{
+		Timeout: 30 * time.Second,
+		// checked on the resolved address so that dns cannot point around the policy
+		Control: func(network, address string, c syscall.RawConn) error {
+			if p.AllowPrivate {
+				return nil
+			}
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if disallowedIP(net.ParseIP(host)) {
+				return DISALLOWED_URL
+			}
+			return nil
+		},
+	}
+	f.client = &http.Client{
+		// no proxy, it would be the one making the connection
+		Transport: &http.Transport{DialContext: dialer.DialContext},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 10 {
+				return errors.New("too many redirects")
+			}
+			return f.Check(req.URL)
+		},
+	}
+	return f
+}
+
+func (f *Fetcher) Check(u *url.URL) error {
+	if !slices.Contains(f.policy.Schemes, strings.ToLower(u.Scheme)) {
+		return DISALLOWED_URL
+	}
+	if u.User != nil {
+		return DISALLOWED_URL
+	}
+	if len(f.policy.Hosts) != 0 && !slices.Contains(f.policy.Hosts, strings.ToLower(u.Hostname())) {
+		return DISALLOWED_URL
+	}
+	return nil
+}
+
+// closing also releases the download timeout
+type body struct {
+	r      io.Reader
+	c      io.Closer
+	cancel context.CancelFunc
+}
+
+func (b body) Read(p []byte) (int, error) { return b.r.Read(p) }
+
+func (b body) Close() error {
+	defer b.cancel()
+	return b.c.Close()
+}
+
+// reports TOO_LARGE instead of a silent EOF
+type limitReader struct {
+	r io.Reader
+	n int64
+}
+
+func (l *limitReader) Read(p []byte) (int, error) {
+	if l.n <= 0 {
+		var b [1]byte
+		n, err := l.r.Read(b[:])
+		if n > 0 {
+			return 0, TOO_LARGE
+		}
+		return 0, err
+	}
+	if int64(len(p)) > l.n {
+		p = p[:l.n]
+	}
+	n, err := l.r.Read(p)
+	l.n -= int64(n)
+	return n, err
+}
+
+// The returned body must be closed.
+func (f *Fetcher) Get(ctx context.Context, raw string) (io.ReadCloser, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.Check(u); err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, f.policy.Timeout)
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	res, err := f.client.Do(req)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	if res.StatusCode != 200 {
+		res.Body.Close()
+		cancel()
+		return nil, BAD_STATUS
+	}
+	if res.ContentLength > f.policy.MaxSize {
+		res.Body.Close()
+		cancel()
+		return nil, TOO_LARGE
+	}
+	return body{&limitReader{res.Body, f.policy.MaxSize}, res.Body, cancel}, nil
+}
@@ -0,0 +1,157 @@
+package fetch
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testPolicy() Policy {
+	return Policy{Schemes: []string{"http", "https"}, AllowPrivate: true, MaxSize: 16, Timeout: 5 * time.Second}
+}
+
+// serves /file, /big, /chunked, /missing and redirects from /to?url=
+func testServer(t *testing.T) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/file", func(res http.ResponseWriter, req *http.Request) {
+		io.WriteString(res, "0123456789abcdef")
+	})
+	mux.HandleFunc("/big", func(res http.ResponseWriter, req *http.Request) {
+		io.WriteString(res, "0123456789abcdefg")
+	})
+	mux.HandleFunc("/chunked", func(res http.ResponseWriter, req *http.Request) {
+		// flushing first leaves the length unknown
+		res.(http.Flusher).Flush()
+		io.WriteString(res, strings.Repeat("x", 100))
+	})
+	mux.HandleFunc("/missing", http.NotFound)
+	mux.HandleFunc("/to", func(res http.ResponseWriter, req *http.Request) {
+		http.Redirect(res, req, req.URL.Query().Get("url"), 302)
+	})
+	mux.HandleFunc("/loop", func(res http.ResponseWriter, req *http.Request) {
+		http.Redirect(res, req, "/loop", 302)
+	})
+	s := httptest.NewServer(mux)
+	t.Cleanup(s.Close)
+	return s
+}
+
+func get(f *Fetcher, raw string) (string, error) {
+	body, err := f.Get(context.Background(), raw)
+	if err != nil {
+		return "", err
+	}
+	defer body.Close()
+	bts, err := io.ReadAll(body)
+	if err != nil {
+		return "", err
+	}
+	return string(bts), nil
+}
+
+func TestGet(t *testing.T) {
+	s := testServer(t)
+	hostOnly := testPolicy()
+	hostOnly.Hosts = []string{"example.com"}
+	private := testPolicy()
+	private.AllowPrivate = false
+	// the test server listens on 127.0.0.1
+	serverOnly := testPolicy()
+	serverOnly.Hosts = []string{"127.0.0.1"}
+	elsewhere := "localhost:" + s.URL[strings.LastIndexByte(s.URL, ':')+1:]
+
+	tests := []struct {
+		name   string
+		policy Policy
+		url    string
+		want   string
+		err    error
+	}{
+		{"file", testPolicy(), s.URL + "/file", "0123456789abcdef", nil},
+		{"private address", private, s.URL + "/file", "", DISALLOWED_URL},
+		{"scheme", testPolicy(), "ftp://" + s.Listener.Addr().String() + "/file", "", DISALLOWED_URL},
+		{"user info", testPolicy(), "http://user:pass@" + s.Listener.Addr().String() + "/file", "", DISALLOWED_URL},
+		{"host not listed", hostOnly, s.URL + "/file", "", DISALLOWED_URL},
+		{"redirect", testPolicy(), s.URL + "/to?url=/file", "0123456789abcdef", nil},
+		{"redirect to scheme", testPolicy(), s.URL + "/to?url=" + url.QueryEscape("file:///etc/passwd"), "", DISALLOWED_URL},
+		{"redirect to user info", testPolicy(), s.URL + "/to?url=" + url.QueryEscape("http://user@"+s.Listener.Addr().String()+"/file"), "", DISALLOWED_URL},
+		{"host listed", serverOnly, s.URL + "/file", "0123456789abcdef", nil},
+		{"redirect to listed host", serverOnly, s.URL + "/to?url=" + url.QueryEscape(s.URL+"/file"), "0123456789abcdef", nil},
+		{"redirect to host not listed", serverOnly, s.URL + "/to?url=" + url.QueryEscape("http://"+elsewhere+"/file"), "", DISALLOWED_URL},
+		{"redirect loop", testPolicy(), s.URL + "/loop", "", errors.New("too many redirects")},
+		{"length over limit", testPolicy(), s.URL + "/big", "", TOO_LARGE},
+		{"body over limit", testPolicy(), s.URL + "/chunked", "", TOO_LARGE},
+		{"status", testPolicy(), s.URL + "/missing", "", BAD_STATUS},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := get(New(tt.policy), tt.url)
+			switch {
+			case tt.err == nil && err != nil:
+				t.Fatalf("unexpected error %v", err)
+			case tt.err != nil && err == nil:
+				t.Fatalf("got %q, want error %v", got, tt.err)
+			case tt.err != nil && !errors.Is(err, tt.err) && !strings.Contains(err.Error(), tt.err.Error()):
+				t.Fatalf("got error %v, want %v", err, tt.err)
+			}
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDisallowedIP(t *testing.T) {
+	for ip, want := range map[string]bool{
+		"127.0.0.1":       true,
+		"::1":             true,
+		"10.1.2.3":        true,
+		"192.168.0.1":     true,
+		"169.254.169.254": true,
+		"fe80::1":         true,
+		"0.0.0.0":         true,
+		"224.0.0.1":       true,
+		"100.64.0.1":      true,
+		"100.127.255.254": true,
+		"198.18.0.1":      true,
+		"198.19.255.254":  true,
+		"64:ff9b::a00:1":  true,
+		"64:ff9b:1::1":    true,
+		"::ffff:10.0.0.1": true,
+		"100.128.0.1":     false,
+		"198.20.0.1":      false,
+		"not an ip":       true,
+		"93.184.216.34":   false,
+		"2606:4700::1111": false,
+	} {
+		if got := disallowedIP(net.ParseIP(ip)); got != want {
+			t.Errorf("disallowedIP(%s) = %v, want %v", ip, got, want)
+		}
+	}
+}
+
+func TestPageTitle(t *testing.T) {
+	tests := []struct {
+		page string
+		want string
+	}{
+		{"<html><head><TITLE lang=en>A &amp; B</title>", "A & B"},
+		{"<title>\n  spread\n  out </title>", "spread out"},
+		{"<title>unterminated", ""},
+		{"<p>no title</p>", ""},
+		{"<title>\xff</title>", ""},
+		{"<title>" + strings.Repeat("a", 300) + "</title>", strings.Repeat("a", maxTitle-1) + "…"},
+	}
+	for _, tt := range tests {
+		if got := pageTitle([]byte(tt.page)); got != tt.want {
+			t.Errorf("pageTitle(%q) = %q, want %q", tt.page, got, tt.want)
+		}
+	}
+}
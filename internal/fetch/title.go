@@ -0,0 +1,65 @@
+package fetch
+
+import (
+	"bytes"
+	"context"
+	"html"
+	"io"
+	"strings"
+	"unicode/utf8"
+)
+
+// the title is expected in the head of a page, nothing after this is read
+const titleScan = 1 << 16
+
+// longer titles are cut, in characters
+const maxTitle = 200
+
+// Fetches the page at raw and returns its title, "" if it has none.
+// Only pages in utf-8 or ascii are understood.
+func (f *Fetcher) Title(ctx context.Context, raw string) (string, error) {
+	body, err := f.Get(ctx, raw)
+	if err != nil {
+		return "", err
+	}
+	defer body.Close()
+	head, err := io.ReadAll(io.LimitReader(body, titleScan))
+	if err != nil && err != TOO_LARGE {
+		return "", err
+	}
+	return pageTitle(head), nil
+}
+
+func pageTitle(page []byte) string {
+	// ascii only, so that offsets stay the same
+	lower := make([]byte, len(page))
+	for i, b := range page {
+		if 'A' <= b && b <= 'Z' {
+			b += 'a' - 'A'
+		}
+		lower[i] = b
+	}
+	start := bytes.Index(lower, []byte("<title"))
+	if start < 0 {
+		return ""
+	}
+	// past the attributes of the tag
+	open := bytes.IndexByte(lower[start:], '>')
+	if open < 0 {
+		return ""
+	}
+	start += open + 1
+	end := bytes.Index(lower[start:], []byte("</title"))
+	if end < 0 {
+		return ""
+	}
+	title := page[start : start+end]
+	if !utf8.Valid(title) {
+		return ""
+	}
+	clean := []rune(strings.Join(strings.Fields(html.UnescapeString(string(title))), " "))
+	if len(clean) > maxTitle {
+		clean = append(clean[:maxTitle-1], '…')
+	}
+	return string(clean)
+}
@@ -0,0 +1,179 @@
+// Renders the markdown of notes as html that is safe to embed in a page
+package markdown
+
+import (
+	"html"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// Only a subset is understood: headings, paragraphs, lists, quotes, fenced code,
+// code spans, emphasis and links. Everything else is shown as the text it is.
+// No html is ever passed through, all text is escaped and links may only be http, https or mailto.
+
+// each matches the marker at the start of a line, what follows is the content,
+// matching the whole line would have the regexp walk all of it for every block
+var (
+	headingRe = regexp.MustCompile(`^(#{1,6})\s+`)
+	bulletRe  = regexp.MustCompile(`^\s*[-*+]\s+`)
+	numberRe  = regexp.MustCompile(`^\s*\d{1,9}[.)]\s+`)
+	quoteRe   = regexp.MustCompile(`^\s*>\s?`)
+	fenceRe   = regexp.MustCompile("^\\s*(```|~~~)")
+)
+
+// what \s matches in the regexps
+const space = " \t\n\f\r"
+
+// quotes nested deeper are shown as text, each level reads the lines again
+const maxQuoteDepth = 8
+
+// schemes links may have, anything else is shown as text
+var linkSchemes = []string{"http", "https", "mailto"}
+
+// Renders src as html, see the package comment for what is understood
+func Render(src string) string {
+	return render(src, 0)
+}
+
+func render(src string, depth int) string {
+	var b strings.Builder
+	lines := strings.Split(strings.ReplaceAll(src, "\r\n", "\n"), "\n")
+	for i := 0; i < len(lines); {
+		line := lines[i]
+		switch {
+		case strings.TrimSpace(line) == "":
+			i++
+		case fenceRe.MatchString(line):
+			fence := fenceRe.FindStringSubmatch(line)[1]
+			i++
+			b.WriteString("<pre><code>")
+			for ; i < len(lines) && !strings.HasPrefix(strings.TrimSpace(lines[i]), fence); i++ {
+				b.WriteString(html.EscapeString(lines[i]))
+				b.WriteString("\n")
+			}
+			b.WriteString("</code></pre>\n")
+			// the closing fence, if any
+			i++
+		case headingRe.MatchString(line):
+			m := headingRe.FindStringSubmatch(line)
+			tag := "h" + string(rune('0'+len(m[1])))
+			// without the closing #s
+			text := strings.Trim(strings.TrimRight(strings.Trim(line[len(m[0]):], space), "#"), space)
+			b.WriteString("<" + tag + ">" + inline(text) + "</" + tag + ">\n")
+			i++
+		case bulletRe.MatchString(line):
+			i = list(&b, lines, i, "ul", bulletRe)
+		case numberRe.MatchString(line):
+			i = list(&b, lines, i, "ol", numberRe)
+		case depth < maxQuoteDepth && quoteRe.MatchString(line):
+			var quoted []string
+			for ; i < len(lines) && quoteRe.MatchString(lines[i]); i++ {
+				quoted = append(quoted, content(quoteRe, lines[i]))
+			}
+			b.WriteString("<blockquote>\n" + render(strings.Join(quoted, "\n"), depth+1) + "</blockquote>\n")
+		default:
+			var para []string
+			for ; i < len(lines) && (len(para) == 0 || !blockStart(lines[i])); i++ {
+				para = append(para, strings.TrimSpace(lines[i]))
+			}
+			b.WriteString("<p>" + inline(strings.Join(para, "\n")) + "</p>\n")
+		}
+	}
+	return b.String()
+}
+
+// whether line ends a paragraph
+func blockStart(line string) bool {
+	return strings.TrimSpace(line) == "" || fenceRe.MatchString(line) || headingRe.MatchString(line) ||
+		bulletRe.MatchString(line) || numberRe.MatchString(line) || quoteRe.MatchString(line)
+}
+
+// line after the marker matched by re
+func content(re *regexp.Regexp, line string) string {
+	return line[re.FindStringIndex(line)[1]:]
+}
+
+// writes the items starting at lines[i] and returns the index after them
+func list(b *strings.Builder, lines []string, i int, tag string, item *regexp.Regexp) int {
+	b.WriteString("<" + tag + ">\n")
+	for ; i < len(lines) && item.MatchString(lines[i]); i++ {
+		b.WriteString("<li>" + inline(content(item, lines[i])) + "</li>\n")
+	}
+	b.WriteString("</" + tag + ">\n")
+	return i
+}
+
+// the text of a single block, escaped, with code spans, emphasis and links
+func inline(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); {
+		rest := s[i:]
+		// underscores inside words, as in snake_case, are not emphasis
+		wordUnderscore := rest[0] == '_' && i > 0 && isWordByte(s[i-1])
+		switch {
+		case rest[0] == '\\' && len(rest) > 1 && strings.IndexByte("\\`*_[]()#+-.!>", rest[1]) >= 0:
+			b.WriteString(html.EscapeString(rest[1:2]))
+			i += 2
+			continue
+		case rest[0] == '`':
+			if end := strings.IndexByte(rest[1:], '`'); end >= 0 {
+				b.WriteString("<code>" + html.EscapeString(rest[1:1+end]) + "</code>")
+				i += end + 2
+				continue
+			}
+		case wordUnderscore:
+		case strings.HasPrefix(rest, "**"), strings.HasPrefix(rest, "__"):
+			if end := strings.Index(rest[2:], rest[:2]); end > 0 {
+				b.WriteString("<strong>" + inline(rest[2:2+end]) + "</strong>")
+				i += end + 4
+				continue
+			}
+		case rest[0] == '*', rest[0] == '_':
+			if end := strings.IndexByte(rest[1:], rest[0]); end > 0 {
+				b.WriteString("<em>" + inline(rest[1:1+end]) + "</em>")
+				i += end + 2
+				continue
+			}
+		case rest[0] == '[':
+			if text, href, n, ok := link(rest); ok {
+				b.WriteString(`<a href="` + html.EscapeString(href) + `" rel="noopener noreferrer">` + inline(text) + "</a>")
+				i += n
+				continue
+			}
+		}
+		// a plain character, which may be several bytes
+		n := 1
+		for n < len(rest) && rest[n]&0xC0 == 0x80 {
+			n++
+		}
+		b.WriteString(html.EscapeString(rest[:n]))
+		i += n
+	}
+	return b.String()
+}
+
+// [text](href) at the start of s, and its length in s.
+// Neither part may hold a newline or another [, so that looking for the end
+// never goes past the next link and rendering stays linear.
+func link(s string) (string, string, int, bool) {
+	mid := strings.IndexAny(s[1:], "[]\n") + 1
+	if mid == 0 || !strings.HasPrefix(s[mid:], "](") {
+		return "", "", 0, false
+	}
+	end := strings.IndexAny(s[mid+2:], "[)\n")
+	if end < 0 || s[mid+2+end] != ')' {
+		return "", "", 0, false
+	}
+	text, href := s[1:mid], strings.TrimSpace(s[mid+2:mid+2+end])
+	u, err := url.Parse(href)
+	if err != nil || !slices.Contains(linkSchemes, strings.ToLower(u.Scheme)) {
+		return "", "", 0, false
+	}
+	return text, href, mid + 3 + end, true
+}
+
+func isWordByte(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c >= 0x80
+}
@@ -0,0 +1,78 @@
+package markdown
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRender(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want string
+	}{
+		{"paragraph", "some\ntext", "<p>some\ntext</p>\n"},
+		{"heading", "## Title ##", "<h2>Title</h2>\n"},
+		{"emphasis", "*a* **b** snake_case_name", "<p><em>a</em> <strong>b</strong> snake_case_name</p>\n"},
+		{"code span", "`<b>`", "<p><code>&lt;b&gt;</code></p>\n"},
+		{"fence", "```\n<script>\n```", "<pre><code>&lt;script&gt;\n</code></pre>\n"},
+		{"list", "- a\n- b\n\n1. c", "<ul>\n<li>a</li>\n<li>b</li>\n</ul>\n<ol>\n<li>c</li>\n</ol>\n"},
+		{"quote", "> a\n> b", "<blockquote>\n<p>a\nb</p>\n</blockquote>\n"},
+		{"link", "[x](https://example.com/?a=1&b=\"2\")", "<p><a href=\"https://example.com/?a=1&amp;b=&#34;2&#34;\" rel=\"noopener noreferrer\">x</a></p>\n"},
+		{"html", "<img src=x onerror=alert(1)>", "<p>&lt;img src=x onerror=alert(1)&gt;</p>\n"},
+		{"script link", "[x](javascript:alert(1))", "<p>[x](javascript:alert(1))</p>\n"},
+		{"script link case", "[x](JavaScript:alert(1))", "<p>[x](JavaScript:alert(1))</p>\n"},
+		{"escape", "\\*not\\*", "<p>*not*</p>\n"},
+		{"link after brackets", "[[a](https://x)]", "<p>[<a href=\"https://x\" rel=\"noopener noreferrer\">a</a>]</p>\n"},
+		{"link across lines", "[a\nb](https://x)", "<p>[a\nb](https://x)</p>\n"},
+		{"href across lines", "[a](https://x\n)", "<p>[a](https://x\n)</p>\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Render(tt.src); got != tt.want {
+				t.Errorf("Render(%q) = %q, want %q", tt.src, got, tt.want)
+			}
+		})
+	}
+}
+
+// inputs as long as a note may be, made to send each lookahead to the end of the text
+func TestRenderLarge(t *testing.T) {
+	const size = 1 << 20
+	for name, src := range map[string]string{
+		"brackets":       strings.Repeat("[", size),
+		"link starts":    strings.Repeat("[a](", size/4),
+		"unclosed links": strings.Repeat("[a](https://x ", size/14),
+		"bracket lines":  strings.Repeat("[\n", size/2),
+		"emphasis":       strings.Repeat("*a_b`", size/5),
+		"strong":         "**" + strings.Repeat("*a", size/2),
+		"quotes":         strings.Repeat(">", size),
+		"list":           strings.Repeat("- [a\n", size/5),
+	} {
+		t.Run(name, func(t *testing.T) {
+			start := time.Now()
+			Render(src)
+			// quadratic rendering takes tens of seconds here
+			if d := time.Since(start); d > 2*time.Second {
+				t.Errorf("took %v", d)
+			}
+		})
+	}
+}
+
+// the only tags Render writes
+var allowedTag = regexp.MustCompile(`</?(p|h[1-6]|ul|ol|li|blockquote|pre|code|em|strong)>|<a href="(https?|mailto):[^"<>]*" rel="noopener noreferrer">|</a>`)
+
+func FuzzRender(f *testing.F) {
+	f.Add("# a\n\n- *b* [c](https://d)\n> `e`")
+	f.Add("<script>alert(1)</script>")
+	f.Add("[x](javascript:alert(1)) **_y_**")
+	f.Fuzz(func(t *testing.T, src string) {
+		out := allowedTag.ReplaceAllString(Render(src), "")
+		if strings.ContainsAny(out, "<>") {
+			t.Errorf("Render(%q) left markup: %q", src, out)
+		}
+	})
+}
@@ -3,6 +3,7 @@ package model
 import (
 	"encoding/json"
 	"errors"
+	"slices"
 	"strings"
 	"time"
 )
@@ -12,8 +13,199 @@ type Resource struct {
 	Mimetype  string
 	CreatedAt time.Time
 	Tags      TagSet
+	// KindFile, KindBookmark or KindNote
+	Kind string
+	// address of a bookmark
+	Url string `json:",omitempty"`
+	// of a bookmark or note
+	Title string `json:",omitempty"`
+	// markdown of a note
+	Text string `json:",omitempty"`
+	// Text rendered as html that is safe to embed, see markdown.Render
+	Html string `json:",omitempty"`
+	// url the file was imported from
+	Source string `json:",omitempty"`
+	// technical metadata, zero when unknown
+	Size     int64  `json:",omitempty"`
+	Hash     string `json:",omitempty"`
+	Filename string `json:",omitempty"`
+	Width    int    `json:",omitempty"`
+	Height   int    `json:",omitempty"`
+	// in seconds
+	Duration float64 `json:",omitempty"`
+	// from the embedded exif data
+	Captured *time.Time `json:",omitempty"`
+	Camera   string     `json:",omitempty"`
+	// perceptual hash of images, see phash.Format
+	Phash string `json:",omitempty"`
+	// overrides config.Config_Privacy for this resource, "" follows it
+	Privacy string `json:",omitempty"`
+	// further named files of the same item, like a raw original or subtitles
+	Files []File `json:",omitempty"`
+	// custom properties by key, see PropertyDef
+	Props map[string]interface{} `json:",omitempty"`
 }
 
+// A named file belonging to a resource besides its content
+type File struct {
+	Name     string
+	Mimetype string
+	AddedAt  time.Time
+	Size     int64  `json:",omitempty"`
+	Hash     string `json:",omitempty"`
+	Filename string `json:",omitempty"`
+}
+
+// Earlier content of a resource, kept when it was replaced
+type Version struct {
+	// counts up from 1 in the order the content was replaced
+	Number     int
+	ReplacedAt time.Time
+	Mimetype   string
+	// as on Resource
+	Source   string  `json:",omitempty"`
+	Size     int64   `json:",omitempty"`
+	Hash     string  `json:",omitempty"`
+	Filename string  `json:",omitempty"`
+	Width    int     `json:",omitempty"`
+	Height   int     `json:",omitempty"`
+	Duration float64 `json:",omitempty"`
+}
+
+// values for Resource.Kind
+const (
+	// content is a stored blob
+	KindFile = "file"
+	// content is the url
+	KindBookmark = "bookmark"
+	// content is the text
+	KindNote = "note"
+)
+
+func ValidKind(k string) bool {
+	return k == KindFile || k == KindBookmark || k == KindNote
+}
+
+// values for Relation.Type, read as From <Type> To
+const (
+	RelParentOf       = "parent-of"
+	RelNextInSequence = "next-in-sequence"
+	RelDuplicateOf    = "duplicate-of"
+	RelDerivedFrom    = "derived-from"
+)
+
+var Relations = []string{RelParentOf, RelNextInSequence, RelDuplicateOf, RelDerivedFrom}
+
+func ValidRelation(r string) bool {
+	return slices.Contains(Relations, r)
+}
+
+// A typed link between two resources
+type Relation struct {
+	Type string
+	From string
+	To   string
+}
+
+// An ordered grouping of resources, like the pages of a comic
+type Collection struct {
+	Id          string
+	Name        string
+	Description string `json:",omitempty"`
+	CreatedAt   time.Time
+	Tags        TagSet
+	// resource ids in order, a resource is a member at most once
+	Members []string
+}
+
+// A resource related to another, see Relation
+type Neighbor struct {
+	Relation Relation
+	// the end of the relation that is not the one asked about
+	Resource Resource
+}
+
+// values for PropertyDef.Type
+const (
+	PropString = "string"
+	// always a float64
+	PropNumber = "number"
+	// an RFC 3339 timestamp in utc, so that comparing the text compares the time
+	PropDate    = "date"
+	PropBoolean = "boolean"
+)
+
+func ValidPropType(t string) bool {
+	return t == PropString || t == PropNumber || t == PropDate || t == PropBoolean
+}
+
+// keys are lowercase letters, digits and dashes, like source-page
+func ValidPropKey(k string) bool {
+	if len(k) == 0 || len(k) > 64 || k[0] == '-' {
+		return false
+	}
+	for _, c := range k {
+		if (c < 'a' || c > 'z') && (c < '0' || c > '9') && c != '-' {
+			return false
+		}
+	}
+	return true
+}
+
+// A custom property that resources may have, with the type all of its values have
+type PropertyDef struct {
+	Key  string
+	Type string
+}
+
+// operators of a PropCondition, those that are the start of another come after it
+var PropOps = []string{">=", "<=", "!=", "=", ">", "<"}
+
+// A comparison of a custom property with a value, as in rating>=4
+type PropCondition struct {
+	Key   string
+	Op    string
+	Value string
+}
+
+func ParsePropCondition(str string) (PropCondition, error) {
+	i := strings.IndexAny(str, "<>=!")
+	if i < 0 {
+		return PropCondition{}, errors.New("missing operator")
+	}
+	c := PropCondition{Key: strings.TrimSpace(str[:i])}
+	if !ValidPropKey(c.Key) {
+		return c, errors.New("invalid property key")
+	}
+	for _, op := range PropOps {
+		if rest, ok := strings.CutPrefix(str[i:], op); ok {
+			c.Op = op
+			c.Value = strings.TrimSpace(rest)
+			return c, nil
+		}
+	}
+	return c, errors.New("invalid operator")
+}
+
+// values for Resource.Privacy
+const (
+	// embedded location and device data is never removed
+	PrivacyKeep = "keep"
+	// embedded location and device data is always removed
+	PrivacyStrip = "strip"
+)
+
+func ValidPrivacy(p string) bool {
+	return p == "" || p == PrivacyKeep || p == PrivacyStrip
+}
+
+// values for Query.Orientation
+const (
+	Landscape = "landscape"
+	Portrait  = "portrait"
+	Square    = "square"
+)
+
 type TagSet struct {
 	Inner []string
 }
@@ -169,6 +361,36 @@ func (ts *TagSet) FromSlice(sstr []string) error {
 type Query struct {
 	Include TagSet
 	Exclude TagSet
-	Offset  int
-	Limit   int
+	// only resources whose source contains this, ignored if empty
+	Source string
+	// only resources whose original filename contains this, ignored if empty
+	Filename string
+	// only resources of this kind, ignored if empty
+	Kind string
+	// only resources that are not the child of another, see RelParentOf
+	TopLevel bool
+	// only the children of this resource, ignored if empty
+	ChildOf string
+	// leaves out resources that are a duplicate of another, see RelDuplicateOf
+	NoDuplicates bool
+	// only the members of this collection, in its order rather than by upload time
+	Collection string
+	// also match resources without any tag, which are left out by default
+	Untagged bool
+	// all must hold, resources without the property never match
+	Props []PropCondition
+	// bounds on technical metadata, ignored if 0
+	// resources without the metadata do not match a bound on it
+	MinWidth    int
+	MaxWidth    int
+	MinHeight   int
+	MaxHeight   int
+	MinSize     int64
+	MaxSize     int64
+	MinDuration float64
+	MaxDuration float64
+	// Landscape, Portrait or Square, ignored if empty
+	Orientation string
+	Offset      int
+	Limit       int
 }
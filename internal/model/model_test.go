@@ -0,0 +1,76 @@
+package model
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestParsePropCondition(t *testing.T) {
+	tests := []struct {
+		str  string
+		want PropCondition
+		err  bool
+	}{
+		{"rating>=4", PropCondition{"rating", ">=", "4"}, false},
+		{"rating<=4", PropCondition{"rating", "<=", "4"}, false},
+		{"rating>4", PropCondition{"rating", ">", "4"}, false},
+		{"rating<4", PropCondition{"rating", "<", "4"}, false},
+		{"rating=4", PropCondition{"rating", "=", "4"}, false},
+		{"rating!=4", PropCondition{"rating", "!=", "4"}, false},
+		{" film-stock = Portra 400 ", PropCondition{"film-stock", "=", "Portra 400"}, false},
+		{"note=", PropCondition{"note", "=", ""}, false},
+		{"a=b=c", PropCondition{"a", "=", "b=c"}, false},
+		{"rating", PropCondition{}, true},
+		{"=4", PropCondition{}, true},
+		{"Rating=4", PropCondition{}, true},
+		{"-rating=4", PropCondition{}, true},
+		{"rating!4", PropCondition{}, true},
+		{"rating=<4", PropCondition{"rating", "=", "<4"}, false},
+	}
+	for _, tt := range tests {
+		got, err := ParsePropCondition(tt.str)
+		if (err != nil) != tt.err {
+			t.Errorf("ParsePropCondition(%q) error %v, want error %v", tt.str, err, tt.err)
+			continue
+		}
+		if err == nil && got != tt.want {
+			t.Errorf("ParsePropCondition(%q) = %+v, want %+v", tt.str, got, tt.want)
+		}
+	}
+}
+
+func FuzzParsePropCondition(f *testing.F) {
+	for _, seed := range []string{"rating>=4", "a!=b", "x<", "no operator"} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, str string) {
+		c, err := ParsePropCondition(str)
+		if err != nil {
+			return
+		}
+		if !ValidPropKey(c.Key) || !slices.Contains(PropOps, c.Op) {
+			t.Errorf("%q parsed to %+v", str, c)
+		}
+	})
+}
+
+func TestValidPropKey(t *testing.T) {
+	for key, want := range map[string]bool{
+		"rating":                true,
+		"film-stock":            true,
+		"iso100":                true,
+		"":                      false,
+		"-rating":               false,
+		"Rating":                false,
+		"film_stock":            false,
+		"a b":                   false,
+		"é":                     false,
+		strings.Repeat("a", 64): true,
+		strings.Repeat("a", 65): false,
+	} {
+		if got := ValidPropKey(key); got != want {
+			t.Errorf("ValidPropKey(%q) = %v, want %v", key, got, want)
+		}
+	}
+}
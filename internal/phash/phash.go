@@ -0,0 +1,136 @@
+// Perceptual hashes of images, which stay close when an image is resized or recompressed
+package phash
+
+import (
+	"fmt"
+	"image"
+	"math/bits"
+	"slices"
+	"strconv"
+
+	"golang.org/x/image/draw"
+)
+
+// the size DHash scales to, one more column than bits per row
+const (
+	Width  = 9
+	Height = 8
+)
+
+// Difference hash, each bit is whether a pixel of a 9x8 grayscale copy is brighter than the one to its right
+func DHash(img image.Image) uint64 {
+	small := image.NewGray(image.Rect(0, 0, Width, Height))
+	draw.CatmullRom.Scale(small, small.Bounds(), img, img.Bounds(), draw.Src, nil)
+	var h uint64
+	for y := 0; y < Height; y++ {
+		for x := 0; x < Width-1; x++ {
+			h <<= 1
+			if small.GrayAt(x, y).Y > small.GrayAt(x+1, y).Y {
+				h |= 1
+			}
+		}
+	}
+	return h
+}
+
+// Number of differing bits, 0 for the same image
+func Distance(a uint64, b uint64) int {
+	return bits.OnesCount64(a ^ b)
+}
+
+// 16 hex digits, as stored
+func Format(h uint64) string {
+	return fmt.Sprintf("%016x", h)
+}
+
+func Parse(s string) (uint64, error) {
+	return strconv.ParseUint(s, 16, 64)
+}
+
+// burkhard-keller tree, children are keyed by their distance to the node
+type bkNode struct {
+	hash     uint64
+	children map[int]*bkNode
+}
+
+func (n *bkNode) insert(h uint64) {
+	for {
+		d := Distance(n.hash, h)
+		if d == 0 {
+			return
+		}
+		child, ok := n.children[d]
+		if !ok {
+			n.children[d] = &bkNode{h, make(map[int]*bkNode)}
+			return
+		}
+		n = child
+	}
+}
+
+// calls fn with every hash within threshold of h
+func (n *bkNode) near(h uint64, threshold int, fn func(uint64)) {
+	d := Distance(n.hash, h)
+	if d <= threshold {
+		fn(n.hash)
+	}
+	// by the triangle inequality nothing else can be within threshold
+	for cd, child := range n.children {
+		if cd >= d-threshold && cd <= d+threshold {
+			child.near(h, threshold, fn)
+		}
+	}
+}
+
+// Groups the keys whose hashes are linked by a chain of distances of at most threshold.
+// Keys without any near neighbour are left out. Groups and the keys within them are sorted.
+func Group(hashes map[string]uint64, threshold int) [][]string {
+	byHash := make(map[uint64][]string)
+	var root *bkNode
+	for key, h := range hashes {
+		byHash[h] = append(byHash[h], key)
+		if root == nil {
+			root = &bkNode{h, make(map[int]*bkNode)}
+		} else {
+			root.insert(h)
+		}
+	}
+
+	// union find over the distinct hashes
+	parent := make(map[uint64]uint64, len(byHash))
+	var find func(uint64) uint64
+	find = func(h uint64) uint64 {
+		p, ok := parent[h]
+		if !ok || p == h {
+			return h
+		}
+		r := find(p)
+		parent[h] = r
+		return r
+	}
+	for h := range byHash {
+		root.near(h, threshold, func(o uint64) {
+			if a, b := find(h), find(o); a != b {
+				parent[a] = b
+			}
+		})
+	}
+
+	sets := make(map[uint64][]string)
+	for h, keys := range byHash {
+		r := find(h)
+		sets[r] = append(sets[r], keys...)
+	}
+	groups := make([][]string, 0)
+	for _, keys := range sets {
+		if len(keys) < 2 {
+			continue
+		}
+		slices.Sort(keys)
+		groups = append(groups, keys)
+	}
+	slices.SortFunc(groups, func(a, b []string) int {
+		return slices.Compare(a, b)
+	})
+	return groups
+}
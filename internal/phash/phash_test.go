@@ -0,0 +1,139 @@
+package phash
+
+import (
+	"image"
+	"image/color"
+	"slices"
+	"testing"
+
+	"golang.org/x/image/draw"
+)
+
+// a horizontal gradient, brighter to the right unless reversed
+func gradient(w, h int, reversed bool) image.Image {
+	img := image.NewGray(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			v := uint8(255 * x / (w - 1))
+			if reversed {
+				v = 255 - v
+			}
+			img.SetGray(x, y, color.Gray{v})
+		}
+	}
+	return img
+}
+
+func TestDHash(t *testing.T) {
+	img := gradient(200, 100, true)
+	if h := DHash(img); h != ^uint64(0) {
+		t.Errorf("falling gradient hashed to %s, want every bit set", Format(h))
+	}
+	if h := DHash(gradient(200, 100, false)); h != 0 {
+		t.Errorf("rising gradient hashed to %s, want no bit set", Format(h))
+	}
+
+	small := image.NewGray(image.Rect(0, 0, 50, 25))
+	draw.ApproxBiLinear.Scale(small, small.Bounds(), img, img.Bounds(), draw.Src, nil)
+	if d := Distance(DHash(img), DHash(small)); d > 4 {
+		t.Errorf("resized copy is %d bits away", d)
+	}
+}
+
+func TestDistance(t *testing.T) {
+	tests := []struct {
+		a, b uint64
+		want int
+	}{
+		{0, 0, 0},
+		{0, 1, 1},
+		{0xff, 0x0f, 4},
+		{0, ^uint64(0), 64},
+	}
+	for _, tt := range tests {
+		if got := Distance(tt.a, tt.b); got != tt.want {
+			t.Errorf("Distance(%x, %x) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	for _, h := range []uint64{0, 1, 0xdeadbeef, ^uint64(0)} {
+		s := Format(h)
+		if len(s) != 16 {
+			t.Errorf("Format(%x) = %q, want 16 digits", h, s)
+		}
+		if got, err := Parse(s); err != nil || got != h {
+			t.Errorf("Parse(%q) = %x, %v, want %x", s, got, err, h)
+		}
+	}
+	for _, s := range []string{"", "xyz", "-1", "10000000000000000"} {
+		if _, err := Parse(s); err == nil {
+			t.Errorf("Parse(%q) succeeded", s)
+		}
+	}
+}
+
+func TestGroup(t *testing.T) {
+	tests := []struct {
+		name      string
+		hashes    map[string]uint64
+		threshold int
+		want      [][]string
+	}{
+		{"empty", nil, 4, [][]string{}},
+		{"alone", map[string]uint64{"a": 0}, 4, [][]string{}},
+		{"same hash", map[string]uint64{"b": 7, "a": 7}, 0, [][]string{{"a", "b"}}},
+		{"near", map[string]uint64{"a": 0, "b": 0b11, "c": ^uint64(0)}, 2, [][]string{{"a", "b"}}},
+		{"too far", map[string]uint64{"a": 0, "b": 0b111}, 2, [][]string{}},
+		{"chained", map[string]uint64{"a": 0, "b": 0b11, "c": 0b1111}, 2, [][]string{{"a", "b", "c"}}},
+		{"two groups", map[string]uint64{"d": ^uint64(0), "c": ^uint64(1), "b": 1, "a": 0}, 1, [][]string{{"a", "b"}, {"c", "d"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := Group(tt.hashes, tt.threshold)
+			if !slices.EqualFunc(got, tt.want, slices.Equal) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// Group must agree with comparing every pair
+func FuzzGroup(f *testing.F) {
+	f.Add(uint64(0), uint64(3), uint64(15), uint64(1<<63), 2)
+	f.Fuzz(func(t *testing.T, a, b, c, d uint64, threshold int) {
+		threshold = min(max(threshold, 0), 64)
+		hashes := map[string]uint64{"a": a, "b": b, "c": c, "d": d}
+		group := make(map[string]int)
+		for i, keys := range Group(hashes, threshold) {
+			for _, k := range keys {
+				group[k] = i + 1
+			}
+		}
+		for k1, h1 := range hashes {
+			for k2, h2 := range hashes {
+				if k1 != k2 && Distance(h1, h2) <= threshold && (group[k1] == 0 || group[k1] != group[k2]) {
+					t.Errorf("%s and %s are %d apart but grouped %v", k1, k2, Distance(h1, h2), group)
+				}
+			}
+		}
+	})
+}
+
+func FuzzParse(f *testing.F) {
+	f.Add("00000000deadbeef")
+	f.Add("ffffffffffffffff")
+	f.Fuzz(func(t *testing.T, s string) {
+		h, err := Parse(s)
+		if err != nil {
+			return
+		}
+		if again, _ := Parse(Format(h)); again != h {
+			t.Errorf("%q parsed to %x but its formatting to %x", s, h, again)
+		}
+		if len(Format(h)) != 16 {
+			t.Errorf("%x formatted to %q", h, Format(h))
+		}
+	})
+}
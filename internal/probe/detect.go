@@ -0,0 +1,299 @@
+package probe
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"path"
+	"slices"
+	"strings"
+	"unicode/utf8"
+)
+
+// how much of the start of a file signatures are looked for in
+const sniffLen = 4096
+
+const ebmlDocType = 0x4282
+
+// by major brand, see https://mp4ra.org/registered-types/brands
+var ftypBrands = map[string]string{
+	"heic": "image/heic",
+	"heix": "image/heic",
+	"heim": "image/heic",
+	"heis": "image/heic",
+	"hevc": "image/heic-sequence",
+	"hevx": "image/heic-sequence",
+	"mif1": "image/heif",
+	"msf1": "image/heif-sequence",
+	"avif": "image/avif",
+	"avis": "image/avif-sequence",
+	"qt  ": "video/quicktime",
+	"M4A ": "audio/mp4",
+	"M4B ": "audio/mp4",
+	"3gp4": "video/3gpp",
+	"3gp5": "video/3gpp",
+	"3gp6": "video/3gpp",
+	"3g2a": "video/3gpp2",
+}
+
+// for when the content alone is not conclusive
+var extensions = map[string]string{
+	".txt":      "text/plain",
+	".md":       "text/markdown",
+	".markdown": "text/markdown",
+	".csv":      "text/csv",
+	".tsv":      "text/tab-separated-values",
+	".html":     "text/html",
+	".htm":      "text/html",
+	".css":      "text/css",
+	".js":       "text/javascript",
+	".xml":      "text/xml",
+	".vtt":      "text/vtt",
+	".srt":      "application/x-subrip",
+	".json":     "application/json",
+	".yaml":     "application/yaml",
+	".yml":      "application/yaml",
+	".svg":      "image/svg+xml",
+	".heic":     "image/heic",
+	".heif":     "image/heif",
+	".avif":     "image/avif",
+	".psd":      "image/vnd.adobe.photoshop",
+	".mp3":      "audio/mpeg",
+	".aac":      "audio/aac",
+	".m4a":      "audio/mp4",
+	".flac":     "audio/flac",
+	".ogg":      "audio/ogg",
+	".opus":     "audio/ogg",
+	".wav":      "audio/wav",
+	".mka":      "audio/x-matroska",
+	".mkv":      "video/x-matroska",
+	".webm":     "video/webm",
+	".docx":     "application/vnd.openxmlformats-officedocument.wordprocessingml.document",
+	".xlsx":     "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+	".pptx":     "application/vnd.openxmlformats-officedocument.presentationml.presentation",
+	".epub":     "application/epub+zip",
+	".jar":      "application/java-archive",
+	".apk":      "application/vnd.android.package-archive",
+}
+
+// extensions of formats that are zip archives inside
+var zipBased = []string{".docx", ".xlsx", ".pptx", ".epub", ".jar", ".apk"}
+
+// Finds the mimetype of a file from its content, looking inside containers where the
+// signature alone is ambiguous. The extension of filename is only used when the content
+// does not say, or to narrow down plain text and zip archives.
+func Detect(r io.ReaderAt, size int64, filename string) string {
+	head := make([]byte, min(size, sniffLen))
+	n, _ := r.ReadAt(head, 0)
+	head = head[:n]
+
+	mimetype := sniff(head)
+	if mimetype == "" {
+		mimetype = http.DetectContentType(head)
+	}
+	switch mimetype {
+	case "video/mp4":
+		if info, err := probeMp4(r, size); err == nil && info.Width == 0 {
+			mimetype = "audio/mp4"
+		}
+	case "video/webm", "video/x-matroska":
+		if info, err := probeWebm(r, size); err == nil && info.Width == 0 {
+			mimetype = "audio/" + strings.TrimPrefix(mimetype, "video/")
+		}
+	case "application/octet-stream":
+		mimetype = weakSniff(head)
+	}
+	mimetype = textCharset(mimetype, head)
+
+	byExt, ok := extensions[strings.ToLower(path.Ext(filename))]
+	if !ok {
+		return mimetype
+	}
+	base, charset, _ := strings.Cut(mimetype, ";")
+	switch {
+	case base == "application/octet-stream":
+		return byExt
+	case base == "text/plain" && strings.HasPrefix(byExt, "text/") && charset != "":
+		return byExt + ";" + charset
+	case base == "text/plain" && (strings.HasPrefix(byExt, "text/") || strings.HasPrefix(byExt, "application/")):
+		return byExt
+	case base == "application/zip" && slices.Contains(zipBased, strings.ToLower(path.Ext(filename))):
+		return byExt
+	}
+	return mimetype
+}
+
+// signatures http.DetectContentType does not know or gets wrong, "" if none match
+func sniff(head []byte) string {
+	switch {
+	case len(head) >= 12 && string(head[4:8]) == "ftyp":
+		return ftypType(head)
+	case bytes.HasPrefix(head, []byte("\x1A\x45\xDF\xA3")):
+		return ebmlType(head)
+	case bytes.HasPrefix(head, []byte("fLaC")):
+		return "audio/flac"
+	case bytes.HasPrefix(head, []byte("OggS")):
+		return oggType(head)
+	case bytes.HasPrefix(head, []byte("#!AMR")):
+		return "audio/amr"
+	case bytes.HasPrefix(head, []byte("8BPS")):
+		return "image/vnd.adobe.photoshop"
+	case bytes.HasPrefix(head, []byte("PK\x03\x04")):
+		return zipType(head)
+	case isSvg(head):
+		return "image/svg+xml"
+	}
+	return ""
+}
+
+// signatures too short to trust before http.DetectContentType has had its say
+func weakSniff(head []byte) string {
+	switch {
+	case len(head) >= 2 && head[0] == 0xFF && head[1]&0xF6 == 0xF0:
+		// adts frame header, layer is always 0
+		return "audio/aac"
+	case len(head) >= 2 && head[0] == 0xFF && head[1]&0xE0 == 0xE0 && head[1]&0x06 != 0:
+		// mpeg audio frame without an id3 tag
+		return "audio/mpeg"
+	}
+	return utf16Text(head)
+}
+
+// iso base media files say what they hold with brands
+func ftypType(head []byte) string {
+	size := min(int(binary.BigEndian.Uint32(head[0:4])), len(head))
+	if t, ok := ftypBrands[string(head[8:12])]; ok {
+		// a generic heif may still be declared compatible with something more specific
+		if t != "image/heif" {
+			return t
+		}
+	}
+	// compatible brands come after the major brand and minor version
+	for i := 16; i+4 <= size; i += 4 {
+		switch string(head[i : i+4]) {
+		case "avif":
+			return "image/avif"
+		case "heic", "heix":
+			return "image/heic"
+		}
+	}
+	if string(head[8:12]) == "mif1" {
+		return "image/heif"
+	}
+	return "video/mp4"
+}
+
+// matroska and webm are told apart by the doctype in the ebml header
+func ebmlType(head []byte) string {
+	r := bytes.NewReader(head)
+	hdr, err := readElement(r, 0)
+	if err != nil {
+		return ""
+	}
+	doctype := ""
+	ebmlWalk(r, hdr.start, hdr.end(int64(len(head))), func(e element) (bool, error) {
+		if e.id == ebmlDocType && e.size > 0 && e.start+e.size <= int64(len(head)) {
+			doctype = string(bytes.TrimRight(head[e.start:e.start+e.size], "\x00"))
+			return false, nil
+		}
+		return true, nil
+	})
+	switch doctype {
+	case "webm":
+		return "video/webm"
+	case "matroska":
+		return "video/x-matroska"
+	}
+	return ""
+}
+
+// the codec of the first logical stream is named in its first packet
+func oggType(head []byte) string {
+	switch {
+	case bytes.Contains(head, []byte("\x80theora")):
+		return "video/ogg"
+	case bytes.Contains(head, []byte("OpusHead")), bytes.Contains(head, []byte("\x01vorbis")),
+		bytes.Contains(head, []byte("Speex   ")), bytes.Contains(head, []byte("\x7FFLAC")):
+		return "audio/ogg"
+	}
+	return "application/ogg"
+}
+
+// epub and opendocument files start with an uncompressed entry named "mimetype" holding their type
+func zipType(head []byte) string {
+	if len(head) < 30 || string(head[30:min(38, len(head))]) != "mimetype" {
+		return ""
+	}
+	size := int(binary.LittleEndian.Uint32(head[18:22]))
+	nameLen := int(binary.LittleEndian.Uint16(head[26:28]))
+	extraLen := int(binary.LittleEndian.Uint16(head[28:30]))
+	start := 30 + nameLen + extraLen
+	// only stored entries can be read directly
+	if binary.LittleEndian.Uint16(head[8:10]) != 0 || start+size > len(head) || size > 100 {
+		return ""
+	}
+	return string(head[start : start+size])
+}
+
+// the root element is svg, after any declaration, comments and doctype
+func isSvg(head []byte) bool {
+	text := bytes.TrimPrefix(head, []byte("\xEF\xBB\xBF"))
+	for {
+		text = bytes.TrimLeft(text, " \t\r\n")
+		end := ""
+		switch {
+		case bytes.HasPrefix(text, []byte("<svg")):
+			return true
+		case bytes.HasPrefix(text, []byte("<?")):
+			end = "?>"
+		case bytes.HasPrefix(text, []byte("<!--")):
+			end = "-->"
+		case bytes.HasPrefix(text, []byte("<!")):
+			end = ">"
+		default:
+			return false
+		}
+		_, rest, ok := bytes.Cut(text, []byte(end))
+		if !ok {
+			return false
+		}
+		text = rest
+	}
+}
+
+// text in utf-16 without a byte order mark has a zero in every other byte while it is ascii
+func utf16Text(head []byte) string {
+	if len(head) < 16 {
+		return "application/octet-stream"
+	}
+	var zeros [2]int
+	for i, b := range head[:len(head)&^1] {
+		if b == 0 {
+			zeros[i%2]++
+		}
+	}
+	pairs := len(head) / 2
+	switch {
+	case zeros[1] > pairs*9/10 && zeros[0] == 0:
+		return "text/plain; charset=utf-16le"
+	case zeros[0] > pairs*9/10 && zeros[1] == 0:
+		return "text/plain; charset=utf-16be"
+	}
+	return "application/octet-stream"
+}
+
+// http.DetectContentType calls all text without a byte order mark utf-8
+func textCharset(mimetype string, head []byte) string {
+	base, ok := strings.CutSuffix(mimetype, "; charset=utf-8")
+	if !ok || utf8.Valid(head) {
+		return mimetype
+	}
+	// the head may have been cut within a character
+	for i := 1; i < utf8.UTFMax && i < len(head); i++ {
+		if utf8.Valid(head[:len(head)-i]) {
+			return mimetype
+		}
+	}
+	return base + "; charset=windows-1252"
+}
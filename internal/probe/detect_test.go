@@ -0,0 +1,108 @@
+package probe
+
+import (
+	"archive/zip"
+	"bytes"
+	"hash/crc32"
+	"testing"
+)
+
+// a zip whose first entry is stored with its sizes in the local header
+func zipWith(name string, content string) []byte {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	w, _ := zw.CreateRaw(&zip.FileHeader{
+		Name:               name,
+		Method:             zip.Store,
+		CRC32:              crc32.ChecksumIEEE([]byte(content)),
+		CompressedSize64:   uint64(len(content)),
+		UncompressedSize64: uint64(len(content)),
+	})
+	w.Write([]byte(content))
+	zw.Close()
+	return buf.Bytes()
+}
+
+func utf16le(s string) []byte {
+	var b []byte
+	for _, c := range s {
+		b = append(b, byte(c), 0)
+	}
+	return b
+}
+
+func TestDetect(t *testing.T) {
+	tests := []struct {
+		name     string
+		content  []byte
+		filename string
+		want     string
+	}{
+		{"png", pngBytes(2, 2), "", "image/png"},
+		{"png named otherwise", pngBytes(2, 2), "a.txt", "image/png"},
+		{"jpeg", []byte("\xFF\xD8\xFF\xE0\x00\x10JFIF\x00"), "", "image/jpeg"},
+		{"heic", ftyp("heic", "mif1", "heic"), "", "image/heic"},
+		{"heif declaring avif", ftyp("mif1", "mif1", "avif"), "", "image/avif"},
+		{"plain heif", ftyp("mif1", "mif1"), "", "image/heif"},
+		{"quicktime", ftyp("qt  "), "", "video/quicktime"},
+		{"mp4", mp4(1000, 1000, 16, 9), "", "video/mp4"},
+		{"mp4 sound only", mp4(1000, 1000, 0, 0), "", "audio/mp4"},
+		{"webm", webm(1000000, 1000, 16, 9), "", "video/webm"},
+		{"webm sound only", ebml("webm"), "", "audio/webm"},
+		{"matroska", ebml("matroska"), "", "audio/x-matroska"},
+		{"flac", []byte("fLaC\x00\x00\x00\x22"), "", "audio/flac"},
+		{"opus", []byte("OggS\x00\x02\x00\x00\x00\x00\x00\x00\x00\x00OpusHead"), "", "audio/ogg"},
+		{"theora", []byte("OggS\x00\x02\x00\x00\x00\x00\x00\x00\x00\x00\x80theora"), "", "video/ogg"},
+		{"svg", []byte("<?xml version=\"1.0\"?>\n<!-- drawn -->\n<!DOCTYPE svg>\n<svg xmlns=\"http://www.w3.org/2000/svg\"/>"), "", "image/svg+xml"},
+		{"html", []byte("<!DOCTYPE html><html></html>"), "", "text/html; charset=utf-8"},
+		{"zip", zipWith("a.txt", "hello"), "a.zip", "application/zip"},
+		{"docx", zipWith("[Content_Types].xml", "<Types/>"), "a.docx", "application/vnd.openxmlformats-officedocument.wordprocessingml.document"},
+		{"epub", zipWith("mimetype", "application/epub+zip"), "book", "application/epub+zip"},
+		{"text", []byte("hello"), "", "text/plain; charset=utf-8"},
+		{"markdown", []byte("# hello"), "notes.MD", "text/markdown; charset=utf-8"},
+		{"csv", []byte("a,b\n1,2\n"), "t.csv", "text/csv; charset=utf-8"},
+		{"latin-1", []byte("caf\xe9 au lait"), "", "text/plain; charset=windows-1252"},
+		{"utf-8 cut in a character", []byte("caf\xc3"), "", "text/plain; charset=utf-8"},
+		{"utf-16", utf16le("sixteen bit text"), "", "text/plain; charset=utf-16le"},
+		{"binary", []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}, "", "application/octet-stream"},
+		{"binary by extension", []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}, "a.psd", "image/vnd.adobe.photoshop"},
+		{"empty", nil, "", "text/plain; charset=utf-8"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Detect(bytes.NewReader(tt.content), int64(len(tt.content)), tt.filename); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestActive(t *testing.T) {
+	for mimetype, want := range map[string]bool{
+		"text/html":                 true,
+		"text/html; charset=utf-8":  true,
+		"Image/SVG+XML":             true,
+		"application/xhtml+xml":     true,
+		"application/rss+xml":       true,
+		"text/xml":                  true,
+		"text/plain; charset=utf-8": false,
+		"image/png":                 false,
+		"application/pdf":           false,
+		"":                          false,
+	} {
+		if got := Active(mimetype); got != want {
+			t.Errorf("Active(%q) = %v, want %v", mimetype, got, want)
+		}
+	}
+}
+
+func FuzzDetect(f *testing.F) {
+	for _, seed := range [][]byte{pngBytes(1, 1), ftyp("mif1", "avif"), ebml("webm"), zipWith("mimetype", "application/epub+zip"), []byte("<svg/>"), utf16le("text for sixteen")} {
+		f.Add(seed, "")
+	}
+	f.Fuzz(func(t *testing.T, content []byte, filename string) {
+		if Detect(bytes.NewReader(content), int64(len(content)), filename) == "" {
+			t.Error("no mimetype")
+		}
+	})
+}
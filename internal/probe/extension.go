@@ -0,0 +1,92 @@
+package probe
+
+import (
+	"mime"
+	"path"
+	"strings"
+)
+
+// the usual extension where a type has several, or where the system may not know it
+var preferredExtensions = map[string]string{
+	"image/jpeg":       ".jpg",
+	"image/png":        ".png",
+	"image/gif":        ".gif",
+	"image/webp":       ".webp",
+	"image/bmp":        ".bmp",
+	"image/heic":       ".heic",
+	"image/heif":       ".heif",
+	"image/avif":       ".avif",
+	"image/svg+xml":    ".svg",
+	"video/mp4":        ".mp4",
+	"video/webm":       ".webm",
+	"video/quicktime":  ".mov",
+	"video/x-matroska": ".mkv",
+	"video/ogg":        ".ogv",
+	"video/3gpp":       ".3gp",
+	"audio/mpeg":       ".mp3",
+	"audio/mp4":        ".m4a",
+	"audio/aac":        ".aac",
+	"audio/webm":       ".weba",
+	"audio/x-matroska": ".mka",
+	"audio/ogg":        ".ogg",
+	"audio/flac":       ".flac",
+	"audio/wave":       ".wav",
+	"audio/aiff":       ".aiff",
+	"audio/midi":       ".mid",
+	"text/plain":       ".txt",
+	"text/html":        ".html",
+	"text/markdown":    ".md",
+	"text/xml":         ".xml",
+	"application/pdf":  ".pdf",
+	"application/zip":  ".zip",
+	"application/json": ".json",
+	"application/ogg":  ".ogg",
+}
+
+// The extension, with its dot, usually given to files of mimetype, "" if there is none
+func Extension(mimetype string) string {
+	base, _, _ := strings.Cut(mimetype, ";")
+	base = strings.TrimSpace(base)
+	if ext, ok := preferredExtensions[base]; ok {
+		return ext
+	}
+	if exts, err := mime.ExtensionsByType(base); err == nil && len(exts) != 0 {
+		return exts[0]
+	}
+	return ""
+}
+
+// Whether the extension of filename is one for mimetype
+func HasExtension(filename string, mimetype string) bool {
+	ext := strings.ToLower(path.Ext(filename))
+	if ext == "" {
+		return false
+	}
+	base, _, _ := strings.Cut(mimetype, ";")
+	base = strings.TrimSpace(base)
+	if extensions[ext] == base || preferredExtensions[base] == ext {
+		return true
+	}
+	byExt, _, _ := strings.Cut(mime.TypeByExtension(ext), ";")
+	return byExt == base
+}
+
+// A name to save a file as, name if it already has a fitting extension
+// and otherwise with the extension of mimetype added
+func Filename(name string, mimetype string) string {
+	if HasExtension(name, mimetype) {
+		return name
+	}
+	return name + Extension(mimetype)
+}
+
+// Whether a browser may run scripts in content of mimetype when it is opened on its own
+func Active(mimetype string) bool {
+	base, _, _ := strings.Cut(mimetype, ";")
+	base = strings.ToLower(strings.TrimSpace(base))
+	switch base {
+	case "text/html", "application/xhtml+xml", "text/xml", "application/xml":
+		return true
+	}
+	return strings.HasSuffix(base, "+xml")
+}
@@ -0,0 +1,61 @@
+package probe
+
+import "testing"
+
+func TestExtension(t *testing.T) {
+	for mimetype, want := range map[string]string{
+		"image/jpeg":                ".jpg",
+		"image/png":                 ".png",
+		"text/plain; charset=utf-8": ".txt",
+		" application/pdf ":         ".pdf",
+		"application/x-unknown":     "",
+		"":                          "",
+	} {
+		if got := Extension(mimetype); got != want {
+			t.Errorf("Extension(%q) = %q, want %q", mimetype, got, want)
+		}
+	}
+}
+
+func TestHasExtension(t *testing.T) {
+	tests := []struct {
+		filename string
+		mimetype string
+		want     bool
+	}{
+		{"photo.jpg", "image/jpeg", true},
+		{"photo.JPEG", "image/jpeg", true},
+		{"photo.png", "image/jpeg", false},
+		{"photo", "image/jpeg", false},
+		{"notes.txt", "text/plain; charset=utf-8", true},
+		{"readme.md", "text/markdown; charset=utf-8", true},
+		{"archive.tar.gz", "application/gzip", true},
+		{".jpg", "image/jpeg", true},
+	}
+	for _, tt := range tests {
+		if got := HasExtension(tt.filename, tt.mimetype); got != tt.want {
+			t.Errorf("HasExtension(%q, %q) = %v, want %v", tt.filename, tt.mimetype, got, tt.want)
+		}
+	}
+}
+
+func TestFilename(t *testing.T) {
+	tests := []struct {
+		name     string
+		mimetype string
+		want     string
+	}{
+		{"photo.jpg", "image/jpeg", "photo.jpg"},
+		{"photo.JPEG", "image/jpeg", "photo.JPEG"},
+		{"photo", "image/jpeg", "photo.jpg"},
+		{"photo.png", "image/jpeg", "photo.png.jpg"},
+		{"notes", "text/plain; charset=utf-8", "notes.txt"},
+		{"readme.md", "text/markdown", "readme.md"},
+		{"data", "application/x-unknown", "data"},
+	}
+	for _, tt := range tests {
+		if got := Filename(tt.name, tt.mimetype); got != tt.want {
+			t.Errorf("Filename(%q, %q) = %q, want %q", tt.name, tt.mimetype, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package probe
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+// iso base media boxes, see ISO/IEC 14496-12
+type box struct {
+	typ string
+	// of the content, after the header
+	start int64
+	end   int64
+}
+
+// the boxes directly inside [start, end)
+func mp4Boxes(r io.ReaderAt, start int64, end int64) ([]box, error) {
+	var boxes []box
+	for off := start; off+8 <= end; {
+		var hdr [16]byte
+		if _, err := r.ReadAt(hdr[:8], off); err != nil {
+			return nil, err
+		}
+		size := int64(binary.BigEndian.Uint32(hdr[0:4]))
+		content := off + 8
+		switch size {
+		case 0:
+			size = end - off
+		case 1:
+			if _, err := r.ReadAt(hdr[8:16], off+8); err != nil {
+				return nil, err
+			}
+			size = int64(binary.BigEndian.Uint64(hdr[8:16]))
+			content += 8
+		}
+		if size < content-off || off+size > end {
+			return nil, UNKNOWN_FORMAT
+		}
+		boxes = append(boxes, box{string(hdr[4:8]), content, off + size})
+		off += size
+	}
+	return boxes, nil
+}
+
+func findBox(boxes []box, typ string) (box, bool) {
+	for _, b := range boxes {
+		if b.typ == typ {
+			return b, true
+		}
+	}
+	return box{}, false
+}
+
+func probeMp4(r io.ReaderAt, size int64) (Info, error) {
+	var info Info
+	top, err := mp4Boxes(r, 0, size)
+	if err != nil {
+		return info, err
+	}
+	moov, ok := findBox(top, "moov")
+	if !ok {
+		return info, UNKNOWN_FORMAT
+	}
+	inner, err := mp4Boxes(r, moov.start, moov.end)
+	if err != nil {
+		return info, err
+	}
+	if mvhd, ok := findBox(inner, "mvhd"); ok {
+		info.Duration, err = mvhdDuration(r, mvhd)
+		if err != nil {
+			return info, err
+		}
+	}
+	// the first track with a picture gives the dimensions
+	for _, trak := range inner {
+		if trak.typ != "trak" {
+			continue
+		}
+		tb, err := mp4Boxes(r, trak.start, trak.end)
+		if err != nil {
+			return info, err
+		}
+		tkhd, ok := findBox(tb, "tkhd")
+		if !ok {
+			continue
+		}
+		w, h, err := tkhdSize(r, tkhd)
+		if err != nil {
+			return info, err
+		}
+		if w != 0 && h != 0 {
+			info.Width, info.Height = w, h
+			break
+		}
+	}
+	return info, nil
+}
+
+func mvhdDuration(r io.ReaderAt, b box) (float64, error) {
+	var buf [32]byte
+	n, err := r.ReadAt(buf[:min(int64(len(buf)), b.end-b.start)], b.start)
+	if err != nil && err != io.EOF {
+		return 0, err
+	}
+	var scale, duration uint64
+	switch {
+	case n >= 20 && buf[0] == 0:
+		scale = uint64(binary.BigEndian.Uint32(buf[12:16]))
+		duration = uint64(binary.BigEndian.Uint32(buf[16:20]))
+	case n >= 32 && buf[0] == 1:
+		scale = uint64(binary.BigEndian.Uint32(buf[20:24]))
+		duration = binary.BigEndian.Uint64(buf[24:32])
+	default:
+		return 0, UNKNOWN_FORMAT
+	}
+	if scale == 0 {
+		return 0, nil
+	}
+	return float64(duration) / float64(scale), nil
+}
+
+// width and height are 16.16 fixed point at the end of the box
+func tkhdSize(r io.ReaderAt, b box) (int, int, error) {
+	var buf [8]byte
+	if b.end-b.start < 8 {
+		return 0, 0, UNKNOWN_FORMAT
+	}
+	if _, err := r.ReadAt(buf[:], b.end-8); err != nil {
+		return 0, 0, err
+	}
+	return int(binary.BigEndian.Uint32(buf[0:4]) >> 16), int(binary.BigEndian.Uint32(buf[4:8]) >> 16), nil
+}
@@ -0,0 +1,75 @@
+// Reads dimensions and durations from file headers without decoding the content
+package probe
+
+import (
+	"encoding/binary"
+	"errors"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+
+	_ "golang.org/x/image/webp"
+)
+
+var UNKNOWN_FORMAT = errors.New("format cannot be probed")
+
+// Zero fields could not be found
+type Info struct {
+	Width  int
+	Height int
+	// in seconds
+	Duration float64
+}
+
+// Reads what it can from the file according to its mimetype.
+// Returns UNKNOWN_FORMAT for mimetypes that are not understood.
+func Probe(r io.ReaderAt, size int64, mimetype string) (Info, error) {
+	switch mimetype {
+	case "image/png", "image/jpeg", "image/gif", "image/webp":
+		cfg, _, err := image.DecodeConfig(io.NewSectionReader(r, 0, size))
+		return Info{Width: cfg.Width, Height: cfg.Height}, err
+	case "video/mp4", "video/quicktime", "audio/mp4":
+		return probeMp4(r, size)
+	case "video/webm", "audio/webm", "video/x-matroska":
+		return probeWebm(r, size)
+	case "audio/wave", "audio/wav", "audio/x-wav":
+		return probeWav(r, size)
+	}
+	return Info{}, UNKNOWN_FORMAT
+}
+
+func probeWav(r io.ReaderAt, size int64) (Info, error) {
+	var hdr [12]byte
+	if _, err := r.ReadAt(hdr[:], 0); err != nil {
+		return Info{}, err
+	}
+	if string(hdr[0:4]) != "RIFF" || string(hdr[8:12]) != "WAVE" {
+		return Info{}, UNKNOWN_FORMAT
+	}
+	var byteRate, dataSize uint32
+	for off := int64(12); off+8 <= size; {
+		var ch [8]byte
+		if _, err := r.ReadAt(ch[:], off); err != nil {
+			return Info{}, err
+		}
+		csize := int64(binary.LittleEndian.Uint32(ch[4:8]))
+		switch string(ch[0:4]) {
+		case "fmt ":
+			var fmt [12]byte
+			if _, err := r.ReadAt(fmt[:], off+8); err != nil {
+				return Info{}, err
+			}
+			byteRate = binary.LittleEndian.Uint32(fmt[8:12])
+		case "data":
+			dataSize = uint32(csize)
+		}
+		// chunks are padded to an even size
+		off += 8 + csize + csize%2
+	}
+	if byteRate == 0 {
+		return Info{}, nil
+	}
+	return Info{Duration: float64(dataSize) / float64(byteRate)}, nil
+}
@@ -0,0 +1,133 @@
+package probe
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/png"
+	"math"
+	"testing"
+)
+
+func pngBytes(w, h int) []byte {
+	var buf bytes.Buffer
+	png.Encode(&buf, image.NewGray(image.Rect(0, 0, w, h)))
+	return buf.Bytes()
+}
+
+func u32(v uint32) []byte {
+	return binary.BigEndian.AppendUint32(nil, v)
+}
+
+func mp4Box(typ string, content ...[]byte) []byte {
+	body := bytes.Join(content, nil)
+	return append(append(u32(uint32(8+len(body))), typ...), body...)
+}
+
+// an iso media file with only its ftyp box
+func ftyp(major string, compatible ...string) []byte {
+	content := [][]byte{[]byte(major), u32(0)}
+	for _, c := range compatible {
+		content = append(content, []byte(c))
+	}
+	return mp4Box("ftyp", content...)
+}
+
+// a version 0 mvhd and a trak whose tkhd has the given size
+func mp4(scale uint32, duration uint32, width uint32, height uint32) []byte {
+	mvhd := mp4Box("mvhd", u32(0), make([]byte, 8), u32(scale), u32(duration), make([]byte, 80))
+	// a sound track comes first and has no size
+	sound := mp4Box("trak", mp4Box("tkhd", make([]byte, 76), u32(0), u32(0)))
+	video := mp4Box("trak", mp4Box("tkhd", make([]byte, 76), u32(width<<16), u32(height<<16)))
+	return append(ftyp("isom", "isom"), mp4Box("moov", mvhd, sound, video)...)
+}
+
+// an element with an eight byte size, or an unknown size if content is nil
+func ebmlElement(id uint32, content ...[]byte) []byte {
+	var b []byte
+	for shift := 24; shift >= 0; shift -= 8 {
+		if c := byte(id >> shift); c != 0 || len(b) != 0 {
+			b = append(b, c)
+		}
+	}
+	if content == nil {
+		return append(b, 0x01, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF)
+	}
+	body := bytes.Join(content, nil)
+	b = append(b, 0x01)
+	b = append(b, binary.BigEndian.AppendUint64(nil, uint64(len(body)))[1:]...)
+	return append(b, body...)
+}
+
+// an ebml header with only the doctype
+func ebml(doctype string) []byte {
+	return ebmlElement(ebmlHeader, ebmlElement(0x4282, []byte(doctype)))
+}
+
+// a webm with info and tracks, then a cluster of unknown size
+func webm(scale uint32, duration float64, width uint32, height uint32) []byte {
+	info := ebmlElement(ebmlInfo,
+		ebmlElement(ebmlScale, u32(scale)),
+		ebmlElement(ebmlDuration, binary.BigEndian.AppendUint64(nil, math.Float64bits(duration))))
+	tracks := ebmlElement(ebmlTracks,
+		ebmlElement(ebmlTrack, ebmlElement(0xD7, []byte{1})),
+		ebmlElement(ebmlTrack, ebmlElement(ebmlVideo, ebmlElement(ebmlWidth, u32(width)), ebmlElement(ebmlHeight, u32(height)))))
+	segment := ebmlElement(ebmlSegment, info, tracks, ebmlElement(ebmlCluster, nil))
+	return append(ebml("webm"), segment...)
+}
+
+// a wav with the given byte rate and amount of sound data
+func wav(byteRate uint32, dataSize uint32) []byte {
+	b := []byte("RIFF\x00\x00\x00\x00WAVEfmt \x10\x00\x00\x00")
+	b = append(b, 1, 0, 2, 0)
+	b = binary.LittleEndian.AppendUint32(b, byteRate/4)
+	b = binary.LittleEndian.AppendUint32(b, byteRate)
+	b = append(b, 4, 0, 16, 0)
+	b = append(b, "data"...)
+	b = binary.LittleEndian.AppendUint32(b, dataSize)
+	return append(b, make([]byte, dataSize)...)
+}
+
+func TestProbe(t *testing.T) {
+	tests := []struct {
+		name     string
+		content  []byte
+		mimetype string
+		want     Info
+		err      bool
+	}{
+		{"png", pngBytes(3, 2), "image/png", Info{Width: 3, Height: 2}, false},
+		{"truncated png", pngBytes(3, 2)[:10], "image/png", Info{}, true},
+		{"mp4", mp4(1000, 2500, 1920, 1080), "video/mp4", Info{Width: 1920, Height: 1080, Duration: 2.5}, false},
+		{"mp4 sound only", mp4(44100, 44100, 0, 0), "audio/mp4", Info{Duration: 1}, false},
+		{"mp4 without moov", ftyp("isom"), "video/mp4", Info{}, true},
+		{"mp4 box past the end", append(u32(100), "moov"...), "video/mp4", Info{}, true},
+		{"webm", webm(1000000, 1500, 640, 360), "video/webm", Info{Width: 640, Height: 360, Duration: 1.5}, false},
+		{"webm with a coarser scale", webm(10000000, 30, 0, 0), "audio/webm", Info{Duration: 0.3}, false},
+		{"not webm", []byte("\x1A\x45\xDF"), "video/webm", Info{}, true},
+		{"wav", wav(1000, 500), "audio/wav", Info{Duration: 0.5}, false},
+		{"wav without format", []byte("RIFF\x00\x00\x00\x00WAVEdata\x00\x00\x00\x00"), "audio/wave", Info{}, false},
+		{"not a wav", []byte("RIFF\x00\x00\x00\x00AVI "), "audio/wav", Info{}, true},
+		{"unknown", []byte("x"), "text/plain", Info{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Probe(bytes.NewReader(tt.content), int64(len(tt.content)), tt.mimetype)
+			if (err != nil) != tt.err {
+				t.Fatalf("error %v, want error %v", err, tt.err)
+			}
+			if !tt.err && got != tt.want {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func FuzzProbe(f *testing.F) {
+	f.Add(mp4(1000, 2500, 16, 9), "video/mp4")
+	f.Add(webm(1000000, 1500, 16, 9), "video/webm")
+	f.Add(wav(8, 16), "audio/wav")
+	f.Fuzz(func(t *testing.T, content []byte, mimetype string) {
+		Probe(bytes.NewReader(content), int64(len(content)), mimetype)
+	})
+}
@@ -0,0 +1,199 @@
+package probe
+
+import (
+	"encoding/binary"
+	"io"
+	"math"
+)
+
+// matroska element ids, see RFC 9559
+const (
+	ebmlHeader    = 0x1A45DFA3
+	ebmlSegment   = 0x18538067
+	ebmlInfo      = 0x1549A966
+	ebmlScale     = 0x2AD7B1
+	ebmlDuration  = 0x4489
+	ebmlTracks    = 0x1654AE6B
+	ebmlTrack     = 0xAE
+	ebmlVideo     = 0xE0
+	ebmlWidth     = 0xB0
+	ebmlHeight    = 0xBA
+	ebmlCluster   = 0x1F43B675
+	ebmlUnsized   = -1
+	ebmlMaxVarint = 8
+)
+
+type element struct {
+	id    uint64
+	start int64
+	// ebmlUnsized if the element runs until its parent ends
+	size int64
+}
+
+// reads a variable length integer, keeping the length marker for ids
+func readVarint(r io.ReaderAt, off int64, keepMarker bool) (uint64, int, error) {
+	var first [1]byte
+	if _, err := r.ReadAt(first[:], off); err != nil {
+		return 0, 0, err
+	}
+	n := 1
+	for mask := byte(0x80); n <= ebmlMaxVarint && first[0]&mask == 0; mask >>= 1 {
+		n++
+	}
+	if n > ebmlMaxVarint {
+		return 0, 0, UNKNOWN_FORMAT
+	}
+	buf := make([]byte, n)
+	if _, err := r.ReadAt(buf, off); err != nil {
+		return 0, 0, err
+	}
+	if !keepMarker {
+		buf[0] &= byte(0xFF >> n)
+	}
+	var v uint64
+	for _, b := range buf {
+		v = v<<8 | uint64(b)
+	}
+	return v, n, nil
+}
+
+func readElement(r io.ReaderAt, off int64) (element, error) {
+	id, n, err := readVarint(r, off, true)
+	if err != nil {
+		return element{}, err
+	}
+	size, m, err := readVarint(r, off+int64(n), false)
+	if err != nil {
+		return element{}, err
+	}
+	e := element{id: id, start: off + int64(n+m), size: int64(size)}
+	// all ones means the size is unknown
+	if size == 1<<(7*m)-1 {
+		e.size = ebmlUnsized
+	}
+	return e, nil
+}
+
+// calls fn for each element directly inside [start, end) until fn returns false
+func ebmlWalk(r io.ReaderAt, start int64, end int64, fn func(e element) (bool, error)) error {
+	for off := start; off < end; {
+		e, err := readElement(r, off)
+		if err != nil {
+			return err
+		}
+		more, err := fn(e)
+		if err != nil || !more {
+			return err
+		}
+		if e.size == ebmlUnsized {
+			return nil
+		}
+		off = e.start + e.size
+	}
+	return nil
+}
+
+func (e element) end(parent int64) int64 {
+	if e.size == ebmlUnsized || e.start+e.size > parent {
+		return parent
+	}
+	return e.start + e.size
+}
+
+func readUint(r io.ReaderAt, e element) (uint64, error) {
+	if e.size < 0 || e.size > 8 {
+		return 0, UNKNOWN_FORMAT
+	}
+	buf := make([]byte, e.size)
+	if _, err := r.ReadAt(buf, e.start); err != nil {
+		return 0, err
+	}
+	var v uint64
+	for _, b := range buf {
+		v = v<<8 | uint64(b)
+	}
+	return v, nil
+}
+
+func readFloat(r io.ReaderAt, e element) (float64, error) {
+	switch e.size {
+	case 4:
+		var buf [4]byte
+		if _, err := r.ReadAt(buf[:], e.start); err != nil {
+			return 0, err
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(buf[:]))), nil
+	case 8:
+		var buf [8]byte
+		if _, err := r.ReadAt(buf[:], e.start); err != nil {
+			return 0, err
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(buf[:])), nil
+	}
+	return 0, UNKNOWN_FORMAT
+}
+
+func probeWebm(r io.ReaderAt, size int64) (Info, error) {
+	var info Info
+	first, err := readElement(r, 0)
+	if err != nil {
+		return info, err
+	}
+	if first.id != ebmlHeader {
+		return info, UNKNOWN_FORMAT
+	}
+	// nanoseconds per timestamp unit, this is the default
+	scale := uint64(1000000)
+	var duration float64
+	err = ebmlWalk(r, 0, size, func(seg element) (bool, error) {
+		if seg.id != ebmlSegment {
+			return true, nil
+		}
+		return false, ebmlWalk(r, seg.start, seg.end(size), func(e element) (bool, error) {
+			switch e.id {
+			case ebmlInfo:
+				return true, ebmlWalk(r, e.start, e.end(size), func(f element) (bool, error) {
+					var err error
+					switch f.id {
+					case ebmlScale:
+						scale, err = readUint(r, f)
+					case ebmlDuration:
+						duration, err = readFloat(r, f)
+					}
+					return true, err
+				})
+			case ebmlTracks:
+				return true, ebmlWalk(r, e.start, e.end(size), func(track element) (bool, error) {
+					if track.id != ebmlTrack {
+						return true, nil
+					}
+					err := ebmlWalk(r, track.start, track.end(size), func(video element) (bool, error) {
+						if video.id != ebmlVideo {
+							return true, nil
+						}
+						return false, ebmlWalk(r, video.start, video.end(size), func(f element) (bool, error) {
+							var v uint64
+							var err error
+							switch f.id {
+							case ebmlWidth:
+								v, err = readUint(r, f)
+								info.Width = int(v)
+							case ebmlHeight:
+								v, err = readUint(r, f)
+								info.Height = int(v)
+							}
+							return true, err
+						})
+					})
+					return info.Width == 0, err
+				})
+			case ebmlCluster:
+				// the headers come before the media, which may not have sizes to skip it by
+				return false, nil
+			}
+			return true, nil
+		})
+	})
+	info.Duration = duration * float64(scale) / 1e9
+	return info, err
+}
@@ -0,0 +1,400 @@
+// Resumable uploads following the tus 1.0.0 protocol (https://tus.io/protocols/resumable-upload).
+// Supports the creation, expiration and termination extensions.
+package tus
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/blubywaff/ftag/internal/blob"
+	"github.com/google/uuid"
+)
+
+const Version = "1.0.0"
+
+// uploads in progress live under this prefix of the blob store
+const stagingPrefix = "staging"
+
+// Stored next to the staged data as "<id>.json"
+type Upload struct {
+	Id       string
+	Length   int64
+	Metadata map[string]string
+}
+
+// Checks an upload before anything is stored for it
+type ValidateFunc func(up Upload) error
+
+// Called once all bytes of an upload have arrived.
+// The returned string is sent back as the Ftag-Resource-Id header.
+type FinishFunc func(ctx context.Context, r io.Reader, up Upload) (string, error)
+
+type Handler struct {
+	Store blob.Store
+	// public url of the handler, used to build Location headers
+	// requests are expected to arrive with this prefix already stripped
+	BasePath string
+	MaxSize  int64
+	// how long an upload may sit without a PATCH before it is swept
+	Expiry time.Duration
+	// optional, without Finish complete uploads stay staged until they expire
+	Validate ValidateFunc
+	Finish   FinishFunc
+
+	mu     sync.Mutex
+	active map[string]bool
+}
+
+func dataKey(id string) string { return stagingPrefix + "/" + id }
+func infoKey(id string) string { return stagingPrefix + "/" + id + ".json" }
+
+// the upload a staged blob belongs to, false for the other things staged next to uploads
+func uploadId(key string) (string, bool) {
+	name, ok := strings.CutPrefix(key, stagingPrefix+"/")
+	if !ok {
+		return "", false
+	}
+	id := strings.TrimSuffix(name, ".json")
+	if u, err := uuid.Parse(id); err != nil || u.String() != id {
+		return "", false
+	}
+	return id, true
+}
+
+// parses "key base64value,key base64value"
+func parseMetadata(str string) (map[string]string, error) {
+	md := make(map[string]string)
+	if strings.TrimSpace(str) == "" {
+		return md, nil
+	}
+	for _, pair := range strings.Split(str, ",") {
+		k, v, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if k == "" {
+			return nil, errors.New("empty metadata key")
+		}
+		bts, err := base64.StdEncoding.DecodeString(v)
+		if err != nil {
+			return nil, err
+		}
+		md[k] = string(bts)
+	}
+	return md, nil
+}
+
+// marks an upload as being written to, returns false if it already is
+func (h *Handler) lock(id string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.active == nil {
+		h.active = make(map[string]bool)
+	}
+	if h.active[id] {
+		return false
+	}
+	h.active[id] = true
+	return true
+}
+
+func (h *Handler) unlock(id string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.active, id)
+}
+
+func (h *Handler) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	res.Header().Set("Tus-Resumable", Version)
+	if req.Method == "OPTIONS" {
+		res.Header().Set("Tus-Version", Version)
+		res.Header().Set("Tus-Extension", "creation,expiration,termination")
+		res.Header().Set("Tus-Max-Size", strconv.FormatInt(h.MaxSize, 10))
+		res.WriteHeader(204)
+		return
+	}
+	if req.Header.Get("Tus-Resumable") != Version {
+		res.Header().Set("Tus-Version", Version)
+		res.WriteHeader(412)
+		return
+	}
+
+	id := strings.Trim(req.URL.Path, "/")
+	if id == "" {
+		if req.Method != "POST" {
+			res.WriteHeader(405)
+			return
+		}
+		h.create(res, req)
+		return
+	}
+	if _, err := uuid.Parse(id); err != nil {
+		res.WriteHeader(404)
+		return
+	}
+	switch req.Method {
+	case "HEAD":
+		h.head(res, req, id)
+	case "PATCH":
+		h.patch(res, req, id)
+	case "DELETE":
+		h.terminate(res, req, id)
+	default:
+		res.WriteHeader(405)
+	}
+}
+
+func (h *Handler) load(ctx context.Context, id string) (Upload, error) {
+	f, err := h.Store.Open(ctx, infoKey(id))
+	if err != nil {
+		return Upload{}, err
+	}
+	defer f.Close()
+	var up Upload
+	err = json.NewDecoder(f).Decode(&up)
+	return up, err
+}
+
+func (h *Handler) create(res http.ResponseWriter, req *http.Request) {
+	length, err := strconv.ParseInt(req.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		http.Error(res, "invalid Upload-Length", 400)
+		return
+	}
+	// nothing could be stored for it, an empty file is not a resource
+	if length == 0 {
+		http.Error(res, "empty uploads are not supported", 400)
+		return
+	}
+	if length > h.MaxSize {
+		res.WriteHeader(413)
+		return
+	}
+	md, err := parseMetadata(req.Header.Get("Upload-Metadata"))
+	if err != nil {
+		http.Error(res, "invalid Upload-Metadata", 400)
+		return
+	}
+	rid, err := uuid.NewRandom()
+	if err != nil {
+		res.WriteHeader(500)
+		return
+	}
+	up := Upload{Id: rid.String(), Length: length, Metadata: md}
+	if h.Validate != nil {
+		if err := h.Validate(up); err != nil {
+			http.Error(res, err.Error(), 400)
+			return
+		}
+	}
+	bts, err := json.Marshal(up)
+	if err != nil {
+		res.WriteHeader(500)
+		return
+	}
+	if _, err := h.Store.Put(req.Context(), infoKey(up.Id), bytes.NewReader(bts)); err != nil {
+		res.WriteHeader(500)
+		log.Println("could not create tus upload info", err)
+		return
+	}
+	if _, err := h.Store.Put(req.Context(), dataKey(up.Id), bytes.NewReader(nil)); err != nil {
+		h.Store.Delete(req.Context(), infoKey(up.Id))
+		res.WriteHeader(500)
+		log.Println("could not create tus upload data", err)
+		return
+	}
+	res.Header().Set("Location", strings.TrimSuffix(h.BasePath, "/")+"/"+up.Id)
+	res.Header().Set("Upload-Expires", time.Now().Add(h.Expiry).UTC().Format(http.TimeFormat))
+	res.WriteHeader(201)
+}
+
+func (h *Handler) head(res http.ResponseWriter, req *http.Request, id string) {
+	up, err := h.load(req.Context(), id)
+	if errors.Is(err, fs.ErrNotExist) {
+		res.WriteHeader(404)
+		return
+	}
+	if err != nil {
+		res.WriteHeader(500)
+		return
+	}
+	bi, err := h.Store.Stat(req.Context(), dataKey(id))
+	if err != nil {
+		res.WriteHeader(500)
+		return
+	}
+	res.Header().Set("Cache-Control", "no-store")
+	res.Header().Set("Upload-Offset", strconv.FormatInt(bi.Size, 10))
+	res.Header().Set("Upload-Length", strconv.FormatInt(up.Length, 10))
+	res.Header().Set("Upload-Expires", bi.ModTime.Add(h.Expiry).UTC().Format(http.TimeFormat))
+	res.WriteHeader(200)
+}
+
+func (h *Handler) patch(res http.ResponseWriter, req *http.Request, id string) {
+	if req.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		res.WriteHeader(415)
+		return
+	}
+	offset, err := strconv.ParseInt(req.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		http.Error(res, "invalid Upload-Offset", 400)
+		return
+	}
+	if !h.lock(id) {
+		res.WriteHeader(423)
+		return
+	}
+	defer h.unlock(id)
+
+	up, err := h.load(req.Context(), id)
+	if errors.Is(err, fs.ErrNotExist) {
+		res.WriteHeader(404)
+		return
+	}
+	if err != nil {
+		res.WriteHeader(500)
+		return
+	}
+	bi, err := h.Store.Stat(req.Context(), dataKey(id))
+	if err != nil {
+		res.WriteHeader(500)
+		return
+	}
+	if bi.ModTime.Before(time.Now().Add(-h.Expiry)) {
+		res.WriteHeader(410)
+		return
+	}
+	if bi.Size != offset {
+		res.WriteHeader(409)
+		return
+	}
+
+	// bytes that did arrive are kept so the client can resume from them
+	n, err := h.Store.Append(req.Context(), dataKey(id), io.LimitReader(req.Body, up.Length-offset))
+	offset += n
+	res.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	res.Header().Set("Upload-Expires", time.Now().Add(h.Expiry).UTC().Format(http.TimeFormat))
+	if err != nil {
+		log.Println("tus patch interrupted", id, err)
+		res.WriteHeader(500)
+		return
+	}
+	if offset < up.Length {
+		res.WriteHeader(204)
+		return
+	}
+
+	rid, err := h.complete(req.Context(), up)
+	if err != nil {
+		log.Println("could not finish tus upload", id, err)
+		http.Error(res, "could not store upload", 500)
+		return
+	}
+	if rid != "" {
+		res.Header().Set("Ftag-Resource-Id", rid)
+	}
+	res.WriteHeader(204)
+}
+
+// Hands a complete upload to Finish and removes it, returns the id Finish gave
+func (h *Handler) complete(ctx context.Context, up Upload) (string, error) {
+	if h.Finish == nil {
+		return "", nil
+	}
+	f, err := h.Store.Open(ctx, dataKey(up.Id))
+	if err != nil {
+		return "", err
+	}
+	rid, err := h.Finish(ctx, f, up)
+	f.Close()
+	// a complete upload cannot be resumed, so if Finish failed the client has to start over
+	h.remove(up.Id)
+	return rid, err
+}
+
+func (h *Handler) terminate(res http.ResponseWriter, req *http.Request, id string) {
+	if !h.lock(id) {
+		res.WriteHeader(423)
+		return
+	}
+	defer h.unlock(id)
+	if _, err := h.Store.Stat(req.Context(), infoKey(id)); err != nil {
+		res.WriteHeader(404)
+		return
+	}
+	h.remove(id)
+	res.WriteHeader(204)
+}
+
+func (h *Handler) remove(id string) {
+	ctx := context.Background()
+	if err := h.Store.Delete(ctx, dataKey(id)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		log.Println("could not delete staged upload: " + id)
+	}
+	if err := h.Store.Delete(ctx, infoKey(id)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		log.Println("could not delete staged upload info: " + id)
+	}
+}
+
+// Removes uploads that have not been written to within Expiry,
+// anything else that is staged is left alone.
+// Returns how many uploads were removed.
+func (h *Handler) Sweep(ctx context.Context) (int, error) {
+	infos, err := h.Store.List(ctx, stagingPrefix)
+	if err != nil {
+		return 0, err
+	}
+	// an upload is as fresh as the newest of its two blobs
+	latest := make(map[string]time.Time)
+	for _, bi := range infos {
+		id, ok := uploadId(bi.Key)
+		if !ok {
+			continue
+		}
+		if bi.ModTime.After(latest[id]) {
+			latest[id] = bi.ModTime
+		}
+	}
+	cutoff := time.Now().Add(-h.Expiry)
+	removed := 0
+	for id, mt := range latest {
+		if mt.After(cutoff) || !h.lock(id) {
+			continue
+		}
+		h.remove(id)
+		h.unlock(id)
+		removed++
+	}
+	return removed, nil
+}
+
+// Calls Sweep every interval until ctx is done, never if interval is not positive
+func (h *Handler) RunSweeper(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			n, err := h.Sweep(ctx)
+			if err != nil {
+				log.Println("tus sweep failed", err)
+			}
+			if n != 0 {
+				log.Println("tus sweep removed expired uploads:", n)
+			}
+		}
+	}
+}
@@ -0,0 +1,281 @@
+package tus
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/blubywaff/ftag/internal/blob"
+)
+
+type finished struct {
+	content string
+	up      Upload
+}
+
+func newHandler(t *testing.T) (*Handler, *[]finished) {
+	var done []finished
+	h := &Handler{
+		Store:    blob.Disk{Root: t.TempDir()},
+		BasePath: "/api/tus/",
+		MaxSize:  100,
+		Expiry:   time.Hour,
+		Validate: func(up Upload) error {
+			if up.Metadata["tags"] == "bad" {
+				return errors.New("invalid tags")
+			}
+			return nil
+		},
+		Finish: func(ctx context.Context, r io.Reader, up Upload) (string, error) {
+			bts, err := io.ReadAll(r)
+			if err != nil {
+				return "", err
+			}
+			if string(bts) == "fail" {
+				return "", errors.New("could not store")
+			}
+			done = append(done, finished{string(bts), up})
+			return "rsc-" + up.Id, nil
+		},
+	}
+	return h, &done
+}
+
+func serve(h *Handler, method string, path string, body string, headers ...string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Tus-Resumable", Version)
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+// creates an upload of length bytes and returns its id
+func create(t *testing.T, h *Handler, length int, metadata string) string {
+	t.Helper()
+	rec := serve(h, "POST", "/", "", "Upload-Length", strconv.Itoa(length), "Upload-Metadata", metadata)
+	if rec.Code != 201 {
+		t.Fatalf("create answered %d: %s", rec.Code, rec.Body)
+	}
+	id, ok := strings.CutPrefix(rec.Header().Get("Location"), "/api/tus/")
+	if !ok || id == "" {
+		t.Fatalf("bad Location %q", rec.Header().Get("Location"))
+	}
+	return id
+}
+
+func patch(h *Handler, id string, offset int, body string) *httptest.ResponseRecorder {
+	return serve(h, "PATCH", "/"+id, body, "Content-Type", "application/offset+octet-stream", "Upload-Offset", strconv.Itoa(offset))
+}
+
+func TestOptions(t *testing.T) {
+	h, _ := newHandler(t)
+	req := httptest.NewRequest("OPTIONS", "/", nil)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != 204 || rec.Header().Get("Tus-Version") != Version || rec.Header().Get("Tus-Max-Size") != "100" {
+		t.Errorf("got %d %v", rec.Code, rec.Header())
+	}
+}
+
+func TestCreate(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers []string
+		status  int
+	}{
+		{"created", []string{"Upload-Length", "10"}, 201},
+		{"with metadata", []string{"Upload-Length", "10", "Upload-Metadata", "filename " + base64.StdEncoding.EncodeToString([]byte("a.txt")) + ",keywords"}, 201},
+		{"no length", nil, 400},
+		{"negative length", []string{"Upload-Length", "-1"}, 400},
+		{"empty", []string{"Upload-Length", "0"}, 400},
+		{"too large", []string{"Upload-Length", "101"}, 413},
+		{"bad metadata", []string{"Upload-Length", "10", "Upload-Metadata", "filename ???"}, 400},
+		{"not valid", []string{"Upload-Length", "10", "Upload-Metadata", "tags " + base64.StdEncoding.EncodeToString([]byte("bad"))}, 400},
+		{"old protocol", []string{"Upload-Length", "10", "Tus-Resumable", "0.2.2"}, 412},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, _ := newHandler(t)
+			rec := serve(h, "POST", "/", "", tt.headers...)
+			if rec.Code != tt.status {
+				t.Fatalf("got %d, want %d: %s", rec.Code, tt.status, rec.Body)
+			}
+			staged, err := h.Store.List(context.Background(), stagingPrefix)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.status == 201 && len(staged) != 2 || tt.status != 201 && (len(staged) != 0 || rec.Header().Get("Location") != "") {
+				t.Errorf("staged %v with Location %q", staged, rec.Header().Get("Location"))
+			}
+		})
+	}
+}
+
+func TestUpload(t *testing.T) {
+	h, done := newHandler(t)
+	md := "filename " + base64.StdEncoding.EncodeToString([]byte("a.txt"))
+	id := create(t, h, 11, md)
+
+	rec := serve(h, "HEAD", "/"+id, "")
+	if rec.Code != 200 || rec.Header().Get("Upload-Offset") != "0" || rec.Header().Get("Upload-Length") != "11" {
+		t.Fatalf("head answered %d %v", rec.Code, rec.Header())
+	}
+	if rec := patch(h, id, 0, "hello "); rec.Code != 204 || rec.Header().Get("Upload-Offset") != "6" {
+		t.Fatalf("first patch answered %d %v", rec.Code, rec.Header())
+	}
+	// a client that lost track of the offset is told so
+	if rec := patch(h, id, 0, "hello "); rec.Code != 409 {
+		t.Fatalf("patch at a stale offset answered %d", rec.Code)
+	}
+	if rec := serve(h, "HEAD", "/"+id, ""); rec.Header().Get("Upload-Offset") != "6" {
+		t.Fatalf("head after patch gave offset %q", rec.Header().Get("Upload-Offset"))
+	}
+	// bytes past the length are not taken
+	rec = patch(h, id, 6, "world and more")
+	if rec.Code != 204 || rec.Header().Get("Upload-Offset") != "11" || rec.Header().Get("Ftag-Resource-Id") != "rsc-"+id {
+		t.Fatalf("last patch answered %d %v", rec.Code, rec.Header())
+	}
+	if len(*done) != 1 || (*done)[0].content != "hello world" || (*done)[0].up.Metadata["filename"] != "a.txt" {
+		t.Fatalf("finished %+v", *done)
+	}
+	// a finished upload is gone
+	if rec := serve(h, "HEAD", "/"+id, ""); rec.Code != 404 {
+		t.Errorf("head of a finished upload answered %d", rec.Code)
+	}
+	if staged, _ := h.Store.List(context.Background(), stagingPrefix); len(staged) != 0 {
+		t.Errorf("left %v staged", staged)
+	}
+}
+
+func TestFinishFails(t *testing.T) {
+	h, done := newHandler(t)
+	id := create(t, h, 4, "")
+	if rec := patch(h, id, 0, "fail"); rec.Code != 500 {
+		t.Fatalf("patch answered %d", rec.Code)
+	}
+	if len(*done) != 0 {
+		t.Errorf("finished %+v", *done)
+	}
+	// the client has to start over
+	if rec := serve(h, "HEAD", "/"+id, ""); rec.Code != 404 {
+		t.Errorf("head answered %d", rec.Code)
+	}
+}
+
+func TestPatch(t *testing.T) {
+	tests := []struct {
+		name    string
+		id      string
+		headers []string
+		status  int
+	}{
+		{"wrong content type", "", []string{"Content-Type", "text/plain", "Upload-Offset", "0"}, 415},
+		{"no offset", "", []string{"Content-Type", "application/offset+octet-stream"}, 400},
+		{"unknown upload", "6b1c5b8c-8f7f-4c1e-9d2a-3f0e4b5a6c7d", []string{"Content-Type", "application/offset+octet-stream", "Upload-Offset", "0"}, 404},
+		{"not an id", "x", []string{"Content-Type", "application/offset+octet-stream", "Upload-Offset", "0"}, 404},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, _ := newHandler(t)
+			id := tt.id
+			if id == "" {
+				id = create(t, h, 10, "")
+			}
+			if rec := serve(h, "PATCH", "/"+id, "data", tt.headers...); rec.Code != tt.status {
+				t.Errorf("got %d, want %d", rec.Code, tt.status)
+			}
+		})
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	h, _ := newHandler(t)
+	id := create(t, h, 10, "")
+	fresh := create(t, h, 10, "")
+	old := time.Now().Add(-2 * h.Expiry)
+	root := h.Store.(blob.Disk).Root
+	for _, key := range []string{dataKey(id), infoKey(id)} {
+		if err := os.Chtimes(filepath.Join(root, filepath.FromSlash(key)), old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if rec := patch(h, id, 0, "data"); rec.Code != 410 {
+		t.Fatalf("patch of an expired upload answered %d", rec.Code)
+	}
+	n, err := h.Sweep(context.Background())
+	if err != nil || n != 1 {
+		t.Fatalf("sweep removed %d, %v", n, err)
+	}
+	if rec := serve(h, "HEAD", "/"+id, ""); rec.Code != 404 {
+		t.Errorf("head of a swept upload answered %d", rec.Code)
+	}
+	if rec := serve(h, "HEAD", "/"+fresh, ""); rec.Code != 200 {
+		t.Errorf("head of a fresh upload answered %d", rec.Code)
+	}
+}
+
+func TestTerminate(t *testing.T) {
+	h, _ := newHandler(t)
+	id := create(t, h, 10, "")
+	if rec := serve(h, "DELETE", "/"+id, ""); rec.Code != 204 {
+		t.Fatalf("delete answered %d", rec.Code)
+	}
+	if rec := serve(h, "DELETE", "/"+id, ""); rec.Code != 404 {
+		t.Errorf("second delete answered %d", rec.Code)
+	}
+	if rec := patch(h, id, 0, "data"); rec.Code != 404 {
+		t.Errorf("patch after delete answered %d", rec.Code)
+	}
+}
+
+func TestParseMetadata(t *testing.T) {
+	tests := []struct {
+		str  string
+		want map[string]string
+		err  bool
+	}{
+		{"", map[string]string{}, false},
+		{"flag", map[string]string{"flag": ""}, false},
+		{"a YQ==, b Yg==", map[string]string{"a": "a", "b": "b"}, false},
+		{"a ???", nil, true},
+		{", a YQ==", nil, true},
+	}
+	for _, tt := range tests {
+		got, err := parseMetadata(tt.str)
+		if (err != nil) != tt.err {
+			t.Errorf("parseMetadata(%q) error %v, want error %v", tt.str, err, tt.err)
+			continue
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("parseMetadata(%q) = %v, want %v", tt.str, got, tt.want)
+			continue
+		}
+		for k, v := range tt.want {
+			if got[k] != v {
+				t.Errorf("parseMetadata(%q) = %v, want %v", tt.str, got, tt.want)
+			}
+		}
+	}
+}
+
+func TestMethods(t *testing.T) {
+	h, _ := newHandler(t)
+	if rec := serve(h, "GET", "/", ""); rec.Code != 405 {
+		t.Errorf("get of the collection answered %d", rec.Code)
+	}
+	id := create(t, h, 10, "")
+	if rec := serve(h, "GET", "/"+id, ""); rec.Code != 405 {
+		t.Errorf("get of an upload answered %d", rec.Code)
+	}
+}